@@ -0,0 +1,462 @@
+// anthropic package provides middleware for partial compatibility with the Anthropic Messages API
+package anthropic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+// ImageSource is the data of an image content block
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// ContentBlock is a part of a message's content. Text and base64 encoded
+// images are supported.
+type ContentBlock struct {
+	Type   string       `json:"type"`
+	Text   string       `json:"text"`
+	Source *ImageSource `json:"source,omitempty"`
+}
+
+// Content is a list of content blocks, which may be written as a single
+// string of text
+type Content []ContentBlock
+
+func (c *Content) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*c = Content{{Type: "text", Text: text}}
+		return nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return err
+	}
+
+	*c = blocks
+	return nil
+}
+
+type Message struct {
+	Role    string  `json:"role"`
+	Content Content `json:"content"`
+}
+
+type MessagesRequest struct {
+	Model         string    `json:"model"`
+	Messages      []Message `json:"messages"`
+	System        Content   `json:"system"`
+	MaxTokens     *int      `json:"max_tokens"`
+	StopSequences []string  `json:"stop_sequences"`
+	Stream        bool      `json:"stream"`
+	Temperature   *float64  `json:"temperature"`
+	TopK          *int      `json:"top_k"`
+	TopP          *float64  `json:"top_p"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type MessagesResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        Usage          `json:"usage"`
+}
+
+type MessageStartEvent struct {
+	Type    string           `json:"type"`
+	Message MessagesResponse `json:"message"`
+}
+
+type ContentBlockStartEvent struct {
+	Type         string       `json:"type"`
+	Index        int          `json:"index"`
+	ContentBlock ContentBlock `json:"content_block"`
+}
+
+type TextDelta struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type ContentBlockDeltaEvent struct {
+	Type  string    `json:"type"`
+	Index int       `json:"index"`
+	Delta TextDelta `json:"delta"`
+}
+
+type ContentBlockStopEvent struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+}
+
+type MessageDelta struct {
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+type MessageDeltaEvent struct {
+	Type  string       `json:"type"`
+	Delta MessageDelta `json:"delta"`
+	Usage Usage        `json:"usage"`
+}
+
+type MessageStopEvent struct {
+	Type string `json:"type"`
+}
+
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch code {
+	case http.StatusBadRequest:
+		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
+	case http.StatusNotFound:
+		etype = "not_found_error"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		etype = "overloaded_error"
+	default:
+		etype = "api_error"
+	}
+
+	return ErrorResponse{Type: "error", Error: Error{Type: etype, Message: message}}
+}
+
+func messageID() string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 24)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return "msg_" + string(b)
+}
+
+// fromContent returns the text of c and the decoded data of its images
+func fromContent(c Content) (string, []api.ImageData, error) {
+	var texts []string
+	var images []api.ImageData
+	for _, block := range c {
+		switch block.Type {
+		case "text":
+			texts = append(texts, block.Text)
+		case "image":
+			if block.Source == nil || block.Source.Type != "base64" {
+				return "", nil, errors.New("only base64 image sources are supported")
+			}
+
+			img, err := base64.StdEncoding.DecodeString(block.Source.Data)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid image data: %w", err)
+			}
+
+			images = append(images, img)
+		default:
+			return "", nil, fmt.Errorf("unsupported content block type %q", block.Type)
+		}
+	}
+
+	return strings.Join(texts, "\n\n"), images, nil
+}
+
+func fromMessagesRequest(r MessagesRequest) (*api.ChatRequest, error) {
+	if r.MaxTokens == nil {
+		return nil, errors.New("max_tokens: field required")
+	}
+
+	if *r.MaxTokens < 1 {
+		return nil, errors.New("max_tokens: must be at least 1")
+	}
+
+	if len(r.Messages) == 0 {
+		return nil, errors.New("messages: at least one message is required")
+	}
+
+	var messages []api.Message
+	if len(r.System) > 0 {
+		system, images, err := fromContent(r.System)
+		if err != nil {
+			return nil, fmt.Errorf("system: %w", err)
+		}
+
+		if len(images) > 0 {
+			return nil, errors.New("system: only text content blocks are supported")
+		}
+
+		messages = append(messages, api.Message{Role: "system", Content: system})
+	}
+
+	for i, msg := range r.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, fmt.Errorf("messages.%d.role: must be user or assistant", i)
+		}
+
+		content, images, err := fromContent(msg.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages.%d.content: %w", i, err)
+		}
+
+		messages = append(messages, api.Message{Role: msg.Role, Content: content, Images: images})
+	}
+
+	options := map[string]any{
+		"num_predict": *r.MaxTokens,
+	}
+
+	if len(r.StopSequences) > 0 {
+		options["stop"] = r.StopSequences
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	}
+
+	if r.TopK != nil {
+		options["top_k"] = *r.TopK
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	}
+
+	return &api.ChatRequest{
+		Model:    r.Model,
+		Messages: messages,
+		Options:  options,
+		Stream:   &r.Stream,
+	}, nil
+}
+
+// stopReason reports why a response stopped. Responses that stop at a stop
+// sequence can't be told apart from those that end their turn.
+func stopReason(r api.ChatResponse, maxTokens int) *string {
+	reason := "end_turn"
+	if r.EvalCount >= maxTokens {
+		reason = "max_tokens"
+	}
+
+	return &reason
+}
+
+func toUsage(r api.ChatResponse) Usage {
+	return Usage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount}
+}
+
+func toMessagesResponse(id string, maxTokens int, r api.ChatResponse) MessagesResponse {
+	return MessagesResponse{
+		ID:         id,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      r.Model,
+		Content:    []ContentBlock{{Type: "text", Text: r.Message.Content}},
+		StopReason: stopReason(r, maxTokens),
+		Usage:      toUsage(r),
+	}
+}
+
+type messagesWriter struct {
+	stream    bool
+	id        string
+	maxTokens int
+
+	// started is set once the message_start event has been written
+	started bool
+	// text accumulates the response when it isn't streamed
+	text strings.Builder
+
+	gin.ResponseWriter
+}
+
+func (w *messagesWriter) writeError(code int, data []byte) (int, error) {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(NewError(code, serr.Error())); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *messagesWriter) writeEvent(event string, v any) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, d)))
+	return err
+}
+
+func (w *messagesWriter) writeEvents(r api.ChatResponse) error {
+	if !w.started {
+		w.started = true
+
+		start := MessageStartEvent{
+			Type: "message_start",
+			Message: MessagesResponse{
+				ID:      w.id,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   r.Model,
+				Content: []ContentBlock{},
+			},
+		}
+
+		if err := w.writeEvent(start.Type, start); err != nil {
+			return err
+		}
+
+		blockStart := ContentBlockStartEvent{Type: "content_block_start", ContentBlock: ContentBlock{Type: "text"}}
+		if err := w.writeEvent(blockStart.Type, blockStart); err != nil {
+			return err
+		}
+	}
+
+	if r.Message.Content != "" {
+		delta := ContentBlockDeltaEvent{Type: "content_block_delta", Delta: TextDelta{Type: "text_delta", Text: r.Message.Content}}
+		if err := w.writeEvent(delta.Type, delta); err != nil {
+			return err
+		}
+	}
+
+	if !r.Done {
+		return nil
+	}
+
+	if err := w.writeEvent("content_block_stop", ContentBlockStopEvent{Type: "content_block_stop"}); err != nil {
+		return err
+	}
+
+	delta := MessageDeltaEvent{Type: "message_delta", Delta: MessageDelta{StopReason: stopReason(r, w.maxTokens)}, Usage: toUsage(r)}
+	if err := w.writeEvent(delta.Type, delta); err != nil {
+		return err
+	}
+
+	return w.writeEvent("message_stop", MessageStopEvent{Type: "message_stop"})
+}
+
+func (w *messagesWriter) writeResponse(data []byte) (int, error) {
+	var resp struct {
+		api.ChatResponse
+		Error string `json:"error"`
+	}
+
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+
+	// errors after the response has started are sent in the stream
+	if resp.Error != "" {
+		if err := w.writeEvent("error", NewError(http.StatusInternalServerError, resp.Error)); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	if w.stream {
+		if err := w.writeEvents(resp.ChatResponse); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	w.text.WriteString(resp.Message.Content)
+	if resp.Done {
+		resp.Message.Content = w.text.String()
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w.ResponseWriter).Encode(toMessagesResponse(w.id, w.maxTokens, resp.ChatResponse)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (w *messagesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// MessagesMiddleware translates /v1/messages requests for the chat handler
+func MessagesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MessagesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		chatReq, err := fromMessagesRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+		// the writer translates the chat handler's newline delimited JSON,
+		// whatever the client accepts
+		c.Request.Header.Set("Accept", "application/x-ndjson")
+
+		c.Writer = &messagesWriter{
+			ResponseWriter: c.Writer,
+			stream:         req.Stream,
+			id:             messageID(),
+			maxTokens:      *req.MaxTokens,
+		}
+
+		c.Next()
+	}
+}
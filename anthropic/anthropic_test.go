@@ -0,0 +1,189 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestFromMessagesRequest(t *testing.T) {
+	var req MessagesRequest
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "llava",
+		"max_tokens": 128,
+		"system": [{"type": "text", "text": "Be brief."}],
+		"stop_sequences": ["\n\nHuman:"],
+		"temperature": 0.5,
+		"top_k": 40,
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "aW1hZ2U="}},
+				{"type": "text", "text": "What is this?"}
+			]},
+			{"role": "assistant", "content": "A picture."},
+			{"role": "user", "content": "Of what?"}
+		]
+	}`), &req))
+
+	chatReq, err := fromMessagesRequest(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, "llava", chatReq.Model)
+	assert.False(t, *chatReq.Stream)
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "What is this?", Images: []api.ImageData{api.ImageData("image")}},
+		{Role: "assistant", Content: "A picture."},
+		{Role: "user", Content: "Of what?"},
+	}, chatReq.Messages)
+	assert.Equal(t, map[string]any{
+		"num_predict": 128,
+		"stop":        []string{"\n\nHuman:"},
+		"temperature": 0.5,
+		"top_k":       40,
+	}, chatReq.Options)
+}
+
+func TestFromMessagesRequestErrors(t *testing.T) {
+	cases := map[string]struct {
+		body string
+		err  string
+	}{
+		"missing max_tokens": {`{"messages": [{"role": "user", "content": "Hi"}]}`, "max_tokens: field required"},
+		"no messages":        {`{"max_tokens": 10, "messages": []}`, "at least one message"},
+		"invalid role":       {`{"max_tokens": 10, "messages": [{"role": "system", "content": "Hi"}]}`, "messages.0.role: must be user or assistant"},
+		"image url":          {`{"max_tokens": 10, "messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "url", "url": "https://example.com/a.png"}}]}]}`, "only base64 image sources"},
+		"unsupported block":  {`{"max_tokens": 10, "messages": [{"role": "user", "content": [{"type": "document"}]}]}`, `unsupported content block type "document"`},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			var req MessagesRequest
+			require.NoError(t, json.Unmarshal([]byte(tt.body), &req))
+
+			_, err := fromMessagesRequest(req)
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestMessagesMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// chat stands in for the chat handler
+	chat := func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+		assert.Equal(t, "application/x-ndjson", c.GetHeader("Accept"))
+
+		switch {
+		case req.Model == "missing":
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+		case *req.Stream:
+			for _, resp := range []any{
+				api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: "Hello"}},
+				api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: " world"}},
+				api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant"}, Done: true, Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 2}},
+			} {
+				bts, _ := json.Marshal(resp)
+				c.Writer.Write(append(bts, '\n')) //nolint:errcheck
+			}
+		default:
+			c.JSON(http.StatusOK, api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: "Hello world"}, Done: true, Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 2}})
+		}
+	}
+
+	r := gin.New()
+	r.POST("/v1/messages", MessagesMiddleware(), chat)
+
+	post := func(t *testing.T, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+		req.Header.Set("Accept", "text/event-stream")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("message", func(t *testing.T) {
+		w := post(t, `{"model": "llama3", "max_tokens": 2, "messages": [{"role": "user", "content": "Hi"}]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp MessagesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.True(t, strings.HasPrefix(resp.ID, "msg_"))
+		assert.Equal(t, "message", resp.Type)
+		assert.Equal(t, "assistant", resp.Role)
+		assert.Equal(t, []ContentBlock{{Type: "text", Text: "Hello world"}}, resp.Content)
+		assert.Equal(t, "max_tokens", *resp.StopReason)
+		assert.Equal(t, Usage{InputTokens: 5, OutputTokens: 2}, resp.Usage)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		w := post(t, `{"model": "llama3", "max_tokens": 100, "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+		body, err := io.ReadAll(w.Body)
+		require.NoError(t, err)
+
+		var events []string
+		var text strings.Builder
+		for _, event := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+			name, data, ok := strings.Cut(event, "\n")
+			require.True(t, ok)
+			events = append(events, strings.TrimPrefix(name, "event: "))
+
+			if name == "event: content_block_delta" {
+				var delta ContentBlockDeltaEvent
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &delta))
+				text.WriteString(delta.Delta.Text)
+			}
+
+			if name == "event: message_delta" {
+				var delta MessageDeltaEvent
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &delta))
+				assert.Equal(t, "end_turn", *delta.Delta.StopReason)
+				assert.Equal(t, 2, delta.Usage.OutputTokens)
+			}
+		}
+
+		assert.Equal(t, []string{
+			"message_start",
+			"content_block_start",
+			"content_block_delta",
+			"content_block_delta",
+			"content_block_stop",
+			"message_delta",
+			"message_stop",
+		}, events)
+		assert.Equal(t, "Hello world", text.String())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		w := post(t, `{"model": "missing", "max_tokens": 100, "messages": [{"role": "user", "content": "Hi"}]}`)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, NewError(http.StatusNotFound, "model 'missing' not found, try pulling it first"), resp)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		w := post(t, `{"model": "llama3", "messages": [{"role": "user", "content": "Hi"}]}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "invalid_request_error", resp.Error.Type)
+	})
+}
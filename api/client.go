@@ -10,7 +10,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -29,6 +32,9 @@ import (
 type Client struct {
 	base *url.URL
 	http *http.Client
+
+	// apiKey is sent as a bearer token if set
+	apiKey string
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -54,15 +60,43 @@ func checkError(resp *http.Response, body []byte) error {
 //
 //	<scheme>://<host>:<port>
 //
+// or, to connect to a Unix domain socket:
+//
+//	unix://<path>
+//
 // If the variable is not specified, a default ollama host and port will be
-// used.
+// used. If it lists several comma separated addresses, as the server allows,
+// the first is used.
+//
+// If the environment variable OLLAMA_API_KEY is set, it is sent with every
+// request as a bearer token to authenticate with the service.
+//
+// For https hosts, OLLAMA_CA_CERT may name a PEM file of additional CA
+// certificates to trust, and OLLAMA_CLIENT_CERT and OLLAMA_CLIENT_KEY may
+// name a certificate and key to present to services that require one.
 func ClientFromEnvironment() (*Client, error) {
 	defaultPort := "11434"
 
-	scheme, hostport, ok := strings.Cut(os.Getenv("OLLAMA_HOST"), "://")
+	addr, _, _ := strings.Cut(os.Getenv("OLLAMA_HOST"), ",")
+	addr = strings.TrimSpace(addr)
+
+	if socket, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if socket == "" {
+			return nil, errors.New("OLLAMA_HOST: unix:// address has no socket path")
+		}
+
+		return &Client{
+			// the host is only used for the Host header
+			base:   &url.URL{Scheme: "http", Host: "localhost"},
+			http:   unixHTTPClient(socket),
+			apiKey: os.Getenv("OLLAMA_API_KEY"),
+		}, nil
+	}
+
+	scheme, hostport, ok := strings.Cut(addr, "://")
 	switch {
 	case !ok:
-		scheme, hostport = "http", os.Getenv("OLLAMA_HOST")
+		scheme, hostport = "http", addr
 	case scheme == "http":
 		defaultPort = "80"
 	case scheme == "https":
@@ -82,15 +116,79 @@ func ClientFromEnvironment() (*Client, error) {
 		}
 	}
 
+	client, err := httpClientFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Client{
 		base: &url.URL{
 			Scheme: scheme,
 			Host:   net.JoinHostPort(host, port),
 		},
-		http: http.DefaultClient,
+		http:   client,
+		apiKey: os.Getenv("OLLAMA_API_KEY"),
 	}, nil
 }
 
+// httpClientFromEnvironment returns an HTTP client configured with the
+// certificates in OLLAMA_CA_CERT, OLLAMA_CLIENT_CERT and OLLAMA_CLIENT_KEY,
+// or the default client if none are set
+func httpClientFromEnvironment() (*http.Client, error) {
+	caFile := os.Getenv("OLLAMA_CA_CERT")
+	certFile, keyFile := os.Getenv("OLLAMA_CLIENT_CERT"), os.Getenv("OLLAMA_CLIENT_KEY")
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return http.DefaultClient, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load OLLAMA_CA_CERT: %w", err)
+		}
+
+		// trust the system's CAs as well, in case requests are redirected
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to load OLLAMA_CA_CERT: no certificates found in %s", caFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load OLLAMA_CLIENT_CERT and OLLAMA_CLIENT_KEY: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+// unixHTTPClient returns an HTTP client that connects to the Unix domain
+// socket at path
+func unixHTTPClient(path string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+
+	return &http.Client{Transport: transport}
+}
+
 func NewClient(base *url.URL, http *http.Client) *Client {
 	return &Client{
 		base: base,
@@ -127,6 +225,9 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
 
 	respObj, err := c.http.Do(request)
 	if err != nil {
@@ -173,6 +274,9 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/x-ndjson")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
 
 	response, err := c.http.Do(request)
 	if err != nil {
@@ -184,12 +288,26 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	// increase the buffer size to avoid running out of space
 	scanBuf := make([]byte, 0, maxBufferSize)
 	scanner.Buffer(scanBuf, maxBufferSize)
+
+	// responses are newline delimited JSON, or Server-Sent Events if the
+	// service chooses to send them
+	events := strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream")
+	if events {
+		scanner.Split(scanEvents)
+	}
+
 	for scanner.Scan() {
 		var errorResponse struct {
 			Error string `json:"error,omitempty"`
 		}
 
 		bts := scanner.Bytes()
+		if events {
+			if bts = eventData(bts); len(bts) == 0 {
+				continue
+			}
+		}
+
 		if err := json.Unmarshal(bts, &errorResponse); err != nil {
 			return fmt.Errorf("unmarshal: %w", err)
 		}
@@ -214,6 +332,39 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	return nil
 }
 
+// scanEvents is a [bufio.SplitFunc] that splits Server-Sent Events, which
+// are separated by blank lines
+func scanEvents(data []byte, atEOF bool) (int, []byte, error) {
+	end, sep := bytes.Index(data, []byte("\n\n")), 2
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 && (end < 0 || i < end) {
+		end, sep = i, 4
+	}
+
+	if end >= 0 {
+		return end + sep, data[:end], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// eventData returns the data fields of a Server-Sent Event, ignoring its
+// other fields
+func eventData(event []byte) []byte {
+	var data [][]byte
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(value, []byte(" ")))
+		}
+	}
+
+	return bytes.Join(data, []byte("\n"))
+}
+
 // GenerateResponseFunc is a function that [Client.Generate] invokes every time
 // a response is received from the service. If this function returns an error,
 // [Client.Generate] will stop generating and return this error.
@@ -306,6 +457,50 @@ func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	return &lr, nil
 }
 
+// ListRunning lists the models currently loaded into memory.
+func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
+	var lr ProcessResponse
+	if err := c.do(ctx, http.MethodGet, "/api/ps", nil, &lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// Load loads a model into memory and returns its running state.
+func (c *Client) Load(ctx context.Context, req *LoadRequest) (*ProcessModelResponse, error) {
+	var resp ProcessModelResponse
+	if err := c.do(ctx, http.MethodPost, "/api/load", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Unload unloads a model from memory once its in-flight requests complete.
+func (c *Client) Unload(ctx context.Context, req *UnloadRequest) error {
+	if err := c.do(ctx, http.MethodPost, "/api/unload", req, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Tokenize converts a prompt, or a list of chat messages, into the model's tokens.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Detokenize converts a list of the model's tokens back into text.
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	if err := c.do(ctx, http.MethodPost, "/api/copy", req, nil); err != nil {
 		return err
@@ -334,6 +529,9 @@ func (c *Client) Heartbeat(ctx context.Context) error {
 	}
 	return nil
 }
+
+// Embeddings generates embeddings from a model. Set req.Prompt to embed a
+// single text, or req.Input to embed several texts in one request.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
 	if err := c.do(ctx, http.MethodPost, "/api/embeddings", req, &resp); err != nil {
@@ -1,6 +1,16 @@
 package api
 
-import "testing"
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestClientFromEnvironment(t *testing.T) {
 	type testCase struct {
@@ -24,6 +34,8 @@ func TestClientFromEnvironment(t *testing.T) {
 		"scheme, hostname, and port": {value: "https://example.com:1234", expect: "https://example.com:1234"},
 		"trailing slash":             {value: "example.com/", expect: "http://example.com:11434"},
 		"trailing slash port":        {value: "example.com:1234/", expect: "http://example.com:1234"},
+		"multiple addresses":         {value: "1.2.3.4:1234, unix:///run/ollama.sock", expect: "http://1.2.3.4:1234"},
+		"unix socket":                {value: "unix:///run/ollama.sock", expect: "http://localhost"},
 	}
 
 	for k, v := range testCases {
@@ -41,3 +53,191 @@ func TestClientFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+func TestClientUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ollama.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version": "0.0.0"}`)) //nolint:errcheck
+	}))
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OLLAMA_HOST", "unix://"+socket)
+
+	client, err := ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := client.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != "0.0.0" {
+		t.Errorf("expected version 0.0.0, got %q", version)
+	}
+}
+
+func TestClientAPIKey(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{"version": "0.0.0"}`)) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	base, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_HOST", base.Host)
+	t.Setenv("OLLAMA_API_KEY", "secret")
+
+	client, err := ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Version(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if authorization != "Bearer secret" {
+		t.Errorf("expected bearer token, got %q", authorization)
+	}
+
+	t.Setenv("OLLAMA_API_KEY", "")
+
+	client, err = ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Version(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if authorization != "" {
+		t.Errorf("expected no authorization header, got %q", authorization)
+	}
+}
+
+func TestClientCACert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version": "0.0.0"}`)) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+
+	// the test server's certificate isn't trusted by default
+	client, err := ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Version(context.Background()); err == nil {
+		t.Fatal("expected certificate error")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_CA_CERT", caFile)
+
+	client, err = ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Version(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_CA_CERT", filepath.Join(t.TempDir(), "missing.pem"))
+	if _, err := ClientFromEnvironment(); err == nil {
+		t.Fatal("expected error for missing CA file")
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	cases := map[string]struct {
+		contentType string
+		body        string
+	}{
+		"ndjson": {
+			contentType: "application/x-ndjson",
+			body:        "{\"response\":\"Hello\"}\n{\"response\":\" world\"}\n{\"done\":true,\"eval_count\":2}\n",
+		},
+		"events": {
+			contentType: "text/event-stream",
+			body:        "id:1\ndata:{\"response\":\"Hello\"}\n\n: comment\n\nid:2\r\ndata: {\"response\":\" world\"}\r\n\r\nid:3\nevent:done\ndata:{\"done\":true,\"eval_count\":2}\n\n",
+		},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body)) //nolint:errcheck
+			}))
+			t.Cleanup(srv.Close)
+
+			base, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var responses []GenerateResponse
+			err = NewClient(base, http.DefaultClient).Generate(context.Background(), &GenerateRequest{}, func(resp GenerateResponse) error {
+				responses = append(responses, resp)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(responses) != 3 {
+				t.Fatalf("expected 3 responses, got %d", len(responses))
+			}
+
+			if responses[0].Response+responses[1].Response != "Hello world" {
+				t.Errorf("expected \"Hello world\", got %q", responses[0].Response+responses[1].Response)
+			}
+
+			if last := responses[2]; !last.Done || last.EvalCount != 2 {
+				t.Errorf("expected final response with metrics, got %+v", last)
+			}
+		})
+	}
+}
+
+func TestClientStreamEventError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("id:1\nevent:error\ndata:{\"error\":\"model not found\"}\n\n")) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	base, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewClient(base, http.DefaultClient).Pull(context.Background(), &PullRequest{Model: "missing"}, func(ProgressResponse) error {
+		return nil
+	})
+	if err == nil || err.Error() != "model not found" {
+		t.Fatalf("expected model not found error, got %v", err)
+	}
+}
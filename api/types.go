@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -61,7 +62,9 @@ type GenerateRequest struct {
 	// Raw set to true means that no formatting will be applied to the prompt.
 	Raw bool `json:"raw,omitempty"`
 
-	// Format specifies the format to return a response in.
+	// Format specifies the format to return a response in. It may be "json",
+	// a JSON schema, or a GBNF grammar with a root rule. A JSON schema is sent
+	// as an object rather than a string.
 	Format string `json:"format"`
 
 	// KeepAlive controls how long the model will stay loaded in memory following
@@ -72,6 +75,15 @@ type GenerateRequest struct {
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
 
+	// Priority is either "interactive" (the default) or "batch". Waiting
+	// interactive requests are always scheduled before batch requests.
+	Priority string `json:"priority,omitempty"`
+
+	// Logprobs is the number of most likely alternatives to return along
+	// with the log probability of each generated token. Log probabilities
+	// are not returned if it is zero.
+	Logprobs int `json:"logprobs,omitempty"`
+
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]interface{} `json:"options"`
@@ -81,16 +93,74 @@ type ChatRequest struct {
 	Model     string    `json:"model"`
 	Messages  []Message `json:"messages"`
 	Stream    *bool     `json:"stream,omitempty"`
-	Format    string    `json:"format"`
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Format specifies the format to return a response in. See
+	// GenerateRequest.Format for the accepted values.
+	Format string `json:"format"`
+
+	// Tools lists the functions the model may call. Tool definitions are
+	// made available to the prompt template as .Tools.
+	Tools Tools `json:"tools,omitempty"`
+
+	// Priority is either "interactive" (the default) or "batch". See
+	// GenerateRequest.Priority.
+	Priority string `json:"priority,omitempty"`
+
+	// Logprobs is the number of most likely alternatives to return along
+	// with the log probability of each generated token. See
+	// GenerateRequest.Logprobs.
+	Logprobs int `json:"logprobs,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
 type Message struct {
-	Role    string      `json:"role"` // one of ["system", "user", "assistant"]
-	Content string      `json:"content"`
-	Images  []ImageData `json:"images,omitempty"`
+	Role      string      `json:"role"` // one of ["system", "user", "assistant", "tool"]
+	Content   string      `json:"content"`
+	Images    []ImageData `json:"images,omitempty"`
+	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+}
+
+// Tool describes a function the model may call in response to a chat.
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+func (t Tool) String() string {
+	bts, _ := json.Marshal(t)
+	return string(bts)
+}
+
+type Tools []Tool
+
+// String renders the tools as a JSON array so templates can embed them
+// directly with {{ .Tools }}.
+func (t Tools) String() string {
+	bts, _ := json.Marshal(t)
+	return string(bts)
+}
+
+// ToolCall is a request by the model to call a function.
+type ToolCall struct {
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+}
+
+func (t ToolCall) String() string {
+	bts, _ := json.Marshal(t)
+	return string(bts)
 }
 
 type ChatResponse struct {
@@ -98,11 +168,28 @@ type ChatResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Message   Message   `json:"message"`
 
+	// Logprobs lists the log probabilities of the tokens in Message.Content
+	// when requested with ChatRequest.Logprobs.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Done bool `json:"done"`
 
 	Metrics
 }
 
+// TokenLogprob is a token and its log probability.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// Logprob describes a generated token, its log probability and the most
+// likely alternatives that could have been generated in its place.
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -152,22 +239,47 @@ type Runner struct {
 	UseMLock  bool `json:"use_mlock,omitempty"`
 	NumThread int  `json:"num_thread,omitempty"`
 
+	// NumParallel is the number of requests the model serves at once, each
+	// with its own num_ctx context. Zero uses the server's default.
+	NumParallel int `json:"num_parallel,omitempty"`
+
 	// Unused: RopeFrequencyBase is ignored. Instead the value in the model will be used
 	RopeFrequencyBase float32 `json:"rope_frequency_base,omitempty"`
 	// Unused: RopeFrequencyScale is ignored. Instead the value in the model will be used
 	RopeFrequencyScale float32 `json:"rope_frequency_scale,omitempty"`
 }
 
+// EmbeddingRequest describes a request sent by [Client.Embeddings]. Either
+// Prompt or Input may be set, but not both.
 type EmbeddingRequest struct {
-	Model     string    `json:"model"`
-	Prompt    string    `json:"prompt"`
+	Model  string `json:"model"`
+	Prompt string `json:"prompt,omitempty"`
+
+	// Input is a list of texts to embed in a single request. Embeddings are
+	// returned in the same order in EmbeddingResponse.Embeddings.
+	Input []string `json:"input,omitempty"`
+
+	// Truncate truncates each input to fit the model's context length; it is
+	// true by default. If false, an input that is too long is an error.
+	Truncate *bool `json:"truncate,omitempty"`
+
+	// Normalize scales each embedding to unit length.
+	Normalize bool `json:"normalize,omitempty"`
+
+	// Priority is either "interactive" (the default) or "batch". See
+	// GenerateRequest.Priority.
+	Priority string `json:"priority,omitempty"`
+
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
 	Options map[string]interface{} `json:"options"`
 }
 
 type EmbeddingResponse struct {
-	Embedding []float64 `json:"embedding"`
+	Embedding  []float64   `json:"embedding"`
+	Embeddings [][]float64 `json:"embeddings,omitempty"`
+
+	PromptEvalCount int `json:"prompt_eval_count,omitempty"`
 }
 
 type CreateRequest struct {
@@ -207,6 +319,7 @@ type ShowResponse struct {
 	System     string       `json:"system,omitempty"`
 	Details    ModelDetails `json:"details,omitempty"`
 	Messages   []Message    `json:"messages,omitempty"`
+	ModifiedAt time.Time    `json:"modified_at,omitempty"`
 }
 
 type CopyRequest struct {
@@ -256,6 +369,105 @@ type ModelResponse struct {
 	Details    ModelDetails `json:"details,omitempty"`
 }
 
+// LoadRequest describes a request sent by [Client.Load].
+type LoadRequest struct {
+	Model string `json:"model"`
+
+	// KeepAlive controls how long the model will stay loaded in memory after
+	// it was last used. A negative value keeps the model loaded indefinitely.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists runner options, such as num_ctx and num_gpu, to load the
+	// model with.
+	Options map[string]interface{} `json:"options"`
+}
+
+// UnloadRequest describes a request sent by [Client.Unload].
+type UnloadRequest struct {
+	Model string `json:"model"`
+}
+
+// TokenizeRequest describes a request sent by [Client.Tokenize]. If Messages
+// is set instead of Prompt, the messages are rendered with the model's chat
+// template before being tokenized.
+type TokenizeRequest struct {
+	Model    string    `json:"model"`
+	Prompt   string    `json:"prompt,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+	Tools    Tools     `json:"tools,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory
+	// following this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Tokens []int `json:"tokens"`
+}
+
+// DetokenizeRequest describes a request sent by [Client.Detokenize].
+type DetokenizeRequest struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+
+	// KeepAlive controls how long the model will stay loaded in memory
+	// following this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Content string `json:"content"`
+}
+
+// ProcessResponse is the response from [Client.ListRunning].
+type ProcessResponse struct {
+	Models []ProcessModelResponse `json:"models"`
+
+	// Queue lists the requests waiting for a model, in the order they
+	// will be scheduled
+	Queue []QueuedRequest `json:"queue,omitempty"`
+}
+
+// QueuedRequest describes a request waiting for a model to be scheduled.
+type QueuedRequest struct {
+	Model    string `json:"model"`
+	Priority string `json:"priority"`
+
+	// Position is the number of requests that will be scheduled before this one
+	Position int       `json:"position"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// ProcessModelResponse describes a model loaded into memory.
+type ProcessModelResponse struct {
+	Name      string       `json:"name"`
+	Model     string       `json:"model"`
+	Size      int64        `json:"size"`
+	Digest    string       `json:"digest"`
+	Details   ModelDetails `json:"details,omitempty"`
+	ExpiresAt time.Time    `json:"expires_at"`
+
+	// SizeVRAM is the portion of Size loaded into GPU memory
+	SizeVRAM int64 `json:"size_vram"`
+
+	// GPUs lists the ids of the GPUs the model is loaded on
+	GPUs []string `json:"gpus,omitempty"`
+
+	// ActiveRequests is the number of requests currently using the model
+	ActiveRequests int `json:"active_requests"`
+
+	// Pinned is set if the model is never unloaded to make room for another
+	Pinned bool `json:"pinned,omitempty"`
+}
+
 type TokenResponse struct {
 	Token string `json:"token"`
 }
@@ -265,6 +477,10 @@ type GenerateResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Response  string    `json:"response"`
 
+	// Logprobs lists the log probabilities of the tokens in Response when
+	// requested with GenerateRequest.Logprobs.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Done    bool  `json:"done"`
 	Context []int `json:"context,omitempty"`
 
@@ -431,6 +647,92 @@ func DefaultOptions() Options {
 	}
 }
 
+func (r GenerateRequest) MarshalJSON() ([]byte, error) {
+	type alias GenerateRequest
+	return json.Marshal(struct {
+		alias
+		Format json.RawMessage `json:"format,omitempty"`
+	}{alias(r), marshalFormat(r.Format)})
+}
+
+func (r *GenerateRequest) UnmarshalJSON(b []byte) (err error) {
+	type alias GenerateRequest
+	v := struct {
+		*alias
+		Format json.RawMessage `json:"format"`
+	}{alias: (*alias)(r)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	r.Format, err = unmarshalFormat(v.Format)
+	return err
+}
+
+func (r ChatRequest) MarshalJSON() ([]byte, error) {
+	type alias ChatRequest
+	return json.Marshal(struct {
+		alias
+		Format json.RawMessage `json:"format,omitempty"`
+	}{alias(r), marshalFormat(r.Format)})
+}
+
+func (r *ChatRequest) UnmarshalJSON(b []byte) (err error) {
+	type alias ChatRequest
+	v := struct {
+		*alias
+		Format json.RawMessage `json:"format"`
+	}{alias: (*alias)(r)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	r.Format, err = unmarshalFormat(v.Format)
+	return err
+}
+
+// marshalFormat returns a request's format as JSON, which is an object for
+// a JSON schema and a string otherwise
+func marshalFormat(format string) json.RawMessage {
+	trimmed := strings.TrimSpace(format)
+	switch {
+	case trimmed == "":
+		return nil
+	case strings.HasPrefix(trimmed, "{") && json.Valid([]byte(trimmed)):
+		return json.RawMessage(trimmed)
+	}
+
+	bts, _ := json.Marshal(format)
+	return bts
+}
+
+// unmarshalFormat returns a request's format from JSON, keeping a JSON
+// schema object as its JSON text
+func unmarshalFormat(b json.RawMessage) (string, error) {
+	var format any
+	if len(b) == 0 {
+		return "", nil
+	} else if err := json.Unmarshal(b, &format); err != nil {
+		return "", err
+	}
+
+	switch format := format.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return format, nil
+	case map[string]any:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, b); err != nil {
+			return "", err
+		}
+
+		return buf.String(), nil
+	default:
+		return "", errors.New("format must be a string or a JSON schema object")
+	}
+}
+
 type Duration struct {
 	time.Duration
 }
@@ -48,3 +48,46 @@ func TestKeepAliveParsingFromJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestFormatJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    string
+		format string
+	}{
+		{name: "None", req: `{}`},
+		{name: "String", req: `{"format": "json"}`, format: "json"},
+		{name: "Schema", req: `{"format": {"type": "object",  "required": []}}`, format: `{"type":"object","required":[]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var chat ChatRequest
+			require.NoError(t, json.Unmarshal([]byte(test.req), &chat))
+			assert.Equal(t, test.format, chat.Format)
+
+			var generate GenerateRequest
+			require.NoError(t, json.Unmarshal([]byte(test.req), &generate))
+			assert.Equal(t, test.format, generate.Format)
+
+			// schemas are sent as objects, and other formats as strings
+			bts, err := json.Marshal(ChatRequest{Model: "test", Format: test.format})
+			require.NoError(t, err)
+
+			var sent struct {
+				Format json.RawMessage `json:"format"`
+			}
+			require.NoError(t, json.Unmarshal(bts, &sent))
+			if test.format == "" {
+				assert.Empty(t, sent.Format)
+			} else {
+				assert.JSONEq(t, test.req, `{"format": `+string(sent.Format)+`}`)
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		var req GenerateRequest
+		require.Error(t, json.Unmarshal([]byte(`{"format": ["json"]}`), &req))
+	})
+}
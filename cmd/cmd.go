@@ -7,18 +7,20 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -32,6 +34,7 @@ import (
 	"golang.org/x/term"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/progress"
@@ -418,6 +421,121 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func ListRunningHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	models, err := client.ListRunning(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	var data [][]string
+
+	for _, m := range models.Models {
+		if len(args) == 0 || strings.HasPrefix(m.Name, args[0]) {
+			var procStr string
+			switch {
+			case m.SizeVRAM == 0:
+				procStr = "100% CPU"
+			case m.SizeVRAM >= m.Size:
+				procStr = "100% GPU"
+			default:
+				sizeCPU := m.Size - m.SizeVRAM
+				cpuPercent := math.Round(float64(sizeCPU) / float64(m.Size) * 100)
+				procStr = fmt.Sprintf("%d%%/%d%% CPU/GPU", int(cpuPercent), int(100-cpuPercent))
+			}
+
+			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, format.HumanTime(m.ExpiresAt, "Never")})
+		}
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"NAME", "ID", "SIZE", "PROCESSOR", "UNTIL"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("\t")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+func LoadHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	req := api.LoadRequest{Model: args[0], Options: map[string]interface{}{}}
+
+	if keepAlive, _ := cmd.Flags().GetString("keepalive"); keepAlive != "" {
+		req.KeepAlive, err = parseKeepAlive(keepAlive)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.Flags().Changed("num-ctx") {
+		numCtx, _ := cmd.Flags().GetInt("num-ctx")
+		req.Options["num_ctx"] = numCtx
+	}
+
+	if cmd.Flags().Changed("num-gpu") {
+		numGPU, _ := cmd.Flags().GetInt("num-gpu")
+		req.Options["num_gpu"] = numGPU
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	spinner := progress.NewSpinner("")
+	p.Add("", spinner)
+
+	resp, err := client.Load(cmd.Context(), &req)
+	p.StopAndClear()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("loaded '%s' (%s) until %s\n", resp.Name, format.HumanBytes(resp.Size), format.HumanTimeLower(resp.ExpiresAt, "never"))
+	return nil
+}
+
+// parseKeepAlive parses a keep alive duration such as "5m", "1h" or "-1"
+// using the same rules as the keep_alive API parameter
+func parseKeepAlive(s string) (*api.Duration, error) {
+	b := []byte(s)
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		b, _ = json.Marshal(s)
+	}
+
+	var d api.Duration
+	if err := d.UnmarshalJSON(b); err != nil {
+		return nil, fmt.Errorf("invalid keepalive %q: %w", s, err)
+	}
+
+	return &d, nil
+}
+
+func UnloadHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range args {
+		if err := client.Unload(cmd.Context(), &api.UnloadRequest{Model: name}); err != nil {
+			return err
+		}
+		fmt.Printf("unloaded '%s'\n", name)
+	}
+	return nil
+}
+
 func DeleteHandler(cmd *cobra.Command, args []string) error {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
@@ -805,24 +923,22 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 }
 
 func RunServer(cmd *cobra.Command, _ []string) error {
-	host, port, err := net.SplitHostPort(strings.Trim(os.Getenv("OLLAMA_HOST"), "\"'"))
+	cfg, err := envconfig.Load(cmd.Flags())
 	if err != nil {
-		host, port = "127.0.0.1", "11434"
-		if ip := net.ParseIP(strings.Trim(os.Getenv("OLLAMA_HOST"), "[]")); ip != nil {
-			host = ip.String()
-		}
+		return err
 	}
+	envconfig.Set(cfg)
 
 	if err := initializeKeypair(); err != nil {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	lns, err := server.Listen(cfg.Hosts, cfg.SocketMode)
 	if err != nil {
 		return err
 	}
 
-	return server.Serve(ln)
+	return server.Serve(lns)
 }
 
 func initializeKeypair() error {
@@ -928,7 +1044,9 @@ func versionHandler(cmd *cobra.Command, _ []string) {
 func appendHostEnvDocs(cmd *cobra.Command) {
 	const hostEnvDocs = `
 Environment Variables:
-      OLLAMA_HOST        The host:port or base URL of the Ollama server (e.g. http://localhost:11434)
+      OLLAMA_HOST        The host:port, base URL or unix:///path socket of the Ollama server (e.g. http://localhost:11434)
+      OLLAMA_API_KEY     The API key to authenticate with, if the server requires one
+      OLLAMA_CA_CERT     The path to PEM CA certificates to trust for an https OLLAMA_HOST
 `
 	cmd.SetUsageTemplate(cmd.UsageTemplate() + hostEnvDocs)
 }
@@ -997,7 +1115,7 @@ func NewCLI() *cobra.Command {
 	runCmd.Flags().Bool("verbose", false, "Show timings for response")
 	runCmd.Flags().Bool("insecure", false, "Use an insecure registry")
 	runCmd.Flags().Bool("nowordwrap", false, "Don't wrap words to the next line automatically")
-	runCmd.Flags().String("format", "", "Response format (e.g. json)")
+	runCmd.Flags().String("format", "", "Response format (e.g. json or a JSON schema)")
 	serveCmd := &cobra.Command{
 		Use:     "serve",
 		Aliases: []string{"start"},
@@ -1005,15 +1123,12 @@ func NewCLI() *cobra.Command {
 		Args:    cobra.ExactArgs(0),
 		RunE:    RunServer,
 	}
+	envconfig.RegisterFlags(serveCmd.Flags())
 	serveCmd.SetUsageTemplate(serveCmd.UsageTemplate() + `
 Environment Variables:
 
-    OLLAMA_HOST         The host:port to bind to (default "127.0.0.1:11434")
-    OLLAMA_ORIGINS      A comma separated list of allowed origins.
-    OLLAMA_MODELS       The path to the models directory (default is "~/.ollama/models")
-    OLLAMA_KEEP_ALIVE   The duration that models stay loaded in memory (default is "5m")
-    OLLAMA_DEBUG        Set to 1 to enable additional debug logging
-`)
+    OLLAMA_CONFIG                    The path to a YAML config file
+` + envconfig.EnvDocs())
 
 	pullCmd := &cobra.Command{
 		Use:     "pull MODEL",
@@ -1042,6 +1157,34 @@ Environment Variables:
 		PreRunE: checkServerHeartbeat,
 		RunE:    ListHandler,
 	}
+
+	psCmd := &cobra.Command{
+		Use:     "ps",
+		Short:   "List running models",
+		PreRunE: checkServerHeartbeat,
+		RunE:    ListRunningHandler,
+	}
+
+	loadCmd := &cobra.Command{
+		Use:     "load MODEL",
+		Short:   "Load a model into memory",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    LoadHandler,
+	}
+
+	loadCmd.Flags().String("keepalive", "", "Duration to keep the model loaded after its last use (e.g. 5m, 1h, -1 to keep loaded indefinitely)")
+	loadCmd.Flags().Int("num-ctx", 0, "Context window size to load the model with")
+	loadCmd.Flags().Int("num-gpu", 0, "Number of layers to offload to the GPU")
+
+	unloadCmd := &cobra.Command{
+		Use:     "unload MODEL [MODEL...]",
+		Short:   "Unload a model from memory",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    UnloadHandler,
+	}
+
 	copyCmd := &cobra.Command{
 		Use:     "cp SOURCE TARGET",
 		Short:   "Copy a model",
@@ -1065,6 +1208,9 @@ Environment Variables:
 		pullCmd,
 		pushCmd,
 		listCmd,
+		psCmd,
+		loadCmd,
+		unloadCmd,
 		copyCmd,
 		deleteCmd,
 	} {
@@ -1079,6 +1225,9 @@ Environment Variables:
 		pullCmd,
 		pushCmd,
 		listCmd,
+		psCmd,
+		loadCmd,
+		unloadCmd,
 		copyCmd,
 		deleteCmd,
 	)
@@ -0,0 +1,285 @@
+// Package envconfig holds the server's settings, which are read from a YAML
+// config file, OLLAMA_* environment variables and `ollama serve` flags.
+//
+// Flags take precedence over environment variables, which take precedence
+// over the config file, which takes precedence over the defaults.
+package envconfig
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Source is where a setting's value came from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// Config is the server's effective configuration.
+type Config struct {
+	// Hosts are the addresses the server listens on, each a host:port, a
+	// URL such as http://0.0.0.0:11434, or a Unix socket such as
+	// unix:///run/ollama.sock
+	Hosts []string
+	// SocketMode is the file mode of Unix sockets the server listens on
+	SocketMode os.FileMode
+	// Origins are additional origins allowed to make cross-origin requests
+	Origins []string
+	// Models is the directory models are stored in. The default, empty,
+	// means ~/.ollama/models.
+	Models string
+	// KeepAlive is how long models stay loaded after a request by default
+	KeepAlive time.Duration
+	// NoPrune disables removing unused layers at startup
+	NoPrune bool
+	Debug   bool
+
+	// LLMLibrary forces a specific LLM library to be used
+	LLMLibrary string
+	RunnersDir string
+	TmpDir     string
+	// MaxVRAM overrides the amount of VRAM available, in bytes
+	MaxVRAM uint64
+	// ReservedMemory is the system memory, in bytes, left free when loading
+	// models on the CPU
+	ReservedMemory uint64
+	// SimulatedGPUs is the path to a file of simulated GPUs. When set,
+	// models are loaded on a stub runner instead of llama.cpp.
+	SimulatedGPUs string
+
+	NumParallel     int
+	MaxLoadedModels int
+	MaxQueue        int
+	QueueTimeout    time.Duration
+	ShutdownTimeout time.Duration
+
+	// EvictionPolicy chooses which model is unloaded to make room for another
+	EvictionPolicy string
+	// PinnedModels are never unloaded to make room for another model
+	PinnedModels []string
+	// ModelPriorities lists models from most to least important, for the
+	// priority eviction policy
+	ModelPriorities []string
+
+	APIKeysFile string
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	MaxRequestsPerMinute int
+	MaxConcurrentStreams int
+	MaxTokensPerDay      int
+
+	LogLevel    string
+	LogFormat   string
+	LogFile     string
+	LogMaxSize  int
+	LogMaxFiles int
+
+	sources map[string]Source
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Hosts:           []string{"127.0.0.1:11434"},
+		SocketMode:      0o660,
+		KeepAlive:       5 * time.Minute,
+		NumParallel:     1,
+		MaxLoadedModels: 1,
+		MaxQueue:        512,
+		QueueTimeout:    5 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		EvictionPolicy:  "duration",
+		LogLevel:        "info",
+		LogFormat:       "text",
+		LogMaxSize:      100,
+		LogMaxFiles:     5,
+		sources:         make(map[string]Source),
+	}
+}
+
+// Source returns where the setting named name came from.
+func (c *Config) Source(name string) Source {
+	if s, ok := c.sources[name]; ok {
+		return s
+	}
+
+	return SourceDefault
+}
+
+// IsSet reports whether the setting named name was configured rather than
+// left at its default.
+func (c *Config) IsSet(name string) bool {
+	return c.Source(name) != SourceDefault
+}
+
+func (c *Config) set(s *setting, value string, source Source) error {
+	if err := s.parse(c, value); err != nil {
+		switch source {
+		case SourceEnv:
+			return fmt.Errorf("invalid %s: %w", s.Env, err)
+		case SourceFlag:
+			return fmt.Errorf("invalid --%s: %w", s.flag(), err)
+		default:
+			return fmt.Errorf("invalid %s: %w", s.Name, err)
+		}
+	}
+
+	c.sources[s.Name] = source
+	return nil
+}
+
+// loadFile reads settings from a YAML file of setting names and values
+func (c *Config) loadFile(name string) error {
+	bts, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	// read values as they're written, so 0660 isn't read as a decimal number
+	var values map[string]yaml.Node
+	if err := yaml.Unmarshal(bts, &values); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	for key, value := range values {
+		s := lookup(key)
+		if s == nil {
+			return fmt.Errorf("%s: unknown setting %q", name, key)
+		}
+
+		var str string
+		switch {
+		case value.Tag == "!!null":
+			continue
+		case value.Kind == yaml.SequenceNode:
+			items := make([]string, len(value.Content))
+			for i := range value.Content {
+				items[i] = value.Content[i].Value
+			}
+			str = strings.Join(items, ",")
+		case value.Kind == yaml.ScalarNode:
+			str = value.Value
+		default:
+			return fmt.Errorf("%s: invalid %s: must be a value or a list", name, key)
+		}
+
+		if err := c.set(s, str, SourceFile); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// loadEnv reads settings from their environment variables. If strict is
+// false, invalid values are ignored rather than returned as errors.
+func (c *Config) loadEnv(strict bool) error {
+	for _, s := range settings {
+		value, ok := os.LookupEnv(s.Env)
+		if !ok || (value == "" && s.kind != kindString) {
+			continue
+		}
+
+		if err := c.set(s, value, SourceEnv); err != nil && strict {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that settings which depend on each other are consistent.
+// Each setting's value is checked as it's set.
+func (c *Config) Validate() error {
+	var errs []error
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls_cert and tls_key must both be set to enable TLS"))
+	}
+
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		errs = append(errs, errors.New("tls_client_ca requires tls_cert and tls_key to be set"))
+	}
+
+	return errors.Join(errs...)
+}
+
+var (
+	mu      sync.RWMutex
+	current *Config
+	fromEnv = sync.OnceValue(loadFromEnv)
+)
+
+// loadFromEnv returns the defaults overridden by the environment, ignoring
+// invalid values
+func loadFromEnv() *Config {
+	c := Default()
+	c.loadEnv(false) //nolint:errcheck
+	return c
+}
+
+// Set makes c the configuration returned by [Current].
+func Set(c *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = c
+}
+
+// Current returns the configuration set by [Set]. Until one is set, it
+// returns the defaults overridden by the environment, ignoring invalid
+// values, so code outside the server keeps following the environment. The
+// environment is read once, on the first call.
+func Current() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if current != nil {
+		return current
+	}
+
+	return fromEnv()
+}
+
+// Reset clears the configuration set by [Set] and reads the environment
+// again on the next call to [Current]. It's meant for tests that change the
+// environment.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	current = nil
+	fromEnv = sync.OnceValue(loadFromEnv)
+}
+
+// parseKeepAlive parses a number of seconds or a duration. Negative values
+// mean forever.
+func parseKeepAlive(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		n, nerr := strconv.Atoi(s)
+		if nerr != nil {
+			return 0, err
+		}
+
+		d = time.Duration(n) * time.Second
+	}
+
+	if d < 0 {
+		return time.Duration(math.MaxInt64), nil
+	}
+
+	return d, nil
+}
@@ -0,0 +1,172 @@
+package envconfig
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(name, []byte(content), 0o644))
+	return name
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	name := writeConfig(t, `
+num_parallel: 2
+max_queue: 10
+origins:
+  - http://a.example.com
+  - http://b.example.com
+keep_alive: 10m
+`)
+
+	t.Setenv("OLLAMA_CONFIG", name)
+	t.Setenv("OLLAMA_NUM_PARALLEL", "3")
+	t.Setenv("OLLAMA_MAX_QUEUE", "20")
+
+	fs := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"--num-parallel", "4", "--noprune"}))
+
+	c, err := Load(fs)
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, c.NumParallel)
+	assert.Equal(t, SourceFlag, c.Source("num_parallel"))
+	assert.Equal(t, 20, c.MaxQueue)
+	assert.Equal(t, SourceEnv, c.Source("max_queue"))
+	assert.Equal(t, []string{"http://a.example.com", "http://b.example.com"}, c.Origins)
+	assert.Equal(t, SourceFile, c.Source("origins"))
+	assert.Equal(t, 10*time.Minute, c.KeepAlive)
+	assert.True(t, c.NoPrune)
+	assert.Equal(t, 1, c.MaxLoadedModels)
+	assert.Equal(t, SourceDefault, c.Source("max_loaded_models"))
+	assert.False(t, c.IsSet("max_loaded_models"))
+	assert.Equal(t, 5*time.Minute, c.QueueTimeout)
+}
+
+func TestLoadConfigFlag(t *testing.T) {
+	t.Setenv("OLLAMA_CONFIG", writeConfig(t, "num_parallel: 2\n"))
+
+	fs := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"--config", writeConfig(t, "num_parallel: 5\n")}))
+
+	c, err := Load(fs)
+	require.NoError(t, err)
+	assert.Equal(t, 5, c.NumParallel)
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		env    map[string]string
+		err    string
+	}{
+		{"unknown setting", "num_paralel: 2\n", nil, `unknown setting "num_paralel"`},
+		{"invalid file value", "num_parallel: 0\n", nil, "invalid num_parallel: 0 must be 1 or greater"},
+		{"invalid yaml", "num_parallel: [\n", nil, "config.yaml"},
+		{"invalid env", "", map[string]string{"OLLAMA_MAX_LOADED_MODELS": "blue"}, `invalid OLLAMA_MAX_LOADED_MODELS: "blue" is not a number`},
+		{"invalid enum", "", map[string]string{"OLLAMA_LOG_FORMAT": "xml"}, `"xml" must be one of text, json`},
+		{"negative duration", "queue_timeout: -1s\n", nil, "must not be negative"},
+		{"tls key without cert", "tls_key: key.pem\n", nil, "tls_cert and tls_key must both be set"},
+		{"client ca without cert", "", map[string]string{"OLLAMA_TLS_CLIENT_CA": "ca.pem"}, "tls_client_ca requires tls_cert"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_CONFIG", "")
+			if tt.config != "" {
+				t.Setenv("OLLAMA_CONFIG", writeConfig(t, tt.config))
+			}
+
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			_, err := Load(nil)
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	t.Cleanup(Reset)
+
+	t.Setenv("OLLAMA_NUM_PARALLEL", "3")
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "blue")
+	Reset()
+
+	// without a loaded config, the environment is followed and invalid values ignored
+	c := Current()
+	assert.Equal(t, 3, c.NumParallel)
+	assert.Equal(t, 1, c.MaxLoadedModels)
+	assert.False(t, c.IsSet("max_loaded_models"))
+
+	// the environment is only read once
+	t.Setenv("OLLAMA_NUM_PARALLEL", "4")
+	assert.Same(t, c, Current())
+
+	Reset()
+	assert.Equal(t, 4, Current().NumParallel)
+
+	loaded := Default()
+	loaded.NumParallel = 8
+	Set(loaded)
+	assert.Same(t, loaded, Current())
+}
+
+func TestParseKeepAlive(t *testing.T) {
+	cases := map[string]time.Duration{
+		"5m":  5 * time.Minute,
+		"1h":  time.Hour,
+		"30":  30 * time.Second,
+		"0":   0,
+		"-1":  time.Duration(math.MaxInt64),
+		"-1m": time.Duration(math.MaxInt64),
+	}
+
+	for s, expect := range cases {
+		d, err := parseKeepAlive(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expect, d, s)
+	}
+
+	_, err := parseKeepAlive("forever")
+	require.Error(t, err)
+}
+
+func TestSettings(t *testing.T) {
+	t.Setenv("OLLAMA_CONFIG", "")
+	t.Setenv("OLLAMA_KEEP_ALIVE", "-1")
+
+	c, err := Load(nil)
+	require.NoError(t, err)
+
+	values := make(map[string]Setting)
+	for _, s := range c.Settings() {
+		values[s.Name] = s
+	}
+
+	assert.Equal(t, Setting{Name: "keep_alive", Env: "OLLAMA_KEEP_ALIVE", Value: "forever", Source: SourceEnv}, values["keep_alive"])
+	assert.Equal(t, Setting{Name: "num_parallel", Env: "OLLAMA_NUM_PARALLEL", Value: 1, Source: SourceDefault}, values["num_parallel"])
+	assert.Len(t, values, len(settings))
+}
+
+func TestFlagValidation(t *testing.T) {
+	fs := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	RegisterFlags(fs)
+	require.ErrorContains(t, fs.Parse([]string{"--num-parallel", "none"}), `"none" is not a number`)
+}
@@ -0,0 +1,342 @@
+package envconfig
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+type kind string
+
+const (
+	kindString   kind = "string"
+	kindStrings  kind = "strings"
+	kindBool     kind = "bool"
+	kindInt      kind = "int"
+	kindBytes    kind = "bytes"
+	kindDuration kind = "duration"
+	kindMode     kind = "mode"
+)
+
+// setting describes how a Config field is named in the config file, the
+// environment and flags
+type setting struct {
+	// Name is the setting's key in the config file
+	Name  string
+	Env   string
+	Usage string
+
+	kind  kind
+	parse func(c *Config, s string) error
+	value func(c *Config) any
+}
+
+// flag returns the name of the setting's `ollama serve` flag
+func (s *setting) flag() string {
+	return strings.ReplaceAll(s.Name, "_", "-")
+}
+
+func stringSetting(name, env, usage string, field func(*Config) *string) *setting {
+	return &setting{
+		Name: name, Env: env, Usage: usage, kind: kindString,
+		parse: func(c *Config, s string) error {
+			*field(c) = strings.Trim(s, "\"' ")
+			return nil
+		},
+		value: func(c *Config) any { return *field(c) },
+	}
+}
+
+// enumSetting is a string setting that must be one of values
+func enumSetting(name, env, usage string, values []string, field func(*Config) *string) *setting {
+	return &setting{
+		Name: name, Env: env, Usage: usage, kind: kindString,
+		parse: func(c *Config, s string) error {
+			s = strings.ToLower(strings.Trim(s, "\"' "))
+			if !slices.Contains(values, s) {
+				return fmt.Errorf("%q must be one of %s", s, strings.Join(values, ", "))
+			}
+
+			*field(c) = s
+			return nil
+		},
+		value: func(c *Config) any { return *field(c) },
+	}
+}
+
+func stringsSetting(name, env, usage string, field func(*Config) *[]string) *setting {
+	return &setting{
+		Name: name, Env: env, Usage: usage, kind: kindStrings,
+		parse: func(c *Config, s string) error {
+			var values []string
+			for _, v := range strings.Split(strings.Trim(s, "\"'"), ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+
+			*field(c) = values
+			return nil
+		},
+		value: func(c *Config) any { return *field(c) },
+	}
+}
+
+func boolSetting(name, env, usage string, field func(*Config) *bool) *setting {
+	return &setting{
+		Name: name, Env: env, Usage: usage, kind: kindBool,
+		parse: func(c *Config, s string) error {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				// any other value enables the setting, as it always has
+				b = s != ""
+			}
+
+			*field(c) = b
+			return nil
+		},
+		value: func(c *Config) any { return *field(c) },
+	}
+}
+
+// intSetting is an integer setting that must be at least minimum
+func intSetting(name, env, usage string, minimum int, field func(*Config) *int) *setting {
+	return &setting{
+		Name: name, Env: env, Usage: usage, kind: kindInt,
+		parse: func(c *Config, s string) error {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("%q is not a number", s)
+			}
+
+			if n < minimum {
+				return fmt.Errorf("%d must be %d or greater", n, minimum)
+			}
+
+			*field(c) = n
+			return nil
+		},
+		value: func(c *Config) any { return *field(c) },
+	}
+}
+
+func bytesSetting(name, env, usage string, field func(*Config) *uint64) *setting {
+	return &setting{
+		Name: name, Env: env, Usage: usage, kind: kindBytes,
+		parse: func(c *Config, s string) error {
+			n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not a number of bytes", s)
+			}
+
+			*field(c) = n
+			return nil
+		},
+		value: func(c *Config) any { return *field(c) },
+	}
+}
+
+// modeSetting is a file permission setting, written in octal
+func modeSetting(name, env, usage string, field func(*Config) *os.FileMode) *setting {
+	return &setting{
+		Name: name, Env: env, Usage: usage, kind: kindMode,
+		parse: func(c *Config, s string) error {
+			n, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(s), "0o"), 8, 32)
+			if err != nil || n > uint64(os.ModePerm) {
+				return fmt.Errorf("%q is not an octal file mode", s)
+			}
+
+			*field(c) = os.FileMode(n)
+			return nil
+		},
+		value: func(c *Config) any { return fmt.Sprintf("%#o", *field(c)) },
+	}
+}
+
+func durationSetting(name, env, usage string, parse func(string) (time.Duration, error), field func(*Config) *time.Duration) *setting {
+	return &setting{
+		Name: name, Env: env, Usage: usage, kind: kindDuration,
+		parse: func(c *Config, s string) error {
+			d, err := parse(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("%q is not a duration", s)
+			}
+
+			if d < 0 {
+				return fmt.Errorf("%s must not be negative", d)
+			}
+
+			*field(c) = d
+			return nil
+		},
+		value: func(c *Config) any {
+			if d := *field(c); d != time.Duration(math.MaxInt64) {
+				return d.String()
+			}
+
+			return "forever"
+		},
+	}
+}
+
+var settings = []*setting{
+	stringsSetting("host", "OLLAMA_HOST", "A comma separated list of host:port or unix:///path addresses to bind to", func(c *Config) *[]string { return &c.Hosts }),
+	modeSetting("socket_mode", "OLLAMA_SOCKET_MODE", "The octal file mode of Unix sockets, such as 0660", func(c *Config) *os.FileMode { return &c.SocketMode }),
+	stringsSetting("origins", "OLLAMA_ORIGINS", "A comma separated list of allowed origins", func(c *Config) *[]string { return &c.Origins }),
+	stringSetting("models", "OLLAMA_MODELS", "The path to the models directory (default is \"~/.ollama/models\")", func(c *Config) *string { return &c.Models }),
+	durationSetting("keep_alive", "OLLAMA_KEEP_ALIVE", "The duration that models stay loaded in memory", parseKeepAlive, func(c *Config) *time.Duration { return &c.KeepAlive }),
+	boolSetting("noprune", "OLLAMA_NOPRUNE", "Don't remove unused model layers at startup", func(c *Config) *bool { return &c.NoPrune }),
+	boolSetting("debug", "OLLAMA_DEBUG", "Enable additional debug logging", func(c *Config) *bool { return &c.Debug }),
+
+	stringSetting("llm_library", "OLLAMA_LLM_LIBRARY", "The LLM library to use, bypassing autodetection", func(c *Config) *string { return &c.LLMLibrary }),
+	stringSetting("runners_dir", "OLLAMA_RUNNERS_DIR", "The location of the LLM runners", func(c *Config) *string { return &c.RunnersDir }),
+	stringSetting("tmpdir", "OLLAMA_TMPDIR", "The location for temporary files", func(c *Config) *string { return &c.TmpDir }),
+	bytesSetting("max_vram", "OLLAMA_MAX_VRAM", "The amount of VRAM to use, in bytes", func(c *Config) *uint64 { return &c.MaxVRAM }),
+	bytesSetting("reserved_memory", "OLLAMA_RESERVED_MEMORY", "The amount of system memory, in bytes, to leave free when loading models on the CPU", func(c *Config) *uint64 { return &c.ReservedMemory }),
+	stringSetting("simulated_gpus", "OLLAMA_SIMULATED_GPUS", "The path to a YAML file of simulated GPUs to load models on with a stub runner, for development", func(c *Config) *string { return &c.SimulatedGPUs }),
+
+	intSetting("num_parallel", "OLLAMA_NUM_PARALLEL", "The default number of requests each model serves at once", 1, func(c *Config) *int { return &c.NumParallel }),
+	intSetting("max_loaded_models", "OLLAMA_MAX_LOADED_MODELS", "The number of models that may be loaded at once, or 0 for as many as fit", 0, func(c *Config) *int { return &c.MaxLoadedModels }),
+	intSetting("max_queue", "OLLAMA_MAX_QUEUE", "The number of requests that may wait to be scheduled", 1, func(c *Config) *int { return &c.MaxQueue }),
+	durationSetting("queue_timeout", "OLLAMA_QUEUE_TIMEOUT", "How long requests may wait to be scheduled, or 0 for no limit", time.ParseDuration, func(c *Config) *time.Duration { return &c.QueueTimeout }),
+	durationSetting("shutdown_timeout", "OLLAMA_SHUTDOWN_TIMEOUT", "How long to wait for requests in progress when shutting down", time.ParseDuration, func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	enumSetting("eviction_policy", "OLLAMA_EVICTION_POLICY", "Which model to unload to make room for another: duration, lru, smallest, largest or priority", []string{"duration", "lru", "smallest", "largest", "priority"}, func(c *Config) *string { return &c.EvictionPolicy }),
+	stringsSetting("pinned_models", "OLLAMA_PINNED_MODELS", "A comma separated list of models that are never unloaded to make room for another", func(c *Config) *[]string { return &c.PinnedModels }),
+	stringsSetting("model_priorities", "OLLAMA_MODEL_PRIORITIES", "A comma separated list of models from most to least important, for the priority eviction policy", func(c *Config) *[]string { return &c.ModelPriorities }),
+
+	stringSetting("api_keys_file", "OLLAMA_API_KEYS_FILE", "The path to a JSON file of API keys required to access the server", func(c *Config) *string { return &c.APIKeysFile }),
+	stringSetting("tls_cert", "OLLAMA_TLS_CERT", "The path to a PEM certificate to serve HTTPS with", func(c *Config) *string { return &c.TLSCert }),
+	stringSetting("tls_key", "OLLAMA_TLS_KEY", "The path to the PEM private key of tls_cert", func(c *Config) *string { return &c.TLSKey }),
+	stringSetting("tls_client_ca", "OLLAMA_TLS_CLIENT_CA", "The path to PEM CA certificates that client certificates must be signed by", func(c *Config) *string { return &c.TLSClientCA }),
+
+	intSetting("max_requests_per_minute", "OLLAMA_MAX_REQUESTS_PER_MINUTE", "The number of inference requests each client may make per minute", 0, func(c *Config) *int { return &c.MaxRequestsPerMinute }),
+	intSetting("max_concurrent_streams", "OLLAMA_MAX_CONCURRENT_STREAMS", "The number of inference requests each client may have in progress", 0, func(c *Config) *int { return &c.MaxConcurrentStreams }),
+	intSetting("max_tokens_per_day", "OLLAMA_MAX_TOKENS_PER_DAY", "The number of tokens each client may generate per day", 0, func(c *Config) *int { return &c.MaxTokensPerDay }),
+
+	enumSetting("log_level", "OLLAMA_LOG_LEVEL", "The minimum level to log: debug, info, warn or error", []string{"debug", "info", "warn", "error"}, func(c *Config) *string { return &c.LogLevel }),
+	enumSetting("log_format", "OLLAMA_LOG_FORMAT", "The format of logs: text or json", []string{"text", "json"}, func(c *Config) *string { return &c.LogFormat }),
+	stringSetting("log_file", "OLLAMA_LOG_FILE", "A file to write logs to instead of stderr", func(c *Config) *string { return &c.LogFile }),
+	intSetting("log_max_size", "OLLAMA_LOG_MAX_SIZE", "The size in megabytes at which the log file is rotated, or 0 to never rotate", 0, func(c *Config) *int { return &c.LogMaxSize }),
+	intSetting("log_max_files", "OLLAMA_LOG_MAX_FILES", "The number of rotated log files to keep", 0, func(c *Config) *int { return &c.LogMaxFiles }),
+}
+
+func lookup(name string) *setting {
+	for _, s := range settings {
+		if s.Name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// Setting is a setting's effective value and where it came from.
+type Setting struct {
+	Name   string `json:"name"`
+	Env    string `json:"env"`
+	Value  any    `json:"value"`
+	Source Source `json:"source"`
+}
+
+// Settings returns the value of every setting.
+func (c *Config) Settings() []Setting {
+	values := make([]Setting, len(settings))
+	for i, s := range settings {
+		values[i] = Setting{Name: s.Name, Env: s.Env, Value: s.value(c), Source: c.Source(s.Name)}
+	}
+
+	return values
+}
+
+const configFlag = "config"
+
+// flagValue holds the value of a setting's flag until the config is loaded,
+// so flags can take precedence over the environment and config file
+type flagValue struct {
+	s     *setting
+	value string
+}
+
+func (v *flagValue) String() string { return v.value }
+
+func (v *flagValue) Set(s string) error {
+	// check the value now so mistakes are reported as usage errors
+	if err := v.s.parse(Default(), s); err != nil {
+		return err
+	}
+
+	v.value = s
+	return nil
+}
+
+func (v *flagValue) Type() string {
+	return string(v.s.kind)
+}
+
+// RegisterFlags adds a flag for each setting, and a --config flag for the
+// path of the config file, to fs.
+func RegisterFlags(fs *pflag.FlagSet) {
+	fs.String(configFlag, "", "The path to a YAML config file (default is $OLLAMA_CONFIG)")
+	for _, s := range settings {
+		f := fs.VarPF(&flagValue{s: s}, s.flag(), "", s.Usage)
+		if s.kind == kindBool {
+			f.NoOptDefVal = "true"
+		}
+	}
+}
+
+// Load reads the config file named by the --config flag or the OLLAMA_CONFIG
+// environment variable, then the environment, then the flags in fs, which
+// may be nil, and validates the result.
+func Load(fs *pflag.FlagSet) (*Config, error) {
+	c := Default()
+
+	name := os.Getenv("OLLAMA_CONFIG")
+	if fs != nil {
+		if f := fs.Lookup(configFlag); f != nil && f.Changed {
+			name = f.Value.String()
+		}
+	}
+
+	if name != "" {
+		if err := c.loadFile(name); err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+
+	if err := c.loadEnv(true); err != nil {
+		return nil, err
+	}
+
+	if fs != nil {
+		for _, s := range settings {
+			if f := fs.Lookup(s.flag()); f != nil && f.Changed {
+				if err := c.set(s, f.Value.String(), SourceFlag); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// EnvDocs describes each setting's environment variable, for help text.
+func EnvDocs() string {
+	var sb strings.Builder
+	for _, s := range settings {
+		fmt.Fprintf(&sb, "    %-32s %s\n", s.Env, s.Usage)
+	}
+
+	return sb.String()
+}
@@ -3,6 +3,9 @@ package format
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
+	"unicode"
 )
 
 const (
@@ -61,3 +64,35 @@ func HumanBytes2(b uint64) string {
 		return fmt.Sprintf("%d B", b)
 	}
 }
+
+var byteUnits = map[string]float64{
+	"":    Byte,
+	"b":   Byte,
+	"kb":  KiloByte,
+	"mb":  MegaByte,
+	"gb":  GigaByte,
+	"tb":  TeraByte,
+	"kib": KibiByte,
+	"mib": MebiByte,
+	"gib": GibiByte,
+	"tib": GibiByte * 1024,
+}
+
+// ParseBytes parses a number of bytes such as 1024, 512MiB or 1.5 GB
+func ParseBytes(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("%q is not a number of bytes", s)
+	}
+
+	return uint64(n * unit), nil
+}
@@ -0,0 +1,32 @@
+package format
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	cases := map[string]uint64{
+		"1024":   1024,
+		"512MiB": 512 * MebiByte,
+		"1.5 GB": 1500 * MegaByte,
+		"24gib":  24 * GibiByte,
+		"10 B":   10,
+	}
+
+	for s, expect := range cases {
+		t.Run(s, func(t *testing.T) {
+			n, err := ParseBytes(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertEqual(t, n, expect)
+		})
+	}
+
+	for _, s := range []string{"", "GB", "12 XB", "-1"} {
+		t.Run(s, func(t *testing.T) {
+			if _, err := ParseBytes(s); err == nil {
+				t.Errorf("expected an error parsing %q", s)
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package gpu
 
 import (
+	"bufio"
+	"fmt"
 	"log/slog"
+	"os"
+	"strconv"
+	"strings"
 
 	"golang.org/x/sys/cpu"
+
+	"github.com/ollama/ollama/format"
 )
 
 func GetCPUVariant() string {
@@ -19,3 +26,46 @@ func GetCPUVariant() string {
 	// else LCD
 	return ""
 }
+
+// GetCPUInfo returns the system memory available to CPU runners
+func GetCPUInfo() GpuInfo {
+	mem, err := GetCPUMem()
+	if err != nil {
+		slog.Warn("error looking up system memory", "error", err)
+	}
+
+	return GpuInfo{
+		Library: "cpu",
+		Variant: GetCPUVariant(),
+		memInfo: mem,
+	}
+}
+
+// readMemAvailable returns MemAvailable from a Linux /proc/meminfo file,
+// the memory that can be allocated without swapping
+func readMemAvailable(name string) (uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %w", name, err)
+			}
+
+			return kb * format.KibiByte, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("%s: MemAvailable not found", name)
+}
@@ -20,6 +20,7 @@ import (
 	"sync"
 	"unsafe"
 
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 )
 
@@ -193,6 +194,17 @@ func GetCPUMem() (memInfo, error) {
 	}
 	ret.FreeMemory = uint64(info.free)
 	ret.TotalMemory = uint64(info.total)
+
+	// sysinfo's free memory leaves out page cache, which the kernel reclaims
+	// when memory is needed, so it's tiny once model files have been read
+	if runtime.GOOS == "linux" {
+		if available, err := readMemAvailable("/proc/meminfo"); err == nil {
+			ret.FreeMemory = available
+		} else {
+			slog.Debug("unable to read available memory, using free memory", "error", err)
+		}
+	}
+
 	return ret, nil
 }
 
@@ -268,7 +280,7 @@ func LoadCUDARTMgmt(cudartLibPaths []string) (int, *C.cudart_handle_t, string) {
 }
 
 func getVerboseState() C.uint16_t {
-	if debug := os.Getenv("OLLAMA_DEBUG"); debug != "" {
+	if envconfig.Current().Debug {
 		return C.uint16_t(1)
 	}
 	return C.uint16_t(0)
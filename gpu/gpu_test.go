@@ -1,10 +1,13 @@
 package gpu
 
 import (
+	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBasicGetGPUInfo(t *testing.T) {
@@ -31,4 +34,23 @@ func TestCPUMemInfo(t *testing.T) {
 	}
 }
 
+func TestReadMemAvailable(t *testing.T) {
+	// most memory is page cache, which is reclaimable but not free
+	name := filepath.Join(t.TempDir(), "meminfo")
+	require.NoError(t, os.WriteFile(name, []byte(`MemTotal:       65536000 kB
+MemFree:          512000 kB
+MemAvailable:   60000000 kB
+Buffers:          100000 kB
+Cached:         58000000 kB
+`), 0o600))
+
+	available, err := readMemAvailable(name)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(60000000*1024), available)
+
+	require.NoError(t, os.WriteFile(name, []byte("MemTotal: 65536000 kB\n"), 0o600))
+	_, err = readMemAvailable(name)
+	require.ErrorContains(t, err, "MemAvailable not found")
+}
+
 // TODO - add some logic to figure out card type through other means and actually verify we got back what we expected
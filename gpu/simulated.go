@@ -0,0 +1,203 @@
+package gpu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ollama/ollama/format"
+)
+
+// simulatedMinimumMemory is the overhead of simulated CUDA and ROCm GPUs
+const simulatedMinimumMemory = 457 * format.MebiByte
+
+// Simulated is an inventory of simulated GPUs and system memory, for trying
+// out scheduling on systems without GPUs. Memory allocated by stub runners
+// isn't reported as free until it's released.
+type Simulated struct {
+	mu     sync.Mutex
+	gpus   GpuInfoList
+	system GpuInfo
+}
+
+// NewSimulated returns an inventory of gpus, and of system memory as
+// described by system
+func NewSimulated(gpus GpuInfoList, system GpuInfo) *Simulated {
+	system.Library = "cpu"
+	return &Simulated{gpus: slices.Clone(gpus), system: system}
+}
+
+// simulatedMemory is memory described in a simulated GPUs file, with sizes
+// such as 24GiB
+type simulatedMemory struct {
+	TotalMemory   string `yaml:"total_memory"`
+	FreeMemory    string `yaml:"free_memory"`
+	MinimumMemory string `yaml:"minimum_memory"`
+}
+
+func (m simulatedMemory) memInfo() (memInfo, error) {
+	total, err := format.ParseBytes(m.TotalMemory)
+	if err != nil {
+		return memInfo{}, fmt.Errorf("total_memory: %w", err)
+	}
+
+	free := total
+	if m.FreeMemory != "" {
+		if free, err = format.ParseBytes(m.FreeMemory); err != nil {
+			return memInfo{}, fmt.Errorf("free_memory: %w", err)
+		}
+	}
+
+	if free > total {
+		return memInfo{}, errors.New("free_memory is greater than total_memory")
+	}
+
+	return memInfo{TotalMemory: total, FreeMemory: free}, nil
+}
+
+// LoadSimulated reads simulated GPUs from a YAML file such as
+//
+//	gpus:
+//	  - library: cuda
+//	    id: GPU-0
+//	    name: Simulated GPU
+//	    total_memory: 24GiB
+//	    free_memory: 23GiB
+//	memory:
+//	  total_memory: 64GiB
+//
+// Free memory defaults to the total memory. Without a memory section, the
+// system memory is the real system's.
+func LoadSimulated(name string) (*Simulated, error) {
+	bts, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		GPUs []struct {
+			simulatedMemory `yaml:",inline"`
+
+			Library string `yaml:"library"`
+			Variant string `yaml:"variant"`
+			ID      string `yaml:"id"`
+			Name    string `yaml:"name"`
+		} `yaml:"gpus"`
+		Memory *simulatedMemory `yaml:"memory"`
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(bts))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	var gpus GpuInfoList
+	for i, g := range file.GPUs {
+		info := GpuInfo{Library: g.Library, Variant: g.Variant, ID: g.ID, Name: g.Name}
+		switch {
+		case !slices.Contains([]string{"cuda", "rocm", "metal"}, g.Library):
+			return nil, fmt.Errorf("%s: gpus.%d.library: must be cuda, rocm or metal", name, i)
+		case g.ID == "":
+			return nil, fmt.Errorf("%s: gpus.%d.id: required", name, i)
+		case slices.ContainsFunc(gpus, func(other GpuInfo) bool { return other.ID == g.ID }):
+			return nil, fmt.Errorf("%s: gpus.%d.id: %q is used by another GPU", name, i, g.ID)
+		}
+
+		if info.memInfo, err = g.memInfo(); err != nil {
+			return nil, fmt.Errorf("%s: gpus.%d.%w", name, i, err)
+		}
+
+		// the same overhead as real CUDA and ROCm GPUs
+		if g.Library != "metal" {
+			info.MinimumMemory = simulatedMinimumMemory
+		}
+
+		if g.MinimumMemory != "" {
+			if info.MinimumMemory, err = format.ParseBytes(g.MinimumMemory); err != nil {
+				return nil, fmt.Errorf("%s: gpus.%d.minimum_memory: %w", name, i, err)
+			}
+		}
+
+		gpus = append(gpus, info)
+	}
+
+	var system GpuInfo
+	if file.Memory != nil {
+		if system.memInfo, err = file.Memory.memInfo(); err != nil {
+			return nil, fmt.Errorf("%s: memory.%w", name, err)
+		}
+	} else if system.memInfo, err = GetCPUMem(); err != nil {
+		return nil, err
+	}
+
+	return NewSimulated(gpus, system), nil
+}
+
+// GetGPUInfo returns the simulated GPUs like the real GetGPUInfo, or system
+// memory if there aren't any
+func (s *Simulated) GetGPUInfo() GpuInfoList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.gpus) == 0 {
+		return GpuInfoList{s.system}
+	}
+
+	return slices.Clone(s.gpus)
+}
+
+// GetCPUInfo returns the simulated system memory like the real GetCPUInfo
+func (s *Simulated) GetCPUInfo() GpuInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.system
+}
+
+// Allocate takes the given sizes from the free memory of the GPUs with the
+// given IDs, and system from the free system memory. Nothing is allocated
+// if any of them don't have enough free memory.
+func (s *Simulated) Allocate(gpuSizes map[string]uint64, system uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, size := range gpuSizes {
+		i := slices.IndexFunc(s.gpus, func(g GpuInfo) bool { return g.ID == id })
+		if i < 0 {
+			return fmt.Errorf("unknown simulated GPU %q", id)
+		}
+
+		if size > s.gpus[i].FreeMemory {
+			return fmt.Errorf("out of memory on simulated GPU %s: %s required, %s free", id, format.HumanBytes2(size), format.HumanBytes2(s.gpus[i].FreeMemory))
+		}
+	}
+
+	if system > s.system.FreeMemory {
+		return fmt.Errorf("out of simulated system memory: %s required, %s free", format.HumanBytes2(system), format.HumanBytes2(s.system.FreeMemory))
+	}
+
+	for id, size := range gpuSizes {
+		i := slices.IndexFunc(s.gpus, func(g GpuInfo) bool { return g.ID == id })
+		s.gpus[i].FreeMemory -= size
+	}
+	s.system.FreeMemory -= system
+	return nil
+}
+
+// Release returns memory taken by Allocate
+func (s *Simulated) Release(gpuSizes map[string]uint64, system uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, size := range gpuSizes {
+		if i := slices.IndexFunc(s.gpus, func(g GpuInfo) bool { return g.ID == id }); i >= 0 {
+			s.gpus[i].FreeMemory = min(s.gpus[i].FreeMemory+size, s.gpus[i].TotalMemory)
+		}
+	}
+	s.system.FreeMemory = min(s.system.FreeMemory+system, s.system.TotalMemory)
+}
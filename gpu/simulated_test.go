@@ -0,0 +1,99 @@
+package gpu
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/format"
+)
+
+func writeSimulated(t *testing.T, content string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "gpus.yaml")
+	require.NoError(t, os.WriteFile(name, []byte(content), 0o600))
+	return name
+}
+
+func TestLoadSimulated(t *testing.T) {
+	sim, err := LoadSimulated(writeSimulated(t, `
+gpus:
+  - library: cuda
+    id: GPU-0
+    name: Simulated GPU
+    total_memory: 24GiB
+    free_memory: 23GiB
+  - library: cuda
+    id: GPU-1
+    total_memory: 12GiB
+    minimum_memory: 256MiB
+memory:
+  total_memory: 64GiB
+  free_memory: 48GiB
+`))
+	require.NoError(t, err)
+
+	gpus := sim.GetGPUInfo()
+	require.Len(t, gpus, 2)
+	assert.Equal(t, "GPU-0", gpus[0].ID)
+	assert.Equal(t, "Simulated GPU", gpus[0].Name)
+	assert.Equal(t, uint64(24*format.GibiByte), gpus[0].TotalMemory)
+	assert.Equal(t, uint64(23*format.GibiByte), gpus[0].FreeMemory)
+	assert.Equal(t, uint64(simulatedMinimumMemory), gpus[0].MinimumMemory)
+	assert.Equal(t, uint64(12*format.GibiByte), gpus[1].FreeMemory)
+	assert.Equal(t, uint64(256*format.MebiByte), gpus[1].MinimumMemory)
+
+	system := sim.GetCPUInfo()
+	assert.Equal(t, "cpu", system.Library)
+	assert.Equal(t, uint64(64*format.GibiByte), system.TotalMemory)
+	assert.Equal(t, uint64(48*format.GibiByte), system.FreeMemory)
+}
+
+func TestLoadSimulatedErrors(t *testing.T) {
+	cases := map[string]struct {
+		content string
+		err     string
+	}{
+		"library":      {"gpus: [{library: vulkan, id: a, total_memory: 1GiB}]", "gpus.0.library: must be cuda, rocm or metal"},
+		"missing id":   {"gpus: [{library: cuda, total_memory: 1GiB}]", "gpus.0.id: required"},
+		"duplicate id": {"gpus: [{library: cuda, id: a, total_memory: 1GiB}, {library: cuda, id: a, total_memory: 1GiB}]", `gpus.1.id: "a" is used by another GPU`},
+		"free memory":  {"gpus: [{library: cuda, id: a, total_memory: 1GiB, free_memory: 2GiB}]", "gpus.0.free_memory is greater than total_memory"},
+		"size":         {"gpus: [{library: cuda, id: a, total_memory: lots}]", "gpus.0.total_memory"},
+		"unknown":      {"gpus: [{library: cuda, id: a, total_memory: 1GiB, vram: 1GiB}]", "field vram not found"},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadSimulated(writeSimulated(t, tt.content))
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestSimulatedAllocate(t *testing.T) {
+	g := GpuInfo{Library: "cuda", ID: "GPU-0"}
+	g.TotalMemory = 1000
+	g.FreeMemory = 1000
+	system := GpuInfo{}
+	system.TotalMemory = 500
+	system.FreeMemory = 500
+	sim := NewSimulated(GpuInfoList{g}, system)
+
+	require.NoError(t, sim.Allocate(map[string]uint64{"GPU-0": 600}, 100))
+	assert.Equal(t, uint64(400), sim.GetGPUInfo()[0].FreeMemory)
+	assert.Equal(t, uint64(400), sim.GetCPUInfo().FreeMemory)
+
+	// nothing is allocated if any of it doesn't fit
+	require.ErrorContains(t, sim.Allocate(map[string]uint64{"GPU-0": 600}, 0), "out of memory on simulated GPU GPU-0")
+	require.ErrorContains(t, sim.Allocate(map[string]uint64{"GPU-0": 100}, 500), "out of simulated system memory")
+	require.ErrorContains(t, sim.Allocate(map[string]uint64{"GPU-1": 100}, 0), `unknown simulated GPU "GPU-1"`)
+	assert.Equal(t, uint64(400), sim.GetGPUInfo()[0].FreeMemory)
+	assert.Equal(t, uint64(400), sim.GetCPUInfo().FreeMemory)
+
+	sim.Release(map[string]uint64{"GPU-0": 600}, 100)
+	assert.Equal(t, uint64(1000), sim.GetGPUInfo()[0].FreeMemory)
+	assert.Equal(t, uint64(500), sim.GetCPUInfo().FreeMemory)
+}
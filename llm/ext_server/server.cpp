@@ -1551,6 +1551,11 @@ struct llama_server_context
         result.stop = true;
         result.error = false;
 
+        // subtask ids are assigned in prompt order, but subtasks may finish in
+        // any order across slots, so restore the original prompt order
+        std::sort(multitask.results.begin(), multitask.results.end(),
+                  [](const task_result & a, const task_result & b) { return a.id < b.id; });
+
         // collect json results into one json result
         std::vector<json> result_jsons;
         for (auto& subres : multitask.results)
@@ -2010,6 +2015,19 @@ struct llama_server_context
                     result.probs.push_back({cur_p.data[i].id, cur_p.data[i].p});
                 }
 
+                if (n_probs > 0)
+                {
+                    // the sampled token may not be among the top n_probs candidates
+                    for (size_t i = 0; i < cur_p.size; ++i)
+                    {
+                        if (cur_p.data[i].id == id)
+                        {
+                            result.prob = cur_p.data[i].p;
+                            break;
+                        }
+                    }
+                }
+
                 if (!process_token(result, slot))
                 {
                     slot.release();
@@ -106,6 +106,7 @@ struct completion_token_output {
 
     std::vector<token_prob> probs;
     llama_token tok;
+    float prob = 0.0f;
     std::string text_to_send;
 };
 
@@ -648,6 +649,7 @@ static json probs_vector_to_json(const llama_context *ctx, const std::vector<com
         std::string tok_str = tokens_to_output_formatted_string(ctx, prob.tok);
         out.push_back(json{
             {"content", tok_str},
+            {"prob",    prob.prob},
             {"probs",   probs_for_token},
         });
     }
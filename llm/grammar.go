@@ -0,0 +1,542 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidFormat = errors.New("invalid format")
+
+var rootRuleRegex = regexp.MustCompile(`(?m)^\s*root\s*::=`)
+
+// Grammar returns the GBNF grammar used to constrain output for a request
+// format. The format may be "json", a raw GBNF grammar defining a root rule,
+// or a JSON Schema object. An empty format returns an empty grammar.
+func Grammar(format string) (string, error) {
+	format = strings.TrimSpace(format)
+	switch {
+	case format == "":
+		return "", nil
+	case format == "json":
+		return jsonGrammar, nil
+	case strings.HasPrefix(format, "{"):
+		grammar, err := SchemaToGrammar(json.RawMessage(format))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+		}
+
+		return grammar, nil
+	case rootRuleRegex.MatchString(format):
+		return format, nil
+	default:
+		return "", fmt.Errorf("%w: must be \"json\", a JSON schema, or a grammar with a root rule", ErrInvalidFormat)
+	}
+}
+
+// schema is the subset of JSON Schema that can be compiled to a grammar
+type schema struct {
+	Type                 schemaType         `json:"type"`
+	Properties           schemaProperties   `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Enum                 []json.RawMessage  `json:"enum"`
+	Const                json.RawMessage    `json:"const"`
+	AnyOf                []*schema          `json:"anyOf"`
+	OneOf                []*schema          `json:"oneOf"`
+	Ref                  string             `json:"$ref"`
+	Defs                 map[string]*schema `json:"$defs"`
+	Definitions          map[string]*schema `json:"definitions"`
+	Pattern              string             `json:"pattern"`
+}
+
+// schemaType is either a single type name or a list of type names
+type schemaType []string
+
+func (t *schemaType) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = schemaType{s}
+		return nil
+	}
+
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+
+	*t = ss
+	return nil
+}
+
+type schemaProperty struct {
+	Name   string
+	Schema *schema
+}
+
+// schemaProperties preserves the order properties are declared in so the
+// generated output follows the same order
+type schemaProperties []schemaProperty
+
+func (p *schemaProperties) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if delim, ok := t.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("properties must be an object")
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		var s schema
+		if err := dec.Decode(&s); err != nil {
+			return err
+		}
+
+		*p = append(*p, schemaProperty{Name: t.(string), Schema: &s})
+	}
+
+	return nil
+}
+
+var primitiveRules = map[string]string{
+	"boolean": `("true" | "false") space`,
+	"number":  `("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space`,
+	"integer": `("-"? ([0-9] | [1-9] [0-9]*)) space`,
+	"string":  `"\"" char* "\"" space`,
+	"null":    `"null" space`,
+	"value":   `object | array | string | number | boolean | null`,
+	"object":  `"{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`,
+	"array":   `"[" space ( value ("," space value)* )? "]" space`,
+	"char":    `[^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])`,
+	"space":   `" "?`,
+}
+
+var primitiveDeps = map[string][]string{
+	"string": {"char"},
+	"value":  {"object", "array", "string", "number", "boolean", "null"},
+	"object": {"string", "value"},
+	"array":  {"value"},
+}
+
+var invalidRuleChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+type schemaConverter struct {
+	rules map[string]string
+	defs  map[string]*schema
+	refs  map[string]string
+}
+
+// SchemaToGrammar compiles a JSON Schema into a GBNF grammar that only
+// accepts JSON matching the schema.
+func SchemaToGrammar(b []byte) (string, error) {
+	var s schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return "", err
+	}
+
+	c := schemaConverter{
+		rules: make(map[string]string),
+		defs:  make(map[string]*schema),
+		refs:  make(map[string]string),
+	}
+
+	for name, def := range s.Definitions {
+		c.defs["#/definitions/"+name] = def
+	}
+
+	for name, def := range s.Defs {
+		c.defs["#/$defs/"+name] = def
+	}
+
+	rule, err := c.visit(&s, "root")
+	if err != nil {
+		return "", err
+	}
+
+	if rule != "root" {
+		c.rules["root"] = rule
+	}
+
+	c.primitive("space")
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "root ::= %s\n", c.rules["root"])
+
+	names := make([]string, 0, len(c.rules))
+	for name := range c.rules {
+		if name != "root" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+
+	return sb.String(), nil
+}
+
+// addRule adds a rule under a name derived from name and returns the name
+// the rule can be referenced by
+func (c *schemaConverter) addRule(name, rule string) string {
+	name = strings.Trim(invalidRuleChars.ReplaceAllString(name, "-"), "-")
+	if name == "" {
+		name = "rule"
+	}
+
+	key := name
+	for i := 0; ; i++ {
+		existing, ok := c.rules[key]
+		if !ok || existing == rule {
+			break
+		}
+
+		key = fmt.Sprintf("%s%d", name, i)
+	}
+
+	c.rules[key] = rule
+	return key
+}
+
+func (c *schemaConverter) primitive(name string) string {
+	if _, ok := c.rules[name]; !ok {
+		c.rules[name] = primitiveRules[name]
+		for _, dep := range primitiveDeps[name] {
+			c.primitive(dep)
+		}
+	}
+
+	return name
+}
+
+func (c *schemaConverter) visit(s *schema, name string) (string, error) {
+	if s == nil {
+		return c.primitive("value"), nil
+	}
+
+	switch {
+	case s.Ref != "":
+		return c.visitRef(s.Ref)
+	case len(s.AnyOf) > 0 || len(s.OneOf) > 0:
+		alts := append(append([]*schema{}, s.AnyOf...), s.OneOf...)
+		rules := make([]string, len(alts))
+		for i, alt := range alts {
+			rule, err := c.visit(alt, fmt.Sprintf("%s-%d", name, i))
+			if err != nil {
+				return "", err
+			}
+			rules[i] = rule
+		}
+
+		return c.addRule(name, strings.Join(rules, " | ")), nil
+	case len(s.Const) > 0:
+		literal, err := jsonLiteral(s.Const)
+		if err != nil {
+			return "", err
+		}
+
+		return c.addRule(name, literal+" space"), nil
+	case len(s.Enum) > 0:
+		literals := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			literal, err := jsonLiteral(v)
+			if err != nil {
+				return "", err
+			}
+			literals[i] = literal
+		}
+
+		return c.addRule(name, "("+strings.Join(literals, " | ")+") space"), nil
+	case len(s.Type) > 1:
+		rules := make([]string, len(s.Type))
+		for i, t := range s.Type {
+			alt := *s
+			alt.Type = schemaType{t}
+			rule, err := c.visit(&alt, name+"-"+t)
+			if err != nil {
+				return "", err
+			}
+			rules[i] = rule
+		}
+
+		return c.addRule(name, strings.Join(rules, " | ")), nil
+	}
+
+	var t string
+	switch {
+	case len(s.Type) == 1:
+		t = s.Type[0]
+	case len(s.Properties) > 0:
+		t = "object"
+	case s.Items != nil:
+		t = "array"
+	}
+
+	switch t {
+	case "object":
+		return c.visitObject(s, name)
+	case "array":
+		if s.Items == nil && s.MinItems == nil && s.MaxItems == nil {
+			return c.primitive("array"), nil
+		}
+
+		if err := checkRepetitions("minItems", s.MinItems, "maxItems", s.MaxItems); err != nil {
+			return "", err
+		}
+
+		item, err := c.visit(s.Items, name+"-item")
+		if err != nil {
+			return "", err
+		}
+
+		return c.addRule(name, `"[" space `+repeat(item, `"," space`, s.MinItems, s.MaxItems)+` "]" space`), nil
+	case "string":
+		if s.Pattern != "" {
+			return "", fmt.Errorf("unsupported schema keyword: pattern")
+		}
+
+		if s.MinLength == nil && s.MaxLength == nil {
+			return c.primitive("string"), nil
+		}
+
+		if err := checkRepetitions("minLength", s.MinLength, "maxLength", s.MaxLength); err != nil {
+			return "", err
+		}
+
+		char := c.primitive("char")
+		c.primitive("space")
+		return c.addRule(name, `"\"" `+repeat(char, "", s.MinLength, s.MaxLength)+` "\"" space`), nil
+	case "number", "integer", "boolean", "null":
+		return c.primitive(t), nil
+	case "":
+		return c.primitive("value"), nil
+	default:
+		return "", fmt.Errorf("unsupported schema type: %s", t)
+	}
+}
+
+func (c *schemaConverter) visitRef(ref string) (string, error) {
+	if rule, ok := c.refs[ref]; ok {
+		return rule, nil
+	}
+
+	def, ok := c.defs[ref]
+	if !ok {
+		return "", fmt.Errorf("unresolved schema reference: %s", ref)
+	}
+
+	// reserve the rule name first so recursive references resolve to it
+	name := c.addRule("ref-"+ref[strings.LastIndex(ref, "/")+1:], ref)
+	c.refs[ref] = name
+
+	rule, err := c.visit(def, name+"-def")
+	if err != nil {
+		return "", err
+	}
+
+	c.rules[name] = rule
+	return name, nil
+}
+
+func (c *schemaConverter) visitObject(s *schema, name string) (string, error) {
+	if len(s.Properties) == 0 {
+		return c.primitive("object"), nil
+	}
+
+	required := make(map[string]bool, len(s.Required))
+	for _, r := range s.Required {
+		required[r] = true
+	}
+
+	c.primitive("space")
+
+	var requiredKVs, optionalKVs []string
+	for _, p := range s.Properties {
+		value, err := c.visit(p.Schema, name+"-"+p.Name)
+		if err != nil {
+			return "", err
+		}
+
+		key, err := jsonLiteral(mustMarshal(p.Name))
+		if err != nil {
+			return "", err
+		}
+
+		kv := c.addRule(name+"-"+p.Name+"-kv", key+` space ":" space `+value)
+		if required[p.Name] {
+			requiredKVs = append(requiredKVs, kv)
+		} else {
+			optionalKVs = append(optionalKVs, kv)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`"{" space `)
+	sb.WriteString(strings.Join(requiredKVs, ` "," space `))
+
+	if len(optionalKVs) > 0 {
+		// each optional property may be omitted, so any of them may be the
+		// first one written after the required properties
+		var alts []string
+		for i := range optionalKVs {
+			alts = append(alts, c.optionalProperties(optionalKVs[i:], false))
+		}
+
+		if len(requiredKVs) > 0 {
+			fmt.Fprintf(&sb, ` ( "," space ( %s ) )?`, strings.Join(alts, " | "))
+		} else {
+			fmt.Fprintf(&sb, `( %s )?`, strings.Join(alts, " | "))
+		}
+	}
+
+	sb.WriteString(` "}" space`)
+	return c.addRule(name, sb.String()), nil
+}
+
+// optionalProperties returns a rule matching the first of kvs followed by any
+// subset of the rest, in order
+func (c *schemaConverter) optionalProperties(kvs []string, optional bool) string {
+	rule := kvs[0]
+	if optional {
+		rule = `( "," space ` + rule + ` )?`
+	}
+
+	if len(kvs) > 1 {
+		rule += " " + c.addRule(kvs[0]+"-rest", c.optionalProperties(kvs[1:], true))
+	}
+
+	return rule
+}
+
+// maxRepetitions is the largest bound on the number of items or characters
+// a schema may set. The grammar grows with the bounds, so larger ones would
+// take too long to compile.
+const maxRepetitions = 1000
+
+// checkRepetitions checks a schema's bounds on the number of items or
+// characters aren't larger than maxRepetitions
+func checkRepetitions(minName string, min *int, maxName string, max *int) error {
+	if min != nil && *min > maxRepetitions {
+		return fmt.Errorf("%s must be at most %d", minName, maxRepetitions)
+	}
+
+	if max != nil && *max > maxRepetitions {
+		return fmt.Errorf("%s must be at most %d", maxName, maxRepetitions)
+	}
+
+	return nil
+}
+
+// repeat returns a rule matching between min and max occurrences of item,
+// separated by sep. A nil max is unbounded.
+func repeat(item, sep string, min, max *int) string {
+	lo := 0
+	if min != nil && *min > 0 {
+		lo = *min
+	}
+
+	hi := -1
+	if max != nil {
+		hi = *max
+		if hi < lo {
+			hi = lo
+		}
+	}
+
+	next := item
+	if sep != "" {
+		next = sep + " " + item
+	}
+
+	// rest matches the optional occurrences following the first n
+	rest := func(n int) string {
+		if hi < 0 {
+			return fmt.Sprintf("( %s )*", next)
+		}
+
+		return nestedOptional(next, hi-n)
+	}
+
+	if lo == 0 {
+		if hi == 0 {
+			return `""`
+		}
+
+		return strings.TrimSpace(fmt.Sprintf("( %s %s", item, rest(1))) + " )?"
+	}
+
+	parts := []string{item}
+	for i := 1; i < lo; i++ {
+		parts = append(parts, next)
+	}
+
+	if r := rest(lo); r != "" {
+		parts = append(parts, r)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// nestedOptional returns a rule matching up to n occurrences of item
+func nestedOptional(item string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+
+	// ( item ( item ( item )? )? )? for n = 3
+	return strings.Repeat("( "+item+" ", n) + strings.TrimSuffix(strings.Repeat(")? ", n), " ")
+}
+
+// jsonLiteral renders a JSON value as a GBNF string literal matching its
+// compact encoding
+func jsonLiteral(v json.RawMessage) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, v); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range buf.String() {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+
+	return sb.String(), nil
+}
+
+func mustMarshal(v any) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
@@ -0,0 +1,148 @@
+package llm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGrammar(t *testing.T) {
+	cases := []struct {
+		name    string
+		format  string
+		grammar string
+		err     bool
+	}{
+		{name: "empty", format: ``},
+		{name: "json", format: `json`, grammar: jsonGrammar},
+		{name: "raw grammar", format: `root ::= "yes" | "no"`, grammar: `root ::= "yes" | "no"`},
+		{name: "unknown string", format: `xml`, err: true},
+		{name: "array", format: `["json"]`, err: true},
+		{name: "schema", format: `{"type": "boolean"}`, grammar: "root ::= boolean\nboolean ::= (\"true\" | \"false\") space\nspace ::= \" \"?\n"},
+		{name: "invalid schema", format: `{"type": "date"}`, err: true},
+		{name: "max length too large", format: `{"type": "string", "maxLength": 100000}`, err: true},
+		{name: "min items too large", format: `{"type": "array", "items": {"type": "number"}, "minItems": 1001}`, err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			grammar, err := Grammar(tc.format)
+			if tc.err {
+				if !errors.Is(err, ErrInvalidFormat) {
+					t.Fatalf("expected ErrInvalidFormat, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if grammar != tc.grammar {
+				t.Errorf("expected %q, got %q", tc.grammar, grammar)
+			}
+		})
+	}
+}
+
+func TestSchemaToGrammar(t *testing.T) {
+	cases := []struct {
+		name    string
+		schema  string
+		grammar string
+		err     bool
+	}{
+		{
+			name:   "object",
+			schema: `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}, "nick": {"type": ["string", "null"]}}, "required": ["name", "age"]}`,
+			grammar: `root ::= "{" space root-name-kv "," space root-age-kv ( "," space ( root-nick-kv ) )? "}" space
+char ::= [^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])
+integer ::= ("-"? ([0-9] | [1-9] [0-9]*)) space
+null ::= "null" space
+root-age-kv ::= "\"age\"" space ":" space integer
+root-name-kv ::= "\"name\"" space ":" space string
+root-nick ::= string | null
+root-nick-kv ::= "\"nick\"" space ":" space root-nick
+space ::= " "?
+string ::= "\"" char* "\"" space
+`,
+		},
+		{
+			name:   "optional properties",
+			schema: `{"type": "object", "properties": {"a": {"enum": ["x", "y", 1]}, "b": {"const": "z"}}}`,
+			grammar: `root ::= "{" space ( root-a-kv root-a-kv-rest | root-b-kv )? "}" space
+root-a ::= ("\"x\"" | "\"y\"" | "1") space
+root-a-kv ::= "\"a\"" space ":" space root-a
+root-a-kv-rest ::= ( "," space root-b-kv )?
+root-b ::= "\"z\"" space
+root-b-kv ::= "\"b\"" space ":" space root-b
+space ::= " "?
+`,
+		},
+		{
+			name:   "recursive reference",
+			schema: `{"$defs": {"node": {"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#/$defs/node"}}}, "required": ["children"]}}, "$ref": "#/$defs/node"}`,
+			grammar: `root ::= ref-node
+ref-node ::= ref-node-def
+ref-node-def ::= "{" space ref-node-def-children-kv "}" space
+ref-node-def-children ::= "[" space ( ref-node ( "," space ref-node )* )? "]" space
+ref-node-def-children-kv ::= "\"children\"" space ":" space ref-node-def-children
+space ::= " "?
+`,
+		},
+		{
+			name:   "array bounds",
+			schema: `{"type": "array", "items": {"type": "number"}, "minItems": 1, "maxItems": 3}`,
+			grammar: `root ::= "[" space number ( "," space number ( "," space number )? )? "]" space
+number ::= ("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space
+space ::= " "?
+`,
+		},
+		{
+			name:   "string length",
+			schema: `{"type": "string", "minLength": 2}`,
+			grammar: `root ::= "\"" char char ( char )* "\"" space
+char ::= [^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])
+space ::= " "?
+`,
+		},
+		{name: "pattern", schema: `{"type": "string", "pattern": "^a+$"}`, err: true},
+		{name: "unresolved reference", schema: `{"$ref": "#/$defs/missing"}`, err: true},
+		{name: "unsupported type", schema: `{"type": "date"}`, err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			grammar, err := SchemaToGrammar([]byte(tc.schema))
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if grammar != tc.grammar {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.grammar, grammar)
+			}
+		})
+	}
+}
+
+func TestNestedOptional(t *testing.T) {
+	if rule := nestedOptional("a", 3); rule != "( a ( a ( a )? )? )?" {
+		t.Errorf("unexpected rule %q", rule)
+	}
+
+	// the rule grows linearly with the bound
+	grammar, err := Grammar(`{"type": "string", "maxLength": 1000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(grammar) > 20000 {
+		t.Errorf("expected a grammar of at most 20000 bytes, got %d", len(grammar))
+	}
+}
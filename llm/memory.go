@@ -3,10 +3,11 @@ package llm
 import (
 	"fmt"
 	"log/slog"
-	"os"
 	"strconv"
+	"strings"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/gpu"
 )
@@ -25,14 +26,14 @@ func PredictServerFit(allGpus gpu.GpuInfoList, ggml *GGML, adapters, projectors
 
 	// Split up the GPUs by type and try them
 	for _, gpus := range allGpus.ByLibrary() {
-		var layerCount int
-		layerCount, estimatedVRAM = EstimateGPULayers(gpus, ggml, projectors, opts)
+		estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
+		estimatedVRAM = estimate.VRAMSize
 		if opts.NumGPU < 0 {
-			if layerCount > 0 && layerCount >= int(ggml.KV().BlockCount()+1) {
+			if estimate.Layers > 0 && estimate.Layers >= int(ggml.KV().BlockCount()+1) {
 				return true, estimatedVRAM
 			}
 		} else {
-			if layerCount > 0 && layerCount >= opts.NumGPU {
+			if estimate.Layers > 0 && estimate.Layers >= opts.NumGPU {
 				return true, estimatedVRAM
 			}
 		}
@@ -40,43 +41,73 @@ func PredictServerFit(allGpus gpu.GpuInfoList, ggml *GGML, adapters, projectors
 	return false, estimatedVRAM
 }
 
+// MemoryEstimate is a plan for offloading a model to one or more GPUs
+type MemoryEstimate struct {
+	// Layers is the number of layers that can be offloaded
+	Layers int
+
+	// VRAMSize is the VRAM required to offload Layers layers
+	VRAMSize uint64
+
+	// TotalSize is the memory required to offload every layer
+	TotalSize uint64
+
+	// GPULayers and GPUSizes are the number of layers offloaded to each GPU
+	// and the VRAM they require, in the same order as the GPUs
+	GPULayers []int
+	GPUSizes  []uint64
+
+	// TensorSplit is the runner's --tensor-split for GPULayers, or empty if
+	// there is only one GPU or the number of layers to offload was set
+	TensorSplit string
+}
+
 // Given a model and one or more GPU targets, predict how many layers and bytes we can load
 // The GPUs provided must all be the same Library
-func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts api.Options) (int, uint64) {
+func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts api.Options) MemoryEstimate {
+	estimate := MemoryEstimate{
+		GPULayers: make([]int, len(gpus)),
+		GPUSizes:  make([]uint64, len(gpus)),
+	}
+
 	if gpus[0].Library == "cpu" {
-		return 0, 0
+		return estimate
 	}
+
+	available := make([]uint64, len(gpus))
 	var memoryAvailable uint64
-	for _, info := range gpus {
+	for i, info := range gpus {
+		available[i] = info.FreeMemory
 		memoryAvailable += info.FreeMemory
 	}
-	userLimit := os.Getenv("OLLAMA_MAX_VRAM")
-	if userLimit != "" {
-		avail, err := strconv.ParseUint(userLimit, 10, 64)
-		if err != nil {
-			slog.Error("invalid setting, ignoring", "OLLAMA_MAX_VRAM", userLimit, "error", err)
-		} else {
-			slog.Info("user override memory limit", "OLLAMA_MAX_VRAM", avail, "actual", memoryAvailable)
-			memoryAvailable = avail
+	if cfg := envconfig.Current(); cfg.IsSet("max_vram") {
+		slog.Info("user override memory limit", "OLLAMA_MAX_VRAM", cfg.MaxVRAM, "actual", memoryAvailable)
+
+		// share the limit between the GPUs in proportion to their free memory
+		for i := range available {
+			if memoryAvailable > 0 {
+				available[i] = uint64(float64(cfg.MaxVRAM) * float64(available[i]) / float64(memoryAvailable))
+			} else {
+				available[i] = cfg.MaxVRAM / uint64(len(gpus))
+			}
 		}
+		memoryAvailable = cfg.MaxVRAM
 	}
 
 	slog.Debug("evaluating", "library", gpus[0].Library, "gpu_count", len(gpus), "available", format.HumanBytes2(memoryAvailable))
 
-	// TODO - this is probably wrong, first GPU vs secondaries will have different overheads
-	memoryMinimum := gpus[0].MinimumMemory
-
+	var memoryProjectors uint64
 	for _, projector := range projectors {
-		memoryMinimum += projectorMemoryRequirements(projector)
+		memoryProjectors += projectorMemoryRequirements(projector)
 
 		// multimodal models require at least 2048 context
 		opts.NumCtx = max(opts.NumCtx, 2048)
 	}
 
-	// fp16 k,v = (1 (k) + 1 (v)) * sizeof(float16) * n_ctx * n_layer * n_embd / n_head * n_head_kv
-	var kv uint64 = 2 * 2 * uint64(opts.NumCtx) * ggml.KV().BlockCount() * ggml.KV().EmbeddingLength() / ggml.KV().HeadCount() * ggml.KV().HeadCountKV()
+	numCtx := contextSize(opts)
+	kv := kvCacheSize(ggml, numCtx)
 
-	graphPartialOffload, graphFullOffload := ggml.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)))
+	graphPartialOffload, graphFullOffload := ggml.GraphSize(uint64(numCtx), uint64(min(numCtx, opts.NumBatch)))
 	if graphPartialOffload == 0 {
 		graphPartialOffload = ggml.KV().GQA() * kv / 6
 	}
@@ -85,20 +116,6 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 		graphFullOffload = graphPartialOffload
 	}
 
-	graphFullOffload *= uint64(len(gpus))
-	graphPartialOffload *= uint64(len(gpus))
-
-	// memoryRequiredTotal represents the memory required for full GPU offloading (all layers)
-	memoryRequiredTotal := memoryMinimum + graphFullOffload
-
-	// memoryRequiredPartial represents the memory required for partial GPU offloading (n > 0, n < layers)
-	memoryRequiredPartial := memoryMinimum + graphPartialOffload
-
-	if memoryRequiredPartial > memoryAvailable {
-		slog.Debug("insufficient VRAM to load any model layers")
-		return 0, 0
-	}
-
 	layers := ggml.Tensors().Layers()
 
 	var memoryLayerOutput uint64
@@ -108,37 +125,113 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 		}
 	}
 
-	if gpus[0].Library == "metal" && opts.UseMMap {
-		// memory is preallocated for output tensors
-		memoryRequiredTotal += memoryLayerOutput
-		memoryRequiredPartial += memoryLayerOutput
+	// memory is preallocated for output tensors
+	preallocated := gpus[0].Library == "metal" && opts.UseMMap
+
+	// overhead is the memory each GPU requires besides its layers. The first
+	// GPU also holds the projectors and any preallocated output tensors.
+	overhead := make([]uint64, len(gpus))
+	for i, info := range gpus {
+		overhead[i] = info.MinimumMemory
+	}
+	overhead[0] += memoryProjectors
+	if preallocated {
+		overhead[0] += memoryLayerOutput
 	}
 
-	var layerCount int
-	for i := 0; i < int(ggml.KV().BlockCount()); i++ {
-		memoryLayer := layers[fmt.Sprintf("blk.%d", i)].size()
+	// memoryRequiredTotal represents the memory required for full GPU offloading (all layers)
+	memoryRequiredTotal := memoryProjectors + memoryLayerOutput
+	for _, info := range gpus {
+		memoryRequiredTotal += info.MinimumMemory + graphFullOffload
+	}
 
-		// KV is proportional to the number of layers
-		memoryLayer += kv / ggml.KV().BlockCount()
+	// room is the memory each GPU has for layers. Layers are split between
+	// the GPUs in proportion to their room, by giving each layer to the GPU
+	// that would have the smallest share of its room used.
+	room := make([]float64, len(gpus))
+	for i := range gpus {
+		if required := overhead[i] + graphPartialOffload; available[i] > required {
+			room[i] = float64(available[i] - required)
+		}
+	}
+
+	var memoryWeights uint64
+	blockCount := int(ggml.KV().BlockCount())
+	for i := 0; i < blockCount; i++ {
+		memoryWeights += layers[fmt.Sprintf("blk.%d", i)].size()
 
+		// KV is proportional to the number of layers
+		memoryLayer := layers[fmt.Sprintf("blk.%d", i)].size() + kv/ggml.KV().BlockCount()
 		memoryRequiredTotal += memoryLayer
-		if memoryAvailable > memoryRequiredPartial+memoryLayer {
-			memoryRequiredPartial += memoryLayer
-			layerCount++
+
+		g := -1
+		for j := range gpus {
+			used := float64(estimate.GPUSizes[j] + memoryLayer)
+			if used < room[j] && (g < 0 || used/room[j] < float64(estimate.GPUSizes[g]+memoryLayer)/room[g]) {
+				g = j
+			}
+		}
+
+		if g >= 0 {
+			estimate.GPUSizes[g] += memoryLayer
+			estimate.GPULayers[g]++
+			estimate.Layers++
 		}
 	}
 
-	if gpus[0].Library != "metal" || !opts.UseMMap {
-		// memory was not preallocated for output tensors
-		memoryRequiredTotal += memoryLayerOutput
+	// The output layer is offloaded to the last GPU with layers, once every
+	// other layer has been
+	last := 0
+	for i := range gpus {
+		if estimate.GPULayers[i] > 0 {
+			last = i
+		}
 	}
 
-	if memoryAvailable > memoryRequiredTotal {
-		layerCount = int(ggml.KV().BlockCount()) + 1
-		memoryRequiredPartial = memoryRequiredTotal
+	graph := graphPartialOffload
+	if estimate.Layers == blockCount {
+		full := true
+		for i := range gpus {
+			if estimate.GPULayers[i] == 0 && i != last {
+				continue
+			}
+
+			required := overhead[i] + graphFullOffload + estimate.GPUSizes[i]
+			if i == last && !preallocated {
+				required += memoryLayerOutput
+			}
+
+			if available[i] <= required {
+				full = false
+			}
+		}
+
+		if full {
+			graph = graphFullOffload
+			estimate.GPULayers[last]++
+			estimate.Layers++
+			if !preallocated {
+				estimate.GPUSizes[last] += memoryLayerOutput
+			}
+		}
 	}
 
-	memoryWeights := memoryRequiredTotal - memoryMinimum - graphFullOffload - kv
+	for i := range gpus {
+		if estimate.GPULayers[i] > 0 {
+			estimate.GPUSizes[i] += overhead[i] + graph
+			estimate.VRAMSize += estimate.GPUSizes[i]
+		}
+	}
+
+	estimate.TotalSize = memoryRequiredTotal
+	if len(gpus) > 1 && estimate.Layers > 0 && opts.NumGPU < 0 {
+		estimate.TensorSplit = tensorSplit(estimate.GPULayers)
+	}
+
+	gpuSizes := make([]string, len(gpus))
+	for i, size := range estimate.GPUSizes {
+		gpuSizes[i] = format.HumanBytes2(size)
+	}
 
 	slog.Info(
 		"offload to gpu",
@@ -147,7 +240,9 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 			// actual number of layers offloaded
 			"real", opts.NumGPU,
 			// estimated number of layers that can be offloaded
-			"estimate", layerCount,
+			"estimate", estimate.Layers,
+			// estimated number of layers offloaded to each GPU
+			"split", estimate.TensorSplit,
 		),
 		slog.Group(
 			"memory",
@@ -158,16 +253,18 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 				// memory required for full offloading
 				"full", format.HumanBytes2(memoryRequiredTotal),
 				// memory required to offload layers.estimate layers
-				"partial", format.HumanBytes2(memoryRequiredPartial),
+				"partial", format.HumanBytes2(estimate.VRAMSize),
+				// memory required on each GPU
+				"gpus", strings.Join(gpuSizes, ","),
 				// memory of KV cache
 				"kv", format.HumanBytes2(kv),
 			),
 			slog.Group(
 				"weights",
 				// memory of the weights
-				"total", format.HumanBytes2(memoryWeights),
+				"total", format.HumanBytes2(memoryWeights+memoryLayerOutput),
 				// memory of repeating layers
-				"repeating", format.HumanBytes2(memoryWeights-memoryLayerOutput),
+				"repeating", format.HumanBytes2(memoryWeights),
 				// memory of non-repeating layers
 				"nonrepeating", format.HumanBytes2(memoryLayerOutput),
 			),
@@ -180,5 +277,85 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 			),
 		),
 	)
-	return layerCount, uint64(memoryRequiredPartial)
+	return estimate
+}
+
+// withLayers returns the GPUs the estimate offloads layers to, and the
+// estimate for just those GPUs. GPUs without layers would still take the
+// runner's overhead if it could see them. If no layers are offloaded, the
+// GPUs and estimate are returned as they are.
+func (e MemoryEstimate) withLayers(gpus gpu.GpuInfoList) (gpu.GpuInfoList, MemoryEstimate) {
+	if e.Layers == 0 {
+		return gpus, e
+	}
+
+	var used gpu.GpuInfoList
+	estimate := MemoryEstimate{Layers: e.Layers, VRAMSize: e.VRAMSize, TotalSize: e.TotalSize}
+	for i, layers := range e.GPULayers {
+		if layers > 0 {
+			used = append(used, gpus[i])
+			estimate.GPULayers = append(estimate.GPULayers, layers)
+			estimate.GPUSizes = append(estimate.GPUSizes, e.GPUSizes[i])
+		}
+	}
+
+	if len(used) > 1 {
+		estimate.TensorSplit = tensorSplit(estimate.GPULayers)
+	}
+
+	return used, estimate
+}
+
+// tensorSplit returns the runner's --tensor-split for the number of layers
+// offloaded to each GPU
+func tensorSplit(gpuLayers []int) string {
+	split := make([]string, len(gpuLayers))
+	for i, layers := range gpuLayers {
+		split[i] = strconv.Itoa(layers)
+	}
+	return strings.Join(split, ",")
+}
+
+// EstimateTotalMemory estimates the memory required to hold a model and its
+// context, regardless of how it is split between system memory and VRAM
+func EstimateTotalMemory(ggml *GGML, projectors []string, opts api.Options) uint64 {
+	var memoryRequired uint64
+	for _, projector := range projectors {
+		memoryRequired += projectorMemoryRequirements(projector)
+
+		// multimodal models require at least 2048 context
+		opts.NumCtx = max(opts.NumCtx, 2048)
+	}
+
+	numCtx := contextSize(opts)
+	kv := kvCacheSize(ggml, numCtx)
+
+	_, graph := ggml.GraphSize(uint64(numCtx), uint64(min(numCtx, opts.NumBatch)))
+	if graph == 0 {
+		graph = ggml.KV().GQA() * kv / 6
+	}
+
+	for _, layer := range ggml.Tensors().Layers() {
+		memoryRequired += layer.size()
+	}
+
+	return memoryRequired + kv + graph
+}
+
+// kvCacheSize returns the size of the fp16 KV cache for a context of numCtx tokens
+func kvCacheSize(ggml *GGML, numCtx int) uint64 {
+	// fp16 k,v = (1 (k) + 1 (v)) * sizeof(float16) * n_ctx * n_layer * n_embd / n_head * n_head_kv
+	return 2 * 2 * uint64(numCtx) * ggml.KV().BlockCount() * ggml.KV().EmbeddingLength() / ggml.KV().HeadCount() * ggml.KV().HeadCountKV()
+}
+
+// numParallel returns the number of requests a runner loaded with opts
+// serves at once
+func numParallel(opts api.Options) int {
+	return max(opts.NumParallel, 1)
+}
+
+// contextSize returns the context a runner loaded with opts allocates,
+// which is split between the requests it serves at once
+func contextSize(opts api.Options) int {
+	return opts.NumCtx * numParallel(opts)
 }
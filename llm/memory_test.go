@@ -0,0 +1,183 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+func TestEstimateGPULayers(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tensors := []Tensor{
+		{Name: "output.weight", Kind: 0, Shape: []uint64{1024}, WriterTo: bytes.NewReader(make([]byte, 4096))},
+	}
+	for i := range 4 {
+		tensors = append(tensors, Tensor{Name: fmt.Sprintf("blk.%d.attn.weight", i), Kind: 0, Shape: []uint64{1024}, WriterTo: bytes.NewReader(make([]byte, 4096))})
+	}
+
+	if err := NewGGUFV3(binary.LittleEndian).Encode(f, KV{
+		"general.architecture":          "llama",
+		"general.name":                  "test",
+		"llama.context_length":          uint32(32),
+		"llama.embedding_length":        uint32(32),
+		"llama.block_count":             uint32(4),
+		"llama.attention.head_count":    uint32(8),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{" "},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, err := LoadModel(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 32
+
+	// each layer is 4 KiB of weights and 4 KiB of KV cache
+	layer := uint64(8192)
+	output := uint64(4096)
+	graphPartial, graphFull := ggml.GraphSize(32, 32)
+
+	newGPU := func(id string, free uint64) gpu.GpuInfo {
+		g := gpu.GpuInfo{Library: "cuda", ID: id}
+		g.FreeMemory = free
+		return g
+	}
+
+	cases := []struct {
+		name   string
+		gpus   []gpu.GpuInfo
+		layers []int
+		sizes  []uint64
+		split  string
+	}{
+		{
+			name:   "single gpu",
+			gpus:   []gpu.GpuInfo{newGPU("0", 1<<30)},
+			layers: []int{5},
+			sizes:  []uint64{graphFull + 4*layer + output},
+		},
+		{
+			name:   "split evenly",
+			gpus:   []gpu.GpuInfo{newGPU("0", 1<<30), newGPU("1", 1<<30)},
+			layers: []int{2, 3},
+			sizes:  []uint64{graphFull + 2*layer, graphFull + 2*layer + output},
+			split:  "2,3",
+		},
+		{
+			name:   "no room on second gpu",
+			gpus:   []gpu.GpuInfo{newGPU("0", 1<<30), newGPU("1", graphPartial)},
+			layers: []int{5, 0},
+			sizes:  []uint64{graphFull + 4*layer + output, 0},
+			split:  "5,0",
+		},
+		{
+			name:   "split by room",
+			gpus:   []gpu.GpuInfo{newGPU("0", 1<<30), newGPU("1", graphPartial+2*layer+1)},
+			layers: []int{5, 0},
+			sizes:  []uint64{graphFull + 4*layer + output, 0},
+			split:  "5,0",
+		},
+		{
+			name:   "partial offload",
+			gpus:   []gpu.GpuInfo{newGPU("0", graphPartial+layer+1), newGPU("1", graphPartial+2*layer+1)},
+			layers: []int{1, 2},
+			sizes:  []uint64{graphPartial + layer, graphPartial + 2*layer},
+			split:  "1,2",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			estimate := EstimateGPULayers(tt.gpus, ggml, nil, opts)
+
+			var layers int
+			var size uint64
+			for i := range tt.gpus {
+				layers += tt.layers[i]
+				size += tt.sizes[i]
+			}
+
+			if estimate.Layers != layers {
+				t.Errorf("expected %d layers, got %d", layers, estimate.Layers)
+			}
+
+			if !slices.Equal(estimate.GPULayers, tt.layers) {
+				t.Errorf("expected layers %v, got %v", tt.layers, estimate.GPULayers)
+			}
+
+			if !slices.Equal(estimate.GPUSizes, tt.sizes) {
+				t.Errorf("expected sizes %v, got %v", tt.sizes, estimate.GPUSizes)
+			}
+
+			if estimate.VRAMSize != size {
+				t.Errorf("expected VRAM size %d, got %d", size, estimate.VRAMSize)
+			}
+
+			if estimate.TensorSplit != tt.split {
+				t.Errorf("expected tensor split %q, got %q", tt.split, estimate.TensorSplit)
+			}
+		})
+	}
+
+	t.Run("gpus without layers", func(t *testing.T) {
+		gpus := gpu.GpuInfoList{newGPU("0", graphPartial), newGPU("1", 1<<30), newGPU("2", graphPartial)}
+		used, estimate := EstimateGPULayers(gpus, ggml, nil, opts).withLayers(gpus)
+		if len(used) != 1 || used[0].ID != "1" {
+			t.Fatalf("expected only GPU 1 to be used, got %v", used)
+		}
+
+		if !slices.Equal(estimate.GPULayers, []int{5}) {
+			t.Errorf("expected layers [5], got %v", estimate.GPULayers)
+		}
+
+		if !slices.Equal(estimate.GPUSizes, []uint64{graphFull + 4*layer + output}) {
+			t.Errorf("expected sizes [%d], got %v", graphFull+4*layer+output, estimate.GPUSizes)
+		}
+
+		if estimate.TensorSplit != "" {
+			t.Errorf("expected no tensor split, got %q", estimate.TensorSplit)
+		}
+	})
+
+	t.Run("num gpu", func(t *testing.T) {
+		opts := opts
+		opts.NumGPU = 5
+
+		// llama.cpp splits the layers that were set
+		estimate := EstimateGPULayers([]gpu.GpuInfo{newGPU("0", 1<<30), newGPU("1", 1<<30)}, ggml, nil, opts)
+		if estimate.TensorSplit != "" {
+			t.Errorf("expected no tensor split, got %q", estimate.TensorSplit)
+		}
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		opts := opts
+		opts.NumParallel = 2
+
+		// each request has its own context, doubling the KV cache
+		_, graphFull := ggml.GraphSize(64, 64)
+		size := graphFull + 4*(layer+4096) + output
+
+		estimate := EstimateGPULayers([]gpu.GpuInfo{newGPU("0", 1<<30)}, ggml, nil, opts)
+		if estimate.VRAMSize != size {
+			t.Errorf("expected VRAM size %d, got %d", size, estimate.VRAMSize)
+		}
+	})
+}
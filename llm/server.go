@@ -10,6 +10,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -24,6 +25,7 @@ import (
 	"golang.org/x/sync/semaphore"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/gpu"
 )
@@ -32,11 +34,13 @@ type LlamaServer interface {
 	Ping(ctx context.Context) error
 	WaitUntilRunning(ctx context.Context) error
 	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
-	Embedding(ctx context.Context, prompt string) ([]float64, error)
+	Embedding(ctx context.Context, input []string) ([][]float64, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
 	Close() error
 	EstimatedVRAM() uint64
+	EstimatedVRAMByGPU(gpuID string) uint64
+	EstimatedTotal() uint64
 }
 
 // llmServer is an instance of the llama.cpp server
@@ -46,9 +50,10 @@ type llmServer struct {
 	done    chan error // Channel to signal when the process exits
 	status  *StatusWriter
 	options api.Options
+	gpus    gpu.GpuInfoList
 
-	// TODO - this should be broken down by GPU
-	estimatedVRAM uint64 // Estimated usage of VRAM by the loaded model
+	estimate       MemoryEstimate // Estimated usage of VRAM by the loaded model, on each GPU
+	estimatedTotal uint64         // Estimated usage of VRAM and system memory by the loaded model
 
 	sem *semaphore.Weighted
 }
@@ -82,12 +87,11 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 	}
 
 	cpuRunner := ""
-	var estimatedVRAM uint64
+	var estimate MemoryEstimate
+	estimatedTotal := EstimateTotalMemory(ggml, projectors, opts)
 	var systemMemory uint64
 	if (len(gpus) == 1 && gpus[0].Library == "cpu") || opts.NumGPU == 0 {
-
-		// TODO evaluate system memory to see if we should block the load, or force an unload of another CPU runner
-
+		// the scheduler has already checked the model fits in system memory
 		cpuRunner = serverForCpu()
 	} else {
 		if gpus[0].Library == "metal" {
@@ -99,15 +103,20 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 				slog.Debug("system memory", "total", format.HumanBytes2(systemMemory))
 			}
 		}
-		var layers int
-		layers, estimatedVRAM = EstimateGPULayers(gpus, ggml, projectors, opts)
+		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+
+		// only GPUs with layers are visible to the runner, unless the number
+		// of layers was set, in which case llama.cpp splits them
+		if opts.NumGPU < 0 {
+			gpus, estimate = estimate.withLayers(gpus)
+		}
 
-		if gpus[0].Library == "metal" && estimatedVRAM > systemMemory {
+		if gpus[0].Library == "metal" && estimate.VRAMSize > systemMemory {
 			// disable partial offloading when model is greater than total system memory as this
 			// can lead to locking up the system
 			opts.NumGPU = 0
-		} else if opts.NumGPU < 0 && layers > 0 && gpus[0].Library != "cpu" {
-			opts.NumGPU = layers
+		} else if opts.NumGPU < 0 && estimate.Layers > 0 && gpus[0].Library != "cpu" {
+			opts.NumGPU = estimate.Layers
 		}
 	}
 
@@ -125,7 +134,8 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 	} else {
 		servers = serversForGpu(gpus[0]) // All GPUs in the list are matching Library and Variant
 	}
-	demandLib := strings.Trim(os.Getenv("OLLAMA_LLM_LIBRARY"), "\"' ")
+	cfg := envconfig.Current()
+	demandLib := cfg.LLMLibrary
 	if demandLib != "" {
 		serverPath := availableServers[demandLib]
 		if serverPath == "" {
@@ -142,11 +152,11 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 
 	params := []string{
 		"--model", model,
-		"--ctx-size", fmt.Sprintf("%d", opts.NumCtx),
+		"--ctx-size", fmt.Sprintf("%d", contextSize(opts)),
 		"--batch-size", fmt.Sprintf("%d", opts.NumBatch),
 		"--embedding",
 	}
-	if debug := os.Getenv("OLLAMA_DEBUG"); debug != "" {
+	if cfg.Debug {
 		params = append(params, "--log-format", "json")
 	} else {
 		params = append(params, "--log-disable")
@@ -156,10 +166,15 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		params = append(params, "--n-gpu-layers", fmt.Sprintf("%d", opts.NumGPU))
 	}
 
-	if debug := os.Getenv("OLLAMA_DEBUG"); debug != "" {
+	if cfg.Debug {
 		params = append(params, "--verbose")
 	}
 
+	if opts.NumGPU != 0 && estimate.TensorSplit != "" {
+		// split layers between the GPUs as they were estimated, rather than by their total memory
+		params = append(params, "--tensor-split", estimate.TensorSplit)
+	}
+
 	if opts.MainGPU > 0 {
 		params = append(params, "--main-gpu", fmt.Sprintf("%d", opts.MainGPU))
 	}
@@ -195,16 +210,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 	}
 
 	// "--cont-batching", // TODO - doesn't seem to have any noticeable perf change for multiple requests
-	numParallel := 1
-	if onp := os.Getenv("OLLAMA_NUM_PARALLEL"); onp != "" {
-		numParallel, err = strconv.Atoi(onp)
-		if err != nil || numParallel <= 0 {
-			err = fmt.Errorf("invalid OLLAMA_NUM_PARALLEL=%s must be greater than zero - %w", onp, err)
-			slog.Error("misconfiguration", "error", err)
-			return nil, err
-		}
-	}
-	params = append(params, "--parallel", fmt.Sprintf("%d", numParallel))
+	params = append(params, "--parallel", fmt.Sprintf("%d", numParallel(opts)))
 
 	for i := 0; i < len(servers); i++ {
 		dir := availableServers[servers[i]]
@@ -268,12 +274,14 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		}
 
 		s := &llmServer{
-			port:          port,
-			cmd:           exec.Command(server, finalParams...),
-			status:        NewStatusWriter(os.Stderr),
-			options:       opts,
-			estimatedVRAM: estimatedVRAM,
-			sem:           semaphore.NewWeighted(int64(numParallel)),
+			port:           port,
+			cmd:            exec.Command(server, finalParams...),
+			status:         NewStatusWriter(os.Stderr),
+			options:        opts,
+			gpus:           gpus,
+			estimate:       estimate,
+			estimatedTotal: max(estimatedTotal, estimate.VRAMSize),
+			sem:            semaphore.NewWeighted(int64(numParallel(opts))),
 		}
 
 		libEnv := fmt.Sprintf("%s=%s", pathEnv, strings.Join(libraryPaths, string(filepath.ListSeparator)))
@@ -436,12 +444,12 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 	ticker := time.NewTicker(50 * time.Millisecond)
 	defer ticker.Stop()
 
-	slog.Info("waiting for llama runner to start responding")
+	slog.InfoContext(ctx, "waiting for llama runner to start responding")
 	var lastStatus ServerStatus = -1
 	for {
 		select {
 		case <-ctx.Done():
-			slog.Info("context expired before server started")
+			slog.InfoContext(ctx, "context expired before server started")
 			return fmt.Errorf("timed out waiting for llama runner to start")
 		case err := <-s.done:
 			msg := ""
@@ -470,7 +478,7 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			defer cancel()
 			status, err := s.getServerStatus(c)
 			if err != nil && lastStatus != status {
-				slog.Debug("server not yet available", "error", err)
+				slog.DebugContext(ctx, "server not yet available", "error", err)
 				lastStatus = status
 				continue
 			}
@@ -479,9 +487,9 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			case ServerStatusLoadingModel:
 				// TODO - this state never seems to happen with the current server.cpp code (bug?)
 				// it doesn't respond to the health endpoint until after the model is loaded
-				slog.Debug("loading model")
+				slog.DebugContext(ctx, "loading model")
 			case ServerStatusReady:
-				slog.Debug(fmt.Sprintf("llama runner started in %f seconds", time.Since(start).Seconds()))
+				slog.DebugContext(ctx, fmt.Sprintf("llama runner started in %f seconds", time.Since(start).Seconds()))
 				return nil
 			}
 		}
@@ -530,6 +538,15 @@ type completion struct {
 	Prompt  string `json:"prompt"`
 	Stop    bool   `json:"stop"`
 
+	CompletionProbabilities []struct {
+		Content string  `json:"content"`
+		Prob    float64 `json:"prob"`
+		Probs   []struct {
+			TokStr string  `json:"tok_str"`
+			Prob   float64 `json:"prob"`
+		} `json:"probs"`
+	} `json:"completion_probabilities"`
+
 	Timings struct {
 		PredictedN  int     `json:"predicted_n"`
 		PredictedMS float64 `json:"predicted_ms"`
@@ -543,10 +560,17 @@ type CompletionRequest struct {
 	Format  string
 	Images  []ImageData
 	Options api.Options
+
+	// Grammar constrains the output, as compiled from Format by Grammar
+	Grammar string
+
+	// Logprobs is the number of top alternatives to report for each token
+	Logprobs int
 }
 
 type CompletionResponse struct {
 	Content            string
+	Logprobs           []api.Logprob
 	Done               bool
 	PromptEvalCount    int
 	PromptEvalDuration time.Duration
@@ -556,7 +580,7 @@ type CompletionResponse struct {
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
 	if err := s.sem.Acquire(ctx, 1); err != nil {
-		slog.Error("Failed to acquire semaphore", "error", err)
+		slog.ErrorContext(ctx, "Failed to acquire semaphore", "error", err)
 		return err
 	}
 	defer s.sem.Release(1)
@@ -564,7 +588,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	// only allow maximum 10 "context shifts" to avoid infinite generation
 	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
 		req.Options.NumPredict = 10 * s.options.NumCtx
-		slog.Debug("setting token limit to 10x num_ctx", "num_ctx", s.options.NumCtx, "num_predict", req.Options.NumPredict)
+		slog.DebugContext(ctx, "setting token limit to 10x num_ctx", "num_ctx", s.options.NumCtx, "num_predict", req.Options.NumPredict)
 	}
 
 	request := map[string]any{
@@ -590,6 +614,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"stop":              req.Options.Stop,
 		"image_data":        req.Images,
 		"cache_prompt":      true,
+		"n_probs":           req.Logprobs,
 	}
 
 	// Make sure the server is ready
@@ -600,10 +625,14 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
-	if req.Format == "json" {
-		request["grammar"] = jsonGrammar
-		if !strings.Contains(strings.ToLower(req.Prompt), "json") {
-			slog.Warn("Prompt does not specify that the LLM should response in JSON, but JSON format is expected. For best results specify that JSON is expected in the system prompt.")
+	if req.Grammar != "" {
+		request["grammar"] = req.Grammar
+
+		// raw grammars are not necessarily JSON
+		format := strings.TrimSpace(req.Format)
+		isJSON := strings.HasPrefix(format, "{") || format == "json"
+		if isJSON && !strings.Contains(strings.ToLower(req.Prompt), "json") {
+			slog.WarnContext(ctx, "Prompt does not specify that the LLM should response in JSON, but JSON format is expected. For best results specify that JSON is expected in the system prompt.")
 		}
 	}
 
@@ -691,13 +720,19 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 				// 30 picked as an arbitrary max token repeat limit, modify as needed
 				if tokenRepeat > 30 {
-					slog.Debug("prediction aborted, token repeat limit reached")
+					slog.DebugContext(ctx, "prediction aborted, token repeat limit reached")
 					return ctx.Err()
 				}
 
 				if c.Content != "" {
+					var logprobs []api.Logprob
+					if len(c.CompletionProbabilities) > 0 {
+						logprobs = completionLogprobs(c)
+					}
+
 					fn(CompletionResponse{
-						Content: c.Content,
+						Content:  c.Content,
+						Logprobs: logprobs,
 					})
 				}
 
@@ -736,17 +771,56 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	return fmt.Errorf("max retries exceeded")
 }
 
+// minLogprob is reported in place of the log probability of tokens that
+// have no chance of being generated, since -Inf can't be encoded as JSON
+const minLogprob = -9999.0
+
+func logprob(p float64) float64 {
+	if p <= 0 {
+		return minLogprob
+	}
+
+	return max(math.Log(p), minLogprob)
+}
+
+// completionLogprobs converts the token probabilities reported with a
+// completion into log probabilities
+func completionLogprobs(c completion) []api.Logprob {
+	logprobs := make([]api.Logprob, 0, len(c.CompletionProbabilities))
+	for _, cp := range c.CompletionProbabilities {
+		lp := api.Logprob{
+			TokenLogprob: api.TokenLogprob{Token: cp.Content, Logprob: logprob(cp.Prob)},
+		}
+
+		for _, p := range cp.Probs {
+			lp.TopLogprobs = append(lp.TopLogprobs, api.TokenLogprob{Token: p.TokStr, Logprob: logprob(p.Prob)})
+		}
+
+		logprobs = append(logprobs, lp)
+	}
+
+	return logprobs
+}
+
 type EmbeddingRequest struct {
-	Content string `json:"content"`
+	Content []string `json:"content"`
 }
 
 type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
-func (s *llmServer) Embedding(ctx context.Context, prompt string) ([]float64, error) {
+// embeddingBatchResponse is returned by the runner when more than one
+// input is embedded in a single request
+type embeddingBatchResponse struct {
+	Results []EmbeddingResponse `json:"results"`
+}
+
+// Embedding generates embeddings for each of the inputs in a single request
+// to the runner. Embeddings are returned in the same order as the inputs.
+func (s *llmServer) Embedding(ctx context.Context, input []string) ([][]float64, error) {
 	if err := s.sem.Acquire(ctx, 1); err != nil {
-		slog.Error("Failed to acquire semaphore", "error", err)
+		slog.ErrorContext(ctx, "Failed to acquire semaphore", "error", err)
 		return nil, err
 	}
 	defer s.sem.Release(1)
@@ -758,7 +832,11 @@ func (s *llmServer) Embedding(ctx context.Context, prompt string) ([]float64, er
 		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
-	data, err := json.Marshal(TokenizeRequest{Content: prompt})
+	if len(input) == 0 {
+		return [][]float64{}, nil
+	}
+
+	data, err := json.Marshal(EmbeddingRequest{Content: input})
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling embed data: %w", err)
 	}
@@ -785,12 +863,31 @@ func (s *llmServer) Embedding(ctx context.Context, prompt string) ([]float64, er
 		return nil, fmt.Errorf("%s", body)
 	}
 
-	var embedding EmbeddingResponse
-	if err := json.Unmarshal(body, &embedding); err != nil {
-		return nil, fmt.Errorf("unmarshal tokenize response: %w", err)
+	// a single input is treated as a single prompt by the runner
+	if len(input) == 1 {
+		var embedding EmbeddingResponse
+		if err := json.Unmarshal(body, &embedding); err != nil {
+			return nil, fmt.Errorf("unmarshal embedding response: %w", err)
+		}
+
+		return [][]float64{embedding.Embedding}, nil
+	}
+
+	var batch embeddingBatchResponse
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, fmt.Errorf("unmarshal embedding response: %w", err)
 	}
 
-	return embedding.Embedding, nil
+	if len(batch.Results) != len(input) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(input), len(batch.Results))
+	}
+
+	embeddings := make([][]float64, len(batch.Results))
+	for i, r := range batch.Results {
+		embeddings[i] = r.Embedding
+	}
+
+	return embeddings, nil
 }
 
 type TokenizeRequest struct {
@@ -907,7 +1004,23 @@ func (s *llmServer) Close() error {
 }
 
 func (s *llmServer) EstimatedVRAM() uint64 {
-	return s.estimatedVRAM
+	return s.estimate.VRAMSize
+}
+
+// EstimatedVRAMByGPU returns the estimated usage of VRAM by the loaded model
+// on a GPU, which is 0 for GPUs the model isn't loaded on
+func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
+	for i, g := range s.gpus {
+		if g.ID == gpuID && i < len(s.estimate.GPUSizes) {
+			return s.estimate.GPUSizes[i]
+		}
+	}
+
+	return 0
+}
+
+func (s *llmServer) EstimatedTotal() uint64 {
+	return s.estimatedTotal
 }
 
 func parseDurationMs(ms float64) time.Duration {
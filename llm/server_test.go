@@ -0,0 +1,56 @@
+package llm
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestCompletionLogprobs(t *testing.T) {
+	var c completion
+	if err := json.Unmarshal([]byte(`{
+		"content": " blue",
+		"stop": false,
+		"completion_probabilities": [{
+			"content": " blue",
+			"prob": 0.5,
+			"probs": [
+				{"tok_str": " blue", "prob": 0.5},
+				{"tok_str": " red", "prob": 0.25},
+				{"tok_str": " green", "prob": 0}
+			]
+		}]
+	}`), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	logprobs := completionLogprobs(c)
+	if len(logprobs) != 1 {
+		t.Fatalf("expected 1 logprob, got %d", len(logprobs))
+	}
+
+	expect := api.Logprob{
+		TokenLogprob: api.TokenLogprob{Token: " blue", Logprob: math.Log(0.5)},
+		TopLogprobs: []api.TokenLogprob{
+			{Token: " blue", Logprob: math.Log(0.5)},
+			{Token: " red", Logprob: math.Log(0.25)},
+			{Token: " green", Logprob: minLogprob},
+		},
+	}
+
+	if logprobs[0].TokenLogprob != expect.TokenLogprob {
+		t.Errorf("expected %v, got %v", expect.TokenLogprob, logprobs[0].TokenLogprob)
+	}
+
+	if len(logprobs[0].TopLogprobs) != len(expect.TopLogprobs) {
+		t.Fatalf("expected %d top logprobs, got %d", len(expect.TopLogprobs), len(logprobs[0].TopLogprobs))
+	}
+
+	for i := range expect.TopLogprobs {
+		if logprobs[0].TopLogprobs[i] != expect.TopLogprobs[i] {
+			t.Errorf("top logprob %d: expected %v, got %v", i, expect.TopLogprobs[i], logprobs[0].TopLogprobs[i])
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+// stubResponse is what the stub server generates for every prompt
+var stubResponse = strings.Fields("This is a response from a stub runner. No model was evaluated to generate it.")
+
+// stubTokenDelay is how long the stub server takes to generate each token
+var stubTokenDelay = 10 * time.Millisecond
+
+// stubServer stands in for the llama.cpp server on simulated GPUs. It takes
+// the memory it's estimated to use from the simulated inventory, so loading
+// a model that doesn't fit fails as it would on real GPUs.
+type stubServer struct {
+	sim     *gpu.Simulated
+	options api.Options
+	gpus    gpu.GpuInfoList
+
+	estimate       MemoryEstimate
+	estimatedTotal uint64
+
+	allocated map[string]uint64 // VRAM taken from each simulated GPU
+	system    uint64            // system memory taken from the simulated inventory
+
+	mu     sync.Mutex
+	closed bool
+
+	sem *semaphore.Weighted
+}
+
+// NewStubServer returns a stub server for the given simulated GPUs, which
+// estimates the model's memory like NewLlamaServer but runs nothing
+func NewStubServer(sim *gpu.Simulated, gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, opts api.Options) (LlamaServer, error) {
+	if opts.NumCtx > int(ggml.KV().ContextLength()) {
+		opts.NumCtx = int(ggml.KV().ContextLength())
+	}
+
+	if opts.NumCtx < 4 {
+		opts.NumCtx = 4
+	}
+
+	if len(adapters) > 1 {
+		return nil, errors.New("ollama supports only one lora adapter, but multiple were provided")
+	}
+
+	var estimate MemoryEstimate
+	if !(len(gpus) == 1 && gpus[0].Library == "cpu") && opts.NumGPU != 0 {
+		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		if opts.NumGPU < 0 {
+			gpus, estimate = estimate.withLayers(gpus)
+		}
+	}
+
+	s := &stubServer{
+		sim:            sim,
+		options:        opts,
+		gpus:           gpus,
+		estimate:       estimate,
+		estimatedTotal: max(EstimateTotalMemory(ggml, projectors, opts), estimate.VRAMSize),
+		allocated:      make(map[string]uint64),
+		sem:            semaphore.NewWeighted(int64(numParallel(opts))),
+	}
+
+	for i, size := range estimate.GPUSizes {
+		if size > 0 {
+			s.allocated[gpus[i].ID] = size
+		}
+	}
+	s.system = s.estimatedTotal - estimate.VRAMSize
+
+	if err := sim.Allocate(s.allocated, s.system); err != nil {
+		return nil, fmt.Errorf("error loading model %s: %w", model, err)
+	}
+
+	slog.Info("starting stub server", "model", model, "gpus", len(s.allocated), "layers", estimate.Layers, "tensor_split", estimate.TensorSplit, "system", s.system)
+	return s, nil
+}
+
+func (s *stubServer) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("stub server has stopped")
+	}
+
+	return nil
+}
+
+func (s *stubServer) WaitUntilRunning(ctx context.Context) error {
+	return s.Ping(ctx)
+}
+
+func (s *stubServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer s.sem.Release(1)
+
+	numPredict := len(stubResponse)
+	if req.Options.NumPredict > 0 {
+		numPredict = min(numPredict, req.Options.NumPredict)
+	}
+
+	start := time.Now()
+	for i, word := range stubResponse[:numPredict] {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(stubTokenDelay):
+		}
+
+		if i > 0 {
+			word = " " + word
+		}
+
+		fn(CompletionResponse{Content: word})
+	}
+
+	fn(CompletionResponse{
+		Done:            true,
+		PromptEvalCount: len(strings.Fields(req.Prompt)),
+		EvalCount:       numPredict,
+		EvalDuration:    time.Since(start),
+	})
+
+	return nil
+}
+
+// Embedding returns a pseudorandom unit vector for each input, which is
+// always the same for the same input
+func (s *stubServer) Embedding(ctx context.Context, input []string) ([][]float64, error) {
+	embeddings := make([][]float64, len(input))
+	for i, content := range input {
+		h := fnv.New64a()
+		h.Write([]byte(content))
+		r := rand.New(rand.NewSource(int64(h.Sum64())))
+
+		var norm float64
+		embedding := make([]float64, 16)
+		for j := range embedding {
+			embedding[j] = r.Float64()*2 - 1
+			norm += embedding[j] * embedding[j]
+		}
+
+		for j := range embedding {
+			embedding[j] /= math.Sqrt(norm)
+		}
+
+		embeddings[i] = embedding
+	}
+
+	return embeddings, nil
+}
+
+// Tokenize returns a token for each word of content
+func (s *stubServer) Tokenize(ctx context.Context, content string) ([]int, error) {
+	var tokens []int
+	for _, word := range strings.Fields(content) {
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		tokens = append(tokens, int(h.Sum32()%32000))
+	}
+
+	return tokens, nil
+}
+
+// Detokenize returns a placeholder for each token, since words can't be
+// recovered from their tokens
+func (s *stubServer) Detokenize(ctx context.Context, tokens []int) (string, error) {
+	words := make([]string, len(tokens))
+	for i, token := range tokens {
+		words[i] = fmt.Sprintf("<%d>", token)
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+func (s *stubServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		slog.Debug("stopping stub server")
+		s.sim.Release(s.allocated, s.system)
+		s.closed = true
+	}
+
+	return nil
+}
+
+func (s *stubServer) EstimatedVRAM() uint64 {
+	return s.estimate.VRAMSize
+}
+
+func (s *stubServer) EstimatedVRAMByGPU(gpuID string) uint64 {
+	return s.allocated[gpuID]
+}
+
+func (s *stubServer) EstimatedTotal() uint64 {
+	return s.estimatedTotal
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := NewHandler(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(handler).With("component", "test")
+	logger.InfoContext(WithRequestID(context.Background(), "abc"), "hello", "key", "value")
+	logger.DebugContext(context.Background(), "hidden")
+	logger.Info("no request")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %q", len(lines), buf.String())
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]any{"msg": "hello", "key": "value", "component": "test", "request_id": "abc", "level": "INFO"} {
+		if record[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, record[k])
+		}
+	}
+
+	source, ok := record["source"].(map[string]any)
+	if !ok || source["file"] != "logging_test.go" {
+		t.Errorf("expected source file to be trimmed, got %v", record["source"])
+	}
+
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("expected no request_id, got %s", lines[1])
+	}
+}
+
+func TestNewHandlerText(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := NewHandler(&buf, "", slog.LevelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slog.New(handler).DebugContext(WithRequestID(context.Background(), "abc"), "hello")
+	if !strings.Contains(buf.String(), "msg=hello request_id=abc") {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	if _, err := NewHandler(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	}
+
+	for s, expect := range cases {
+		level, err := ParseLevel(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if level != expect {
+			t.Errorf("%s: expected %v, got %v", s, expect, level)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected error for invalid level")
+	}
+}
@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file that is rotated once it grows beyond a maximum
+// size. Rotated files are renamed with a numeric suffix, name.1 being the
+// most recent, and the oldest are removed once there are more than the
+// maximum number of backups.
+type RotatingFile struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens name for appending, creating it if needed. A
+// maxSize <= 0 disables rotation.
+func OpenRotatingFile(name string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to the first backup and opens a new one.
+// Must be called with f locked.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			if err := os.Rename(backupName(f.name, i), backupName(f.name, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		if err := os.Rename(f.name, backupName(f.name, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.name); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+func backupName(name string, i int) string {
+	return fmt.Sprintf("%s.%d", name, i)
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.log")
+
+	f, err := OpenRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each write would take the file past 10 bytes, so each is rotated and
+	// only the two most recent backups are kept
+	for file, expect := range map[string]string{
+		name:        "fourth\n",
+		name + ".1": "third\n",
+		name + ".2": "second\n",
+	} {
+		bts, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(bts) != expect {
+			t.Errorf("%s: expected %q, got %q", filepath.Base(file), expect, bts)
+		}
+	}
+
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected oldest backup to be removed, got %v", err)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.log")
+	if err := os.WriteFile(name, []byte("existing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(name, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("appended\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bts, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(bts) != "existing\nappended\n" {
+		t.Errorf("unexpected content %q", bts)
+	}
+}
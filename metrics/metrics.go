@@ -0,0 +1,311 @@
+// Package metrics implements counters, gauges and histograms that can be
+// exported in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds, suited to
+// request latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// Registry holds a set of metrics and writes them out together.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounterVec registers a counter partitioned by the given labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, kindCounter, nil, labels)}
+}
+
+// NewGaugeVec registers a gauge partitioned by the given labels.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, kindGauge, nil, labels)}
+}
+
+// NewHistogramVec registers a histogram partitioned by the given labels.
+// buckets are the upper bounds of the histogram's buckets, in increasing order.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets for %s are not sorted", name))
+	}
+
+	return &HistogramVec{r.register(name, help, kindHistogram, buckets, labels)}
+}
+
+func (r *Registry) register(name, help string, kind kind, buckets []float64, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range r.metrics {
+		if m.name == name {
+			panic(fmt.Sprintf("metrics: %s is already registered", name))
+		}
+	}
+
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+
+	return cw.n, cw.w.Flush()
+}
+
+// Handler serves the registry's metrics over HTTP.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w) //nolint:errcheck
+	})
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+
+	// value is the counter or gauge value, or the histogram sum
+	value float64
+
+	// counts are the cumulative histogram bucket counts; the last is +Inf
+	counts []uint64
+}
+
+func (m *metric) with(labelValues []string, fn func(*series)) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		if m.kind == kindHistogram {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+
+	fn(s)
+}
+
+func (m *metric) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.series)
+}
+
+func (m *metric) write(w *countingWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		labels := formatLabels(m.labels, s.labelValues)
+		switch m.kind {
+		case kindHistogram:
+			names := append(slices.Clone(m.labels), "le")
+			values := append(slices.Clone(s.labelValues), "")
+			for i, upper := range m.buckets {
+				values[len(values)-1] = formatFloat(upper)
+				fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.counts[i])
+			}
+			count := s.counts[len(m.buckets)]
+			values[len(values)-1] = "+Inf"
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, count)
+		default:
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatFloat(s.value))
+		}
+	}
+}
+
+// CounterVec is a value that only increases, partitioned by labels.
+type CounterVec struct {
+	m *metric
+}
+
+// Add increases the counter with the given label values by v, which must not be negative.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: %s counter cannot decrease", c.m.name))
+	}
+
+	c.m.with(labelValues, func(s *series) { s.value += v })
+}
+
+// Inc increases the counter with the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels.
+type GaugeVec struct {
+	m *metric
+}
+
+// Set sets the gauge with the given label values to v.
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.m.with(labelValues, func(s *series) { s.value = v })
+}
+
+// Add adds v, which may be negative, to the gauge with the given label values.
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	g.m.with(labelValues, func(s *series) { s.value += v })
+}
+
+// Reset removes all of the gauge's values, so values for labels that no
+// longer apply are not exported.
+func (g *GaugeVec) Reset() {
+	g.m.reset()
+}
+
+// HistogramVec counts observations in buckets, partitioned by labels.
+type HistogramVec struct {
+	m *metric
+}
+
+// Observe adds v to the histogram with the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.m.with(labelValues, func(s *series) {
+		s.value += v
+		for i, upper := range h.m.buckets {
+			if v <= upper {
+				s.counts[i]++
+			}
+		}
+		s.counts[len(h.m.buckets)]++
+	})
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(names[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Number of requests.", "handler", "code")
+	queue := r.NewGaugeVec("queue_depth", "Number of queued\nrequests.")
+	latency := r.NewHistogramVec("latency_seconds", "Request latency.", []float64{0.1, 1}, "handler")
+	empty := r.NewGaugeVec("empty", "Unset gauge.", "label")
+
+	requests.Inc("/api/chat", "200")
+	requests.Add(2, "/api/chat", "200")
+	requests.Inc(`/api/"quoted"`, "500")
+	queue.Set(3)
+	queue.Add(-1)
+	latency.Observe(0.05, "/api/chat")
+	latency.Observe(0.5, "/api/chat")
+	latency.Observe(math.Inf(1), "/api/chat")
+	empty.Set(1, "removed")
+	empty.Reset()
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(b.Len()) {
+		t.Errorf("expected %d bytes written, got %d", b.Len(), n)
+	}
+
+	expect := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{handler="/api/\"quoted\"",code="500"} 1
+requests_total{handler="/api/chat",code="200"} 3
+# HELP queue_depth Number of queued\nrequests.
+# TYPE queue_depth gauge
+queue_depth 2
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{handler="/api/chat",le="0.1"} 1
+latency_seconds_bucket{handler="/api/chat",le="1"} 2
+latency_seconds_bucket{handler="/api/chat",le="+Inf"} 3
+latency_seconds_sum{handler="/api/chat"} +Inf
+latency_seconds_count{handler="/api/chat"} 3
+# HELP empty Unset gauge.
+# TYPE empty gauge
+`
+
+	if b.String() != expect {
+		t.Errorf("expected:\n%s\ngot:\n%s", expect, b.String())
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	cases := map[string]func(r *Registry){
+		"duplicate": func(r *Registry) {
+			r.NewCounterVec("requests_total", "Number of requests.")
+		},
+		"unsorted buckets": func(r *Registry) {
+			r.NewHistogramVec("latency_seconds", "Request latency.", []float64{1, 0.1})
+		},
+		"label count": func(r *Registry) {
+			r.NewCounterVec("labeled_total", "Labeled.", "handler").Inc()
+		},
+		"negative counter": func(r *Registry) {
+			r.NewCounterVec("negative_total", "Negative.").Add(-1)
+		},
+	}
+
+	for name, fn := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := NewRegistry()
+			r.NewCounterVec("requests_total", "Number of requests.")
+
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic")
+				}
+			}()
+
+			fn(r)
+		})
+	}
+}
@@ -4,14 +4,18 @@ package openai
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
 )
 
 type Error struct {
@@ -26,20 +30,49 @@ type ErrorResponse struct {
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+type ToolCall struct {
+	// Index identifies the tool call in a stream of chunks
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int       `json:"index"`
+	Message      Message   `json:"message"`
+	Logprobs     *Logprobs `json:"logprobs"`
+	FinishReason *string   `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int       `json:"index"`
+	Delta        Message   `json:"delta"`
+	Logprobs     *Logprobs `json:"logprobs"`
+	FinishReason *string   `json:"finish_reason"`
+}
+
+type Logprobs struct {
+	Content []LogprobContent `json:"content"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type LogprobContent struct {
+	TopLogprob
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
 }
 
 type Usage struct {
@@ -49,7 +82,15 @@ type Usage struct {
 }
 
 type ResponseFormat struct {
-	Type string `json:"type"`
+	Type       string      `json:"type"`
+	JsonSchema *JsonSchema `json:"json_schema,omitempty"`
+}
+
+type JsonSchema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      *bool           `json:"strict,omitempty"`
 }
 
 type ChatCompletionRequest struct {
@@ -64,6 +105,10 @@ type ChatCompletionRequest struct {
 	PresencePenalty  *float64        `json:"presence_penalty_penalty"`
 	TopP             *float64        `json:"top_p"`
 	ResponseFormat   *ResponseFormat `json:"response_format"`
+	Tools            []api.Tool      `json:"tools"`
+	ToolChoice       any             `json:"tool_choice"`
+	Logprobs         *bool           `json:"logprobs"`
+	TopLogprobs      *int            `json:"top_logprobs"`
 }
 
 type ChatCompletion struct {
@@ -85,13 +130,95 @@ type ChatCompletionChunk struct {
 	Choices           []ChunkChoice `json:"choices"`
 }
 
+// CompletionRequest is a request to the legacy completions endpoint
+type CompletionRequest struct {
+	Model            string   `json:"model"`
+	Prompt           string   `json:"prompt"`
+	Stream           bool     `json:"stream"`
+	MaxTokens        *int     `json:"max_tokens"`
+	Seed             *int     `json:"seed"`
+	Stop             any      `json:"stop"`
+	Temperature      *float64 `json:"temperature"`
+	FrequencyPenalty *float64 `json:"frequency_penalty"`
+	PresencePenalty  *float64 `json:"presence_penalty"`
+	TopP             *float64 `json:"top_p"`
+}
+
+type CompleteChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type Completion struct {
+	Id                string           `json:"id"`
+	Object            string           `json:"object"`
+	Created           int64            `json:"created"`
+	Model             string           `json:"model"`
+	SystemFingerprint string           `json:"system_fingerprint"`
+	Choices           []CompleteChoice `json:"choices"`
+	Usage             Usage            `json:"usage,omitempty"`
+}
+
+type CompletionChunk struct {
+	Id                string           `json:"id"`
+	Object            string           `json:"object"`
+	Created           int64            `json:"created"`
+	Model             string           `json:"model"`
+	SystemFingerprint string           `json:"system_fingerprint"`
+	Choices           []CompleteChoice `json:"choices"`
+}
+
+// EmbedRequest is a request to the embeddings endpoint. Input is either a
+// string or an array of strings.
+type EmbedRequest struct {
+	Input any    `json:"input"`
+	Model string `json:"model"`
+}
+
+type Embedding struct {
+	Object    string    `json:"object"`
+	Embedding []float64 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type EmbeddingList struct {
+	Object string         `json:"object"`
+	Data   []Embedding    `json:"data"`
+	Model  string         `json:"model"`
+	Usage  EmbeddingUsage `json:"usage,omitempty"`
+}
+
+type Model struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type ListCompletion struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
 func NewError(code int, message string) ErrorResponse {
 	var etype string
 	switch code {
 	case http.StatusBadRequest:
 		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
 	case http.StatusNotFound:
 		etype = "not_found_error"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
 	default:
 		etype = "api_error"
 	}
@@ -99,6 +226,77 @@ func NewError(code int, message string) ErrorResponse {
 	return ErrorResponse{Error{Type: etype, Message: message}}
 }
 
+func toolCallId() string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return "call_" + string(b)
+}
+
+func toToolCalls(tc []api.ToolCall) []ToolCall {
+	toolCalls := make([]ToolCall, len(tc))
+	for i, call := range tc {
+		toolCalls[i].ID = toolCallId()
+		toolCalls[i].Type = "function"
+		toolCalls[i].Function.Name = call.Function.Name
+
+		args, err := json.Marshal(call.Function.Arguments)
+		if err != nil {
+			slog.Error("could not marshall function arguments to json", "error", err)
+			continue
+		}
+
+		toolCalls[i].Function.Arguments = string(args)
+	}
+
+	return toolCalls
+}
+
+func finishReason(r api.ChatResponse) *string {
+	if !r.Done {
+		return nil
+	}
+
+	reason := "stop"
+	if len(r.Message.ToolCalls) > 0 {
+		reason = "tool_calls"
+	}
+
+	return &reason
+}
+
+func toTopLogprob(t api.TokenLogprob) TopLogprob {
+	bts := []byte(t.Token)
+	b := make([]int, len(bts))
+	for i := range bts {
+		b[i] = int(bts[i])
+	}
+
+	return TopLogprob{Token: t.Token, Logprob: t.Logprob, Bytes: b}
+}
+
+func toLogprobs(logprobs []api.Logprob) *Logprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	content := make([]LogprobContent, len(logprobs))
+	for i, lp := range logprobs {
+		content[i] = LogprobContent{
+			TopLogprob:  toTopLogprob(lp.TokenLogprob),
+			TopLogprobs: make([]TopLogprob, len(lp.TopLogprobs)),
+		}
+
+		for j, top := range lp.TopLogprobs {
+			content[i].TopLogprobs[j] = toTopLogprob(top)
+		}
+	}
+
+	return &Logprobs{Content: content}
+}
+
 func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 	return ChatCompletion{
 		Id:                id,
@@ -107,8 +305,53 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content},
+			Index:        0,
+			Message:      Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toToolCalls(r.Message.ToolCalls)},
+			Logprobs:     toLogprobs(r.Logprobs),
+			FinishReason: finishReason(r),
+		}},
+		Usage: Usage{
+			// TODO: ollama returns 0 for prompt eval if the prompt was cached, but openai returns the actual count
+			PromptTokens:     r.PromptEvalCount,
+			CompletionTokens: r.EvalCount,
+			TotalTokens:      r.PromptEvalCount + r.EvalCount,
+		},
+	}
+}
+
+func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
+	toolCalls := toToolCalls(r.Message.ToolCalls)
+	for i := range toolCalls {
+		toolCalls[i].Index = &i
+	}
+
+	return ChatCompletionChunk{
+		Id:                id,
+		Object:            "chat.completion.chunk",
+		Created:           time.Now().Unix(),
+		Model:             r.Model,
+		SystemFingerprint: "fp_ollama",
+		Choices: []ChunkChoice{
+			{
+				Index:        0,
+				Delta:        Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+				Logprobs:     toLogprobs(r.Logprobs),
+				FinishReason: finishReason(r),
+			},
+		},
+	}
+}
+
+func toCompletion(id string, r api.GenerateResponse) Completion {
+	return Completion{
+		Id:                id,
+		Object:            "text_completion",
+		Created:           r.CreatedAt.Unix(),
+		Model:             r.Model,
+		SystemFingerprint: "fp_ollama",
+		Choices: []CompleteChoice{{
+			Text:  r.Response,
+			Index: 0,
 			FinishReason: func(done bool) *string {
 				if done {
 					reason := "stop"
@@ -126,33 +369,102 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 	}
 }
 
-func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
-	return ChatCompletionChunk{
+func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
+	return CompletionChunk{
 		Id:                id,
-		Object:            "chat.completion.chunk",
+		Object:            "text_completion",
 		Created:           time.Now().Unix(),
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
-		Choices: []ChunkChoice{
-			{
-				Index: 0,
-				Delta: Message{Role: "assistant", Content: r.Message.Content},
-				FinishReason: func(done bool) *string {
-					if done {
-						reason := "stop"
-						return &reason
-					}
-					return nil
-				}(r.Done),
-			},
+		Choices: []CompleteChoice{{
+			Text:  r.Response,
+			Index: 0,
+			FinishReason: func(done bool) *string {
+				if done {
+					reason := "stop"
+					return &reason
+				}
+				return nil
+			}(r.Done),
+		}},
+	}
+}
+
+func toEmbeddingList(model string, r api.EmbeddingResponse) EmbeddingList {
+	data := make([]Embedding, len(r.Embeddings))
+	for i, e := range r.Embeddings {
+		data[i] = Embedding{
+			Object:    "embedding",
+			Embedding: e,
+			Index:     i,
+		}
+	}
+
+	return EmbeddingList{
+		Object: "list",
+		Data:   data,
+		Model:  model,
+		Usage: EmbeddingUsage{
+			PromptTokens: r.PromptEvalCount,
+			TotalTokens:  r.PromptEvalCount,
 		},
 	}
 }
 
-func fromRequest(r ChatCompletionRequest) api.ChatRequest {
+func toListCompletion(r api.ListResponse) ListCompletion {
+	data := []Model{}
+	for _, m := range r.Models {
+		data = append(data, Model{
+			Id:      m.Name,
+			Object:  "model",
+			Created: m.ModifiedAt.Unix(),
+			OwnedBy: ownedBy(m.Name),
+		})
+	}
+
+	return ListCompletion{
+		Object: "list",
+		Data:   data,
+	}
+}
+
+func toModel(name string, r api.ShowResponse) Model {
+	return Model{
+		Id:      name,
+		Object:  "model",
+		Created: r.ModifiedAt.Unix(),
+		OwnedBy: ownedBy(name),
+	}
+}
+
+// ownedBy reports the namespace of a model name, e.g. "library" for models
+// pulled from the default namespace
+func ownedBy(name string) string {
+	if ns := model.ParseNameFill(name, model.MaskDefault).Namespace(); ns != "" {
+		return ns
+	}
+
+	return "library"
+}
+
+func fromRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 	var messages []api.Message
 	for _, msg := range r.Messages {
-		messages = append(messages, api.Message{Role: msg.Role, Content: msg.Content})
+		message := api.Message{Role: msg.Role, Content: msg.Content}
+		for _, tc := range msg.ToolCalls {
+			var args map[string]any
+			if tc.Function.Arguments != "" {
+				if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+					return nil, fmt.Errorf("invalid arguments for tool call %q: %w", tc.Function.Name, err)
+				}
+			}
+
+			message.ToolCalls = append(message.ToolCalls, api.ToolCall{
+				Function: api.ToolCallFunction{Name: tc.Function.Name, Arguments: args},
+			})
+		}
+
+		messages = append(messages, message)
 	}
 
 	options := make(map[string]interface{})
@@ -201,27 +513,105 @@ func fromRequest(r ChatCompletionRequest) api.ChatRequest {
 		options["top_p"] = 1.0
 	}
 
-	var format string
-	if r.ResponseFormat != nil && r.ResponseFormat.Type == "json_object" {
-		format = "json"
+	format, err := fromResponseFormat(r.ResponseFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	tools, required, err := fromToolChoice(r.Tools, r.ToolChoice)
+	if err != nil {
+		return nil, err
 	}
 
-	return api.ChatRequest{
+	if required {
+		if format != "" {
+			return nil, errors.New("response_format can't be set when tool_choice requires a tool call")
+		}
+
+		format = toolCallFormat(tools)
+	}
+
+	var logprobs int
+	if r.Logprobs != nil && *r.Logprobs {
+		// the log probability of each token is only reported along
+		// with its alternatives, so always request at least one
+		logprobs = 1
+		if r.TopLogprobs != nil {
+			if *r.TopLogprobs < 0 || *r.TopLogprobs > 20 {
+				return nil, fmt.Errorf("invalid top_logprobs: %d, must be between 0 and 20", *r.TopLogprobs)
+			}
+
+			logprobs = max(*r.TopLogprobs, 1)
+		}
+	} else if r.TopLogprobs != nil {
+		return nil, errors.New("logprobs must be set to true when top_logprobs is set")
+	}
+
+	return &api.ChatRequest{
 		Model:    r.Model,
 		Messages: messages,
 		Format:   format,
 		Options:  options,
 		Stream:   &r.Stream,
+		Tools:    tools,
+		Logprobs: logprobs,
+	}, nil
+}
+
+// fromToolChoice narrows the tools offered to the model according to the
+// request's tool_choice, which is one of "none", "auto", "required" or an
+// object naming a single function. It also reports whether the model must
+// call one of the tools.
+func fromToolChoice(tools []api.Tool, choice any) (api.Tools, bool, error) {
+	switch choice := choice.(type) {
+	case nil:
+		return tools, false, nil
+	case string:
+		switch choice {
+		case "none":
+			return nil, false, nil
+		case "auto":
+			return tools, false, nil
+		case "required":
+			if len(tools) == 0 {
+				return nil, false, errors.New("tool_choice is required but no tools were provided")
+			}
+
+			return tools, true, nil
+		}
+	case map[string]any:
+		if fn, ok := choice["function"].(map[string]any); ok {
+			name, _ := fn["name"].(string)
+			for _, tool := range tools {
+				if tool.Function.Name == name {
+					return api.Tools{tool}, true, nil
+				}
+			}
+
+			return nil, false, fmt.Errorf("tool_choice function %q not found in tools", name)
+		}
 	}
+
+	return nil, false, fmt.Errorf("invalid tool_choice: %v", choice)
 }
 
-type writer struct {
-	stream bool
-	id     string
+// toolCallFormat returns a JSON schema matching a call to any of tools, which
+// constrains the model to respond with one
+func toolCallFormat(tools api.Tools) string {
+	calls := make([]string, len(tools))
+	for i, tool := range tools {
+		name, _ := json.Marshal(tool.Function.Name)
+		calls[i] = fmt.Sprintf(`{"type":"object","properties":{"name":{"const":%s},"arguments":{"type":"object"}},"required":["name","arguments"]}`, name)
+	}
+
+	return `{"anyOf":[` + strings.Join(calls, ",") + `]}`
+}
+
+type baseWriter struct {
 	gin.ResponseWriter
 }
 
-func (w *writer) writeError(code int, data []byte) (int, error) {
+func (w *baseWriter) writeError(code int, data []byte) (int, error) {
 	var serr api.StatusError
 	err := json.Unmarshal(data, &serr)
 	if err != nil {
@@ -229,7 +619,7 @@ func (w *writer) writeError(code int, data []byte) (int, error) {
 	}
 
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(http.StatusInternalServerError, serr.Error()))
+	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(code, serr.Error()))
 	if err != nil {
 		return 0, err
 	}
@@ -237,30 +627,100 @@ func (w *writer) writeError(code int, data []byte) (int, error) {
 	return len(data), nil
 }
 
-func (w *writer) writeResponse(data []byte) (int, error) {
+func (w *baseWriter) writeEvent(v any) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+	return err
+}
+
+func (w *baseWriter) writeDone() error {
+	_, err := w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
+	return err
+}
+
+func (w *baseWriter) writeJSON(v any) error {
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w.ResponseWriter).Encode(v)
+}
+
+type chatWriter struct {
+	stream      bool
+	id          string
+	topLogprobs int
+	baseWriter
+}
+
+func (w *chatWriter) writeResponse(data []byte) (int, error) {
 	var chatResponse api.ChatResponse
 	err := json.Unmarshal(data, &chatResponse)
 	if err != nil {
 		return 0, err
 	}
 
+	// at least one alternative is requested even if none were asked for
+	for i := range chatResponse.Logprobs {
+		lp := &chatResponse.Logprobs[i]
+		lp.TopLogprobs = lp.TopLogprobs[:min(len(lp.TopLogprobs), w.topLogprobs)]
+	}
+
 	// chat chunk
 	if w.stream {
-		d, err := json.Marshal(toChunk(w.id, chatResponse))
-		if err != nil {
+		if err := w.writeEvent(toChunk(w.id, chatResponse)); err != nil {
 			return 0, err
+		}
 
+		if chatResponse.Done {
+			if err := w.writeDone(); err != nil {
+				return 0, err
+			}
 		}
 
-		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
-		_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
-		if err != nil {
+		return len(data), nil
+	}
+
+	// chat completion
+	if err := w.writeJSON(toChatCompletion(w.id, chatResponse)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *chatWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
+type completeWriter struct {
+	stream bool
+	id     string
+	baseWriter
+}
+
+func (w *completeWriter) writeResponse(data []byte) (int, error) {
+	var generateResponse api.GenerateResponse
+	err := json.Unmarshal(data, &generateResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	// completion chunk
+	if w.stream {
+		if err := w.writeEvent(toCompleteChunk(w.id, generateResponse)); err != nil {
 			return 0, err
 		}
 
-		if chatResponse.Done {
-			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
-			if err != nil {
+		if generateResponse.Done {
+			if err := w.writeDone(); err != nil {
 				return 0, err
 			}
 		}
@@ -268,17 +728,15 @@ func (w *writer) writeResponse(data []byte) (int, error) {
 		return len(data), nil
 	}
 
-	// chat completion
-	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(toChatCompletion(w.id, chatResponse))
-	if err != nil {
+	// completion
+	if err := w.writeJSON(toCompletion(w.id, generateResponse)); err != nil {
 		return 0, err
 	}
 
 	return len(data), nil
 }
 
-func (w *writer) Write(data []byte) (int, error) {
+func (w *completeWriter) Write(data []byte) (int, error) {
 	code := w.ResponseWriter.Status()
 	if code != http.StatusOK {
 		return w.writeError(code, data)
@@ -287,7 +745,98 @@ func (w *writer) Write(data []byte) (int, error) {
 	return w.writeResponse(data)
 }
 
+type embedWriter struct {
+	model string
+	baseWriter
+}
+
+func (w *embedWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	var embeddingResponse api.EmbeddingResponse
+	if err := json.Unmarshal(data, &embeddingResponse); err != nil {
+		return 0, err
+	}
+
+	if err := w.writeJSON(toEmbeddingList(w.model, embeddingResponse)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+type listWriter struct {
+	baseWriter
+}
+
+func (w *listWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	var listResponse api.ListResponse
+	if err := json.Unmarshal(data, &listResponse); err != nil {
+		return 0, err
+	}
+
+	if err := w.writeJSON(toListCompletion(listResponse)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+type retrieveWriter struct {
+	model string
+	baseWriter
+}
+
+func (w *retrieveWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	var showResponse api.ShowResponse
+	if err := json.Unmarshal(data, &showResponse); err != nil {
+		return 0, err
+	}
+
+	if err := w.writeJSON(toModel(w.model, showResponse)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// setRequest replaces the request body with the JSON encoding of req so it
+// can be handled by the native API handler.
+func setRequest(c *gin.Context, req any) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(req); err != nil {
+		return err
+	}
+
+	c.Request.Body = io.NopCloser(&b)
+	// the writers translate the native handlers' newline delimited JSON,
+	// whatever the client accepts
+	c.Request.Header.Set("Accept", "application/x-ndjson")
+	return nil
+}
+
+// Middleware translates /v1/chat/completions requests for the chat handler.
+//
+// Deprecated: Use ChatMiddleware.
 func Middleware() gin.HandlerFunc {
+	return ChatMiddleware()
+}
+
+// ChatMiddleware translates /v1/chat/completions requests for the chat handler
+func ChatMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req ChatCompletionRequest
 		err := c.ShouldBindJSON(&req)
@@ -301,22 +850,217 @@ func Middleware() gin.HandlerFunc {
 			return
 		}
 
-		var b bytes.Buffer
-		if err := json.NewEncoder(&b).Encode(fromRequest(req)); err != nil {
+		chatReq, err := fromRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if err := setRequest(c, chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		var topLogprobs int
+		if req.TopLogprobs != nil {
+			topLogprobs = *req.TopLogprobs
+		}
+
+		c.Writer = &chatWriter{
+			baseWriter:  baseWriter{ResponseWriter: c.Writer},
+			stream:      req.Stream,
+			id:          fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+			topLogprobs: topLogprobs,
+		}
+
+		c.Next()
+	}
+}
+
+// CompletionsMiddleware translates legacy /v1/completions requests for the
+// generate handler
+func CompletionsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CompletionRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if err := setRequest(c, fromCompleteRequest(req)); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Writer = &completeWriter{
+			baseWriter: baseWriter{ResponseWriter: c.Writer},
+			stream:     req.Stream,
+			id:         fmt.Sprintf("cmpl-%d", rand.Intn(999)),
+		}
+
+		c.Next()
+	}
+}
+
+// EmbeddingsMiddleware translates /v1/embeddings requests for the embeddings
+// handler
+func EmbeddingsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req EmbedRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		embedReq, err := fromEmbedRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if err := setRequest(c, embedReq); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
 			return
 		}
 
-		c.Request.Body = io.NopCloser(&b)
+		c.Writer = &embedWriter{
+			baseWriter: baseWriter{ResponseWriter: c.Writer},
+			model:      req.Model,
+		}
+
+		c.Next()
+	}
+}
+
+// ListMiddleware translates the model list for /v1/models
+func ListMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = &listWriter{
+			baseWriter: baseWriter{ResponseWriter: c.Writer},
+		}
+
+		c.Next()
+	}
+}
 
-		w := &writer{
-			ResponseWriter: c.Writer,
-			stream:         req.Stream,
-			id:             fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+// RetrieveMiddleware translates /v1/models/:model requests for the show
+// handler
+func RetrieveMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		model := strings.TrimPrefix(c.Param("model"), "/")
+		if err := setRequest(c, api.ShowRequest{Model: model}); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
 		}
 
-		c.Writer = w
+		c.Writer = &retrieveWriter{
+			baseWriter: baseWriter{ResponseWriter: c.Writer},
+			model:      model,
+		}
 
 		c.Next()
 	}
 }
+
+func fromResponseFormat(r *ResponseFormat) (string, error) {
+	if r == nil {
+		return "", nil
+	}
+
+	switch r.Type {
+	case "", "text":
+		return "", nil
+	case "json_object":
+		return "json", nil
+	case "json_schema":
+		if r.JsonSchema == nil || len(r.JsonSchema.Schema) == 0 {
+			return "", fmt.Errorf("response_format json_schema requires a schema")
+		}
+
+		return string(r.JsonSchema.Schema), nil
+	default:
+		return "", fmt.Errorf("invalid response_format type: %s", r.Type)
+	}
+}
+
+func fromCompleteRequest(r CompletionRequest) api.GenerateRequest {
+	options := make(map[string]interface{})
+
+	switch stop := r.Stop.(type) {
+	case string:
+		options["stop"] = []string{stop}
+	case []interface{}:
+		var stops []string
+		for _, s := range stop {
+			if str, ok := s.(string); ok {
+				stops = append(stops, str)
+			}
+		}
+		options["stop"] = stops
+	}
+
+	if r.MaxTokens != nil {
+		options["num_predict"] = *r.MaxTokens
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature * 2.0
+	} else {
+		options["temperature"] = 1.0
+	}
+
+	if r.Seed != nil {
+		options["seed"] = *r.Seed
+
+		// temperature=0 is required for reproducible outputs
+		options["temperature"] = 0.0
+	}
+
+	if r.FrequencyPenalty != nil {
+		options["frequency_penalty"] = *r.FrequencyPenalty * 2.0
+	}
+
+	if r.PresencePenalty != nil {
+		options["presence_penalty"] = *r.PresencePenalty * 2.0
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	} else {
+		options["top_p"] = 1.0
+	}
+
+	return api.GenerateRequest{
+		Model:   r.Model,
+		Prompt:  r.Prompt,
+		Options: options,
+		Stream:  &r.Stream,
+	}
+}
+
+func fromEmbedRequest(r EmbedRequest) (api.EmbeddingRequest, error) {
+	var input []string
+	switch in := r.Input.(type) {
+	case string:
+		input = []string{in}
+	case []any:
+		for _, v := range in {
+			s, ok := v.(string)
+			if !ok {
+				return api.EmbeddingRequest{}, fmt.Errorf("input must be a string or an array of strings")
+			}
+			input = append(input, s)
+		}
+	default:
+		return api.EmbeddingRequest{}, fmt.Errorf("input must be a string or an array of strings")
+	}
+
+	if len(input) == 0 {
+		return api.EmbeddingRequest{}, fmt.Errorf("invalid input")
+	}
+
+	// embeddings returned by OpenAI are normalized to unit length
+	return api.EmbeddingRequest{Model: r.Model, Input: input, Normalize: true}, nil
+}
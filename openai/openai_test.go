@@ -0,0 +1,365 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestFromRequestTools(t *testing.T) {
+	weather := api.Tool{Type: "function", Function: api.ToolFunction{Name: "get_weather"}}
+	clock := api.Tool{Type: "function", Function: api.ToolFunction{Name: "get_time"}}
+	tools := `"tools": [{"type": "function", "function": {"name": "get_weather"}}, {"type": "function", "function": {"name": "get_time"}}]`
+
+	cases := []struct {
+		name   string
+		body   string
+		tools  api.Tools
+		format string
+		err    string
+	}{
+		{
+			name:  "default",
+			body:  tools,
+			tools: api.Tools{weather, clock},
+		},
+		{
+			name: "none",
+			body: tools + `, "tool_choice": "none"`,
+		},
+		{
+			name:  "auto",
+			body:  tools + `, "tool_choice": "auto"`,
+			tools: api.Tools{weather, clock},
+		},
+		{
+			name:   "required",
+			body:   tools + `, "tool_choice": "required"`,
+			tools:  api.Tools{weather, clock},
+			format: `{"anyOf":[{"type":"object","properties":{"name":{"const":"get_weather"},"arguments":{"type":"object"}},"required":["name","arguments"]},{"type":"object","properties":{"name":{"const":"get_time"},"arguments":{"type":"object"}},"required":["name","arguments"]}]}`,
+		},
+		{
+			name:   "function",
+			body:   tools + `, "tool_choice": {"type": "function", "function": {"name": "get_time"}}`,
+			tools:  api.Tools{clock},
+			format: `{"anyOf":[{"type":"object","properties":{"name":{"const":"get_time"},"arguments":{"type":"object"}},"required":["name","arguments"]}]}`,
+		},
+		{
+			name: "unknown function",
+			body: tools + `, "tool_choice": {"type": "function", "function": {"name": "get_stock_price"}}`,
+			err:  `tool_choice function "get_stock_price" not found in tools`,
+		},
+		{
+			name: "required without tools",
+			body: `"tool_choice": "required"`,
+			err:  "tool_choice is required but no tools were provided",
+		},
+		{
+			name: "required with response format",
+			body: tools + `, "tool_choice": "required", "response_format": {"type": "json_object"}`,
+			err:  "response_format can't be set when tool_choice requires a tool call",
+		},
+		{
+			name: "invalid",
+			body: tools + `, "tool_choice": "sometimes"`,
+			err:  "invalid tool_choice: sometimes",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var r ChatCompletionRequest
+			require.NoError(t, json.Unmarshal([]byte(`{"model": "test", "messages": [{"role": "user", "content": "hi"}], `+tt.body+`}`), &r))
+
+			req, err := fromRequest(r)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.tools, req.Tools)
+			assert.Equal(t, tt.format, string(req.Format))
+		})
+	}
+}
+
+func TestFromRequestToolCallMessages(t *testing.T) {
+	var r ChatCompletionRequest
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "test",
+		"messages": [
+			{"role": "user", "content": "What's the weather in Paris?"},
+			{"role": "assistant", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\": \"Paris\"}"}}]},
+			{"role": "tool", "content": "sunny"}
+		]
+	}`), &r))
+
+	req, err := fromRequest(r)
+	require.NoError(t, err)
+	require.Len(t, req.Messages, 3)
+	assert.Equal(t, []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: map[string]any{"city": "Paris"}}}}, req.Messages[1].ToolCalls)
+	assert.Equal(t, api.Message{Role: "tool", Content: "sunny"}, req.Messages[2])
+
+	r.Messages[1].ToolCalls[0].Function.Arguments = "not json"
+	_, err = fromRequest(r)
+	require.ErrorContains(t, err, `invalid arguments for tool call "get_weather"`)
+}
+
+func TestToChatCompletionToolCalls(t *testing.T) {
+	r := api.ChatResponse{
+		Model:     "test",
+		CreatedAt: time.Now(),
+		Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+			{Function: api.ToolCallFunction{Name: "get_weather", Arguments: map[string]any{"city": "Paris"}}},
+			{Function: api.ToolCallFunction{Name: "get_time", Arguments: map[string]any{}}},
+		}},
+		Done: true,
+	}
+
+	cases := []struct {
+		name      string
+		streaming bool
+	}{
+		{name: "completion"},
+		{name: "chunk", streaming: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var message Message
+			var reason *string
+			if tt.streaming {
+				chunk := toChunk("chatcmpl-1", r)
+				require.Len(t, chunk.Choices, 1)
+				message, reason = chunk.Choices[0].Delta, chunk.Choices[0].FinishReason
+			} else {
+				completion := toChatCompletion("chatcmpl-1", r)
+				require.Len(t, completion.Choices, 1)
+				message, reason = completion.Choices[0].Message, completion.Choices[0].FinishReason
+			}
+
+			require.NotNil(t, reason)
+			assert.Equal(t, "tool_calls", *reason)
+			assert.Equal(t, "assistant", message.Role)
+			assert.Empty(t, message.Content)
+			require.Len(t, message.ToolCalls, 2)
+
+			for i, call := range message.ToolCalls {
+				assert.Regexp(t, `^call_[a-z0-9]{8}$`, call.ID)
+				assert.Equal(t, "function", call.Type)
+				assert.Equal(t, r.Message.ToolCalls[i].Function.Name, call.Function.Name)
+
+				var args map[string]any
+				require.NoError(t, json.Unmarshal([]byte(call.Function.Arguments), &args))
+				assert.Equal(t, r.Message.ToolCalls[i].Function.Arguments, args)
+
+				// chunks number their tool calls so clients can reassemble them
+				if tt.streaming {
+					require.NotNil(t, call.Index)
+					assert.Equal(t, i, *call.Index)
+				} else {
+					assert.Nil(t, call.Index)
+				}
+			}
+		})
+	}
+
+	t.Run("content", func(t *testing.T) {
+		chunk := toChunk("chatcmpl-1", api.ChatResponse{Message: api.Message{Role: "assistant", Content: "Hello"}})
+		assert.Nil(t, chunk.Choices[0].FinishReason)
+		assert.Empty(t, chunk.Choices[0].Delta.ToolCalls)
+
+		bts, err := json.Marshal(chunk.Choices[0].Delta)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"role": "assistant", "content": "Hello"}`, string(bts))
+	})
+}
+
+// serve sends body to middleware, followed by handler standing in for the
+// native handler
+func serve(t *testing.T, middleware gin.HandlerFunc, handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/", middleware, handler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return w
+}
+
+func TestCompletionsMiddleware(t *testing.T) {
+	t.Run("completion", func(t *testing.T) {
+		var req api.GenerateRequest
+		w := serve(t, CompletionsMiddleware(), func(c *gin.Context) {
+			require.NoError(t, c.ShouldBindJSON(&req))
+			c.JSON(http.StatusOK, api.GenerateResponse{
+				Model:    "test",
+				Response: "Hello!",
+				Done:     true,
+				Metrics:  api.Metrics{PromptEvalCount: 5, EvalCount: 2},
+			})
+		}, `{"model": "test", "prompt": "Say hello", "max_tokens": 10, "stop": ["\n", "."], "temperature": 0.4, "seed": 42}`)
+
+		assert.Equal(t, "test", req.Model)
+		assert.Equal(t, "Say hello", req.Prompt)
+		require.NotNil(t, req.Stream)
+		assert.False(t, *req.Stream)
+		assert.Equal(t, map[string]any{
+			"num_predict": float64(10),
+			"stop":        []any{"\n", "."},
+			"seed":        float64(42),
+			"temperature": float64(0),
+			"top_p":       float64(1),
+		}, req.Options)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var completion Completion
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&completion))
+		assert.Regexp(t, `^cmpl-\d+$`, completion.Id)
+		assert.Equal(t, "text_completion", completion.Object)
+		assert.Equal(t, "test", completion.Model)
+		require.Len(t, completion.Choices, 1)
+		assert.Equal(t, "Hello!", completion.Choices[0].Text)
+		require.NotNil(t, completion.Choices[0].FinishReason)
+		assert.Equal(t, "stop", *completion.Choices[0].FinishReason)
+		assert.Equal(t, Usage{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7}, completion.Usage)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		w := serve(t, CompletionsMiddleware(), func(c *gin.Context) {
+			for _, resp := range []api.GenerateResponse{
+				{Model: "test", Response: "Hello"},
+				{Model: "test", Response: "!", Done: true},
+			} {
+				bts, err := json.Marshal(resp)
+				require.NoError(t, err)
+				_, err = c.Writer.Write(append(bts, '\n'))
+				require.NoError(t, err)
+			}
+		}, `{"model": "test", "prompt": "Say hello", "stream": true}`)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+		events := strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n")
+		require.Len(t, events, 3)
+		for i, text := range []string{"Hello", "!"} {
+			var chunk CompletionChunk
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(events[i], "data: ")), &chunk))
+			require.Len(t, chunk.Choices, 1)
+			assert.Equal(t, text, chunk.Choices[0].Text)
+			assert.Equal(t, i == 1, chunk.Choices[0].FinishReason != nil)
+		}
+		assert.Equal(t, "data: [DONE]", events[2])
+	})
+
+	t.Run("error", func(t *testing.T) {
+		w := serve(t, CompletionsMiddleware(), func(c *gin.Context) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'test' not found"})
+		}, `{"model": "test", "prompt": "Say hello"}`)
+
+		require.Equal(t, http.StatusNotFound, w.Code)
+		var resp ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "model 'test' not found", resp.Error.Message)
+		assert.Equal(t, "not_found_error", resp.Error.Type)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := serve(t, CompletionsMiddleware(), func(c *gin.Context) {
+			t.Fatal("handler called for an invalid request")
+		}, `{"model": "test", "prompt": ["Say hello"]}`)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestEmbeddingsMiddleware(t *testing.T) {
+	cases := []struct {
+		name  string
+		body  string
+		input []string
+		err   string
+	}{
+		{name: "string", body: `{"model": "test", "input": "hello"}`, input: []string{"hello"}},
+		{name: "array", body: `{"model": "test", "input": ["hello", "world"]}`, input: []string{"hello", "world"}},
+		{name: "empty", body: `{"model": "test", "input": []}`, err: "invalid input"},
+		{name: "tokens", body: `{"model": "test", "input": [1, 2, 3]}`, err: "input must be a string or an array of strings"},
+		{name: "missing", body: `{"model": "test"}`, err: "input must be a string or an array of strings"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var req api.EmbeddingRequest
+			w := serve(t, EmbeddingsMiddleware(), func(c *gin.Context) {
+				require.NoError(t, c.ShouldBindJSON(&req))
+
+				embeddings := make([][]float64, len(req.Input))
+				for i := range embeddings {
+					embeddings[i] = []float64{float64(i), 1}
+				}
+
+				c.JSON(http.StatusOK, api.EmbeddingResponse{Embeddings: embeddings, PromptEvalCount: 4})
+			}, tt.body)
+
+			if tt.err != "" {
+				require.Equal(t, http.StatusBadRequest, w.Code)
+				var resp ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, tt.err, resp.Error.Message)
+				return
+			}
+
+			assert.Equal(t, api.EmbeddingRequest{Model: "test", Input: tt.input, Normalize: true}, req)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			var list EmbeddingList
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+			assert.Equal(t, "list", list.Object)
+			assert.Equal(t, "test", list.Model)
+			assert.Equal(t, EmbeddingUsage{PromptTokens: 4, TotalTokens: 4}, list.Usage)
+			require.Len(t, list.Data, len(tt.input))
+			for i, e := range list.Data {
+				assert.Equal(t, Embedding{Object: "embedding", Embedding: []float64{float64(i), 1}, Index: i}, e)
+			}
+		})
+	}
+}
+
+func TestListMiddleware(t *testing.T) {
+	cases := map[string]struct {
+		models []api.ModelResponse
+		expect string
+	}{
+		"models": {
+			models: []api.ModelResponse{{Name: "test-model", ModifiedAt: time.Unix(1686935002, 0).UTC()}},
+			expect: `{"object": "list", "data": [{"id": "test-model", "object": "model", "created": 1686935002, "owned_by": "library"}]}`,
+		},
+		"empty": {
+			expect: `{"object": "list", "data": []}`,
+		},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := serve(t, ListMiddleware(), func(c *gin.Context) {
+				c.JSON(http.StatusOK, api.ListResponse{Models: tt.models})
+			}, "")
+
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, tt.expect, w.Body.String())
+		})
+	}
+}
@@ -63,8 +63,8 @@ func Parse(reader io.Reader) ([]Command, error) {
 			if len(fields) < 2 {
 				return nil, fmt.Errorf("should be in the format <role> <message>")
 			}
-			if !slices.Contains([]string{"system", "user", "assistant"}, string(bytes.ToLower(fields[0]))) {
-				return nil, fmt.Errorf("role must be one of \"system\", \"user\", or \"assistant\"")
+			if !slices.Contains([]string{"system", "user", "assistant", "tool"}, string(bytes.ToLower(fields[0]))) {
+				return nil, fmt.Errorf("role must be one of \"system\", \"user\", \"assistant\", or \"tool\"")
 			}
 			command.Args = fmt.Sprintf("%s: %s", string(bytes.ToLower(fields[0])), string(fields[1]))
 		default:
@@ -69,6 +69,7 @@ FROM foo
 MESSAGE system You are a Parser. Always Parse things.
 MESSAGE user Hey there!
 MESSAGE assistant Hello, I want to parse all the things!
+MESSAGE tool 42 things parsed
 `
 
 	reader := strings.NewReader(input)
@@ -80,6 +81,7 @@ MESSAGE assistant Hello, I want to parse all the things!
 		{Name: "message", Args: "system: You are a Parser. Always Parse things."},
 		{Name: "message", Args: "user: Hey there!"},
 		{Name: "message", Args: "assistant: Hello, I want to parse all the things!"},
+		{Name: "message", Args: "tool: 42 things parsed"},
 	}
 
 	assert.Equal(t, expectedCommands, commands)
@@ -94,5 +96,5 @@ MESSAGE badguy I'm a bad guy!
 
 	reader := strings.NewReader(input)
 	_, err := Parse(reader)
-	assert.ErrorContains(t, err, "role must be one of \"system\", \"user\", or \"assistant\"")
+	assert.ErrorContains(t, err, "role must be one of \"system\", \"user\", \"assistant\", or \"tool\"")
 }
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/anthropic"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/openai"
+)
+
+// operation is an action an API key may be allowed to perform
+type operation string
+
+const (
+	opInference operation = "inference"
+	opCreate    operation = "create"
+	opPull      operation = "pull"
+	opPush      operation = "push"
+	opDelete    operation = "delete"
+	opAdmin     operation = "admin"
+
+	// opRead lists and shows models, which any key may do for the models it
+	// is allowed to use
+	opRead operation = "read"
+)
+
+const apiKeyContextKey = "apiKey"
+
+// apiKey is a bearer token that grants access to a set of models and operations
+type apiKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+
+	// Models lists glob patterns matching the model names the key may use.
+	// A pattern without a tag matches every tag of a model and "*" matches
+	// every model.
+	Models     []string    `json:"models"`
+	Operations []operation `json:"operations"`
+
+	// Limits replace the server's default rate limits for the key if set
+	Limits *rateLimits `json:"limits,omitempty"`
+}
+
+type apiKeys struct {
+	Keys []apiKey `json:"keys"`
+}
+
+// loadAPIKeys reads API keys from a JSON file
+func loadAPIKeys(name string) (*apiKeys, error) {
+	bts, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys apiKeys
+	if err := json.Unmarshal(bts, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys defined", name)
+	}
+
+	seen := make(map[string]bool)
+	for i, k := range keys.Keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("%s: key %d has no value", name, i)
+		}
+
+		if seen[k.Key] {
+			return nil, fmt.Errorf("%s: key %d is a duplicate", name, i)
+		}
+		seen[k.Key] = true
+
+		for _, op := range k.Operations {
+			switch op {
+			case opInference, opCreate, opPull, opPush, opDelete, opAdmin, "*":
+			default:
+				return nil, fmt.Errorf("%s: key %d has unknown operation %q", name, i, op)
+			}
+		}
+
+		if l := k.Limits; l != nil && (l.RequestsPerMinute < 0 || l.ConcurrentStreams < 0 || l.TokensPerDay < 0) {
+			return nil, fmt.Errorf("%s: key %d has a negative limit", name, i)
+		}
+
+		for _, pattern := range k.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: key %d has invalid model pattern %q: %w", name, i, pattern, err)
+			}
+		}
+	}
+
+	return &keys, nil
+}
+
+// lookup returns the key matching token, or nil if there isn't one
+func (keys *apiKeys) lookup(token string) *apiKey {
+	var found *apiKey
+	// compare against every key so the time taken doesn't reveal which keys exist
+	for i := range keys.Keys {
+		if subtle.ConstantTimeCompare([]byte(keys.Keys[i].Key), []byte(token)) == 1 {
+			found = &keys.Keys[i]
+		}
+	}
+
+	return found
+}
+
+func (k *apiKey) allows(op operation) bool {
+	return op == opRead || slices.Contains(k.Operations, op) || slices.Contains(k.Operations, "*")
+}
+
+func (k *apiKey) allowsModel(name string) bool {
+	name = ParseModelPath(name).GetShortTagname()
+	return slices.ContainsFunc(k.Models, func(pattern string) bool {
+		return modelMatches(pattern, name)
+	})
+}
+
+// modelMatches reports whether the short name of a model, such as
+// llama3:latest, matches pattern. Patterns may use * as a wildcard, and
+// patterns without a tag match any tag.
+func modelMatches(pattern, name string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if !strings.Contains(pattern[strings.LastIndex(pattern, "/")+1:], ":") {
+		pattern += ":*"
+	}
+
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// requestAPIKey returns the API key used to authenticate a request, or nil
+// if authentication is disabled
+func requestAPIKey(c *gin.Context) *apiKey {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		return v.(*apiKey)
+	}
+
+	return nil
+}
+
+// authMiddleware requires requests to have one of the server's API keys as a
+// bearer token. It does nothing if no API keys are configured.
+func (s *Server) authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.apiKeys == nil {
+			c.Next()
+			return
+		}
+
+		switch c.FullPath() {
+		case "/", "/api/version":
+			// let clients check the server is running
+			c.Next()
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			// Anthropic's clients send their key in X-Api-Key
+			token = c.GetHeader("X-Api-Key")
+		}
+
+		if token == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="ollama"`)
+			abortWithAuthError(c, http.StatusUnauthorized, "missing API key")
+			return
+		}
+
+		key := s.apiKeys.lookup(token)
+		if key == nil {
+			c.Header("WWW-Authenticate", `Bearer realm="ollama", error="invalid_token"`)
+			abortWithAuthError(c, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// abortWithAuthError aborts a request whose API key isn't accepted, with an
+// error in the shape clients of the OpenAI and Anthropic compatible
+// endpoints expect
+func abortWithAuthError(c *gin.Context, code int, message string) {
+	switch path := c.FullPath(); {
+	case path == "/v1/messages":
+		c.AbortWithStatusJSON(code, anthropic.NewError(code, message))
+	case strings.HasPrefix(path, "/v1/"):
+		c.AbortWithStatusJSON(code, openai.NewError(code, message))
+	default:
+		c.AbortWithStatusJSON(code, gin.H{"error": message})
+	}
+}
+
+// authorize checks that the request's API key allows op on the models named
+// in the request
+func authorize(op operation) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := requestAPIKey(c)
+		if key == nil {
+			c.Next()
+			return
+		}
+
+		if !key.allows(op) {
+			msg := fmt.Sprintf("API key is not allowed to %s models", op)
+			if op == opAdmin {
+				msg = "API key is not allowed to administer the server"
+			}
+
+			abortWithAuthError(c, http.StatusForbidden, msg)
+			return
+		}
+
+		names, err := requestModelNames(c)
+		if err != nil {
+			abortWithAuthError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		for _, name := range names {
+			if !key.allowsModel(name) {
+				abortWithAuthError(c, http.StatusForbidden, fmt.Sprintf("API key is not allowed to use model '%s'", name))
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// maxModelNamesPrefix is how much of a request body is decoded to find the
+// model names in it. Larger bodies, such as chats with their model after
+// long messages, are decoded in full, as their handlers do anyway.
+const maxModelNamesPrefix = 8 * format.KibiByte
+
+// requestModelNames returns the model names in a request's path or body,
+// leaving the body to be read again by the handler
+func requestModelNames(c *gin.Context) ([]string, error) {
+	var names []string
+	if name := strings.TrimPrefix(c.Param("model"), "/"); name != "" {
+		names = append(names, name)
+	}
+
+	// blobs are model layers of up to many gigabytes rather than JSON, and
+	// don't name a model
+	if c.Request.Body == nil || c.Param("digest") != "" {
+		return names, nil
+	}
+
+	var req struct {
+		Model       string `json:"model"`
+		Name        string `json:"name"`
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
+	}
+
+	// put what's read back in front of the rest of the body for the handler
+	var consumed bytes.Buffer
+	body := c.Request.Body
+	c.Request.Body = readCloser{io.MultiReader(&consumed, body), body}
+
+	err := json.NewDecoder(io.TeeReader(io.LimitReader(body, maxModelNamesPrefix), &consumed)).Decode(&req)
+	if errors.Is(err, io.ErrUnexpectedEOF) && consumed.Len() == maxModelNamesPrefix {
+		if _, err := consumed.ReadFrom(body); err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(consumed.Bytes(), &req)
+	}
+
+	// malformed requests are rejected by the handler
+	if err != nil && !errors.As(err, new(*json.UnmarshalTypeError)) {
+		return names, nil
+	}
+
+	for _, name := range []string{req.Model, req.Name, req.Source, req.Destination} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// readCloser reads from Reader and closes Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
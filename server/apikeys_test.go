@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/parser"
+)
+
+func TestLoadAPIKeys(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"valid", `{"keys": [{"name": "ci", "key": "a", "models": ["llama3"], "operations": ["inference", "pull"]}]}`, ""},
+		{"all operations", `{"keys": [{"key": "a", "models": ["*"], "operations": ["*"]}]}`, ""},
+		{"no keys", `{"keys": []}`, "no keys defined"},
+		{"empty key", `{"keys": [{"key": ""}]}`, "key 0 has no value"},
+		{"duplicate", `{"keys": [{"key": "a"}, {"key": "a"}]}`, "key 1 is a duplicate"},
+		{"unknown operation", `{"keys": [{"key": "a", "operations": ["manage"]}]}`, `unknown operation "manage"`},
+		{"invalid pattern", `{"keys": [{"key": "a", "models": ["llama["]}]}`, "invalid model pattern"},
+		{"malformed", `{"keys": `, "unexpected end of JSON input"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "keys.json")
+			require.NoError(t, os.WriteFile(name, []byte(tt.content), 0o600))
+
+			keys, err := loadAPIKeys(name)
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotEmpty(t, keys.Keys)
+		})
+	}
+}
+
+func TestAPIKeyAllowsModel(t *testing.T) {
+	key := apiKey{Models: []string{"llama3", "mistral:7b", "myuser/*", "registry.example.com/team/*"}}
+
+	cases := map[string]bool{
+		"llama3":                              true,
+		"llama3:latest":                       true,
+		"llama3:70b":                          true,
+		"library/llama3:8b":                   true,
+		"llama3.1":                            false,
+		"mistral":                             false,
+		"mistral:7b":                          true,
+		"myuser/model":                        true,
+		"myuser/model:q4_0":                   true,
+		"otheruser/model":                     false,
+		"registry.example.com/team/model:v1":  true,
+		"registry.example.com/other/model:v1": false,
+	}
+
+	for name, expect := range cases {
+		assert.Equal(t, expect, key.allowsModel(name), name)
+	}
+
+	all := apiKey{Models: []string{"*"}}
+	assert.True(t, all.allowsModel("anything/at:all"))
+
+	none := apiKey{}
+	assert.False(t, none.allowsModel("llama3"))
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	setenv(t, "OLLAMA_MODELS", t.TempDir())
+
+	s := &Server{
+		apiKeys: &apiKeys{Keys: []apiKey{
+			{Name: "reader", Key: "reader-key", Models: []string{"llama3"}, Operations: []operation{opInference}},
+			{Name: "creator", Key: "creator-key", Models: []string{"llama3"}, Operations: []operation{opCreate}},
+			{Name: "admin", Key: "admin-key", Models: []string{"*"}, Operations: []operation{"*"}},
+		}},
+		sched: InitScheduler(context.Background()),
+	}
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   string
+		status int
+		err    string
+	}{
+		{"version is public", http.MethodGet, "/api/version", "", "", http.StatusOK, ""},
+		{"missing key", http.MethodGet, "/api/tags", "", "", http.StatusUnauthorized, "missing API key"},
+		{"invalid key", http.MethodGet, "/api/tags", "wrong", "", http.StatusUnauthorized, "invalid API key"},
+		{"valid key", http.MethodGet, "/api/tags", "reader-key", "", http.StatusOK, ""},
+		{"operation not allowed", http.MethodDelete, "/api/delete", "reader-key", `{"name": "llama3"}`, http.StatusForbidden, "not allowed to delete models"},
+		{"model not allowed", http.MethodPost, "/api/generate", "reader-key", `{"model": "mistral"}`, http.StatusForbidden, "not allowed to use model 'mistral'"},
+		{"create from model not allowed", http.MethodPost, "/api/create", "creator-key", `{"name": "llama3:copy", "modelfile": "FROM mistral"}`, http.StatusForbidden, "not allowed to use model 'mistral'"},
+		{"copy destination not allowed", http.MethodPost, "/api/copy", "creator-key", `{"source": "llama3", "destination": "mistral"}`, http.StatusForbidden, "not allowed to use model 'mistral'"},
+		{"config requires admin", http.MethodGet, "/api/config", "creator-key", "", http.StatusForbidden, "not allowed to administer the server"},
+		{"admin config", http.MethodGet, "/api/config", "admin-key", "", http.StatusOK, ""},
+		{"metrics requires admin", http.MethodGet, "/metrics", "reader-key", "", http.StatusForbidden, "not allowed to administer the server"},
+		{"admin metrics", http.MethodGet, "/metrics", "admin-key", "", http.StatusOK, ""},
+		{"admin allowed", http.MethodDelete, "/api/delete", "admin-key", `{"name": "llama3"}`, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			require.NoError(t, err)
+
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.status, resp.StatusCode)
+
+			if tt.status == http.StatusUnauthorized {
+				require.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+			}
+
+			if tt.err != "" {
+				var body struct {
+					Error string `json:"error"`
+				}
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+				require.Contains(t, body.Error, tt.err)
+			}
+		})
+	}
+
+	t.Run("x-api-key", func(t *testing.T) {
+		for key, status := range map[string]int{"reader-key": http.StatusOK, "wrong": http.StatusUnauthorized} {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/tags", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Api-Key", key)
+
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, status, resp.StatusCode)
+		}
+	})
+
+	t.Run("error shapes", func(t *testing.T) {
+		cases := []struct {
+			method string
+			path   string
+			key    string
+			body   string
+			status int
+			expect string
+		}{
+			{http.MethodPost, "/v1/chat/completions", "", `{"model": "llama3"}`, http.StatusUnauthorized, `{"error": {"message": "missing API key", "type": "authentication_error", "param": null, "code": null}}`},
+			{http.MethodPost, "/v1/chat/completions", "reader-key", `{"model": "mistral"}`, http.StatusForbidden, `{"error": {"message": "API key is not allowed to use model 'mistral'", "type": "permission_error", "param": null, "code": null}}`},
+			{http.MethodGet, "/v1/models/mistral", "reader-key", "", http.StatusForbidden, `{"error": {"message": "API key is not allowed to use model 'mistral'", "type": "permission_error", "param": null, "code": null}}`},
+			{http.MethodPost, "/v1/messages", "wrong", `{"model": "llama3"}`, http.StatusUnauthorized, `{"type": "error", "error": {"type": "authentication_error", "message": "invalid API key"}}`},
+			{http.MethodPost, "/v1/messages", "reader-key", `{"model": "mistral"}`, http.StatusForbidden, `{"type": "error", "error": {"type": "permission_error", "message": "API key is not allowed to use model 'mistral'"}}`},
+		}
+
+		for _, tt := range cases {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.status, resp.StatusCode, tt.path)
+
+			bts, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.expect, string(bts), tt.path)
+		}
+	})
+}
+
+func TestAPIKeyListings(t *testing.T) {
+	setenv(t, "OLLAMA_MODELS", t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := &Server{
+		apiKeys: &apiKeys{Keys: []apiKey{
+			{Name: "reader", Key: "reader-key", Models: []string{"llama3"}, Operations: []operation{opInference}},
+		}},
+		sched: InitScheduler(ctx),
+	}
+
+	for _, name := range []string{"llama3", "mistral"} {
+		scenario := newScenario(t, ctx, name, 0)
+
+		commands, err := parser.Parse(strings.NewReader("FROM " + scenario.req.model.ModelPath))
+		require.NoError(t, err)
+		require.NoError(t, CreateModel(ctx, name, "", "", commands, func(api.ProgressResponse) {}))
+
+		model := &Model{ShortName: name + ":latest"}
+		s.sched.loaded[name] = &runnerRef{modelInfo: model, model: name}
+		require.NoError(t, s.sched.pending.push(&LlmRequest{ctx: ctx, model: model, errCh: make(chan error, 1)}, 0))
+	}
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	get := func(path string, v any) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer reader-key")
+
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+
+	var tags api.ListResponse
+	get("/api/tags", &tags)
+	require.Len(t, tags.Models, 1)
+	assert.Equal(t, "llama3:latest", tags.Models[0].Name)
+
+	var models openai.ListCompletion
+	get("/v1/models", &models)
+	require.Len(t, models.Data, 1)
+	assert.Equal(t, "llama3:latest", models.Data[0].Id)
+
+	var ps api.ProcessResponse
+	get("/api/ps", &ps)
+	require.Len(t, ps.Models, 1)
+	assert.Equal(t, "llama3:latest", ps.Models[0].Name)
+	require.Len(t, ps.Queue, 1)
+	assert.Equal(t, "llama3:latest", ps.Queue[0].Model)
+}
+
+// unreadable is a request body that fails the test if it's read
+type unreadable struct{ t *testing.T }
+
+func (r unreadable) Read([]byte) (int, error) {
+	r.t.Error("request body was read")
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestRequestModelNames(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newContext := func(body io.Reader) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", body)
+		return c
+	}
+
+	t.Run("blob", func(t *testing.T) {
+		c := newContext(unreadable{t})
+		c.Params = gin.Params{{Key: "digest", Value: "sha256:abc"}}
+
+		names, err := requestModelNames(c)
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	})
+
+	cases := map[string]string{
+		"small": `{"model": "llama3", "prompt": "hi"}`,
+		"large": `{"messages": [{"role": "user", "content": "` + strings.Repeat("a", 2*maxModelNamesPrefix) + `"}], "model": "llama3"}`,
+	}
+
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := newContext(strings.NewReader(body))
+
+			names, err := requestModelNames(c)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"llama3"}, names)
+
+			// the handler reads the whole body
+			bts, err := io.ReadAll(c.Request.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(bts))
+		})
+	}
+}
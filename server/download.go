@@ -81,6 +81,7 @@ func (p *blobDownloadPart) StopsAt() int64 {
 func (p *blobDownloadPart) Write(b []byte) (n int, err error) {
 	n = len(b)
 	p.blobDownload.Completed.Add(int64(n))
+	pullBytes.Add(float64(n))
 	p.lastUpdated = time.Now()
 	return n, nil
 }
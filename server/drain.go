@@ -0,0 +1,61 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// drainMiddleware counts requests in progress and rejects new requests with
+// 503 Service Unavailable once the server is draining
+func (s *Server) drainMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.draining.Load() {
+			c.Header("Connection", "close")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+			return
+		}
+
+		// chat sockets stay open between turns, so only their turns are counted
+		if c.IsWebsocket() {
+			c.Next()
+			return
+		}
+
+		s.inflight.Add(1)
+		defer s.inflight.Add(-1)
+
+		c.Next()
+	}
+}
+
+// drain stops the server accepting new requests and waits up to timeout for
+// those in progress to finish. It reports whether they all finished.
+func (s *Server) drain(timeout time.Duration) bool {
+	s.draining.Store(true)
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		// handlers finish before the scheduler releases their runners
+		inflight, scheduled := s.inflight.Load(), 0
+		if s.sched != nil {
+			scheduled = s.sched.activeRequests()
+		}
+
+		if inflight == 0 && scheduled == 0 {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			slog.Warn("shutdown timeout exceeded, stopping requests in progress", "requests", inflight, "scheduled", scheduled)
+			return false
+		}
+
+		<-ticker.C
+	}
+}
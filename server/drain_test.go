@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	s := &Server{sched: InitScheduler(ctx)}
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	r := gin.New()
+	r.Use(s.drainMiddleware())
+	r.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-finish
+		c.Status(http.StatusOK)
+	})
+	r.GET("/fast", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	get := func(path string) int {
+		resp, err := srv.Client().Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, get("/fast"))
+
+	slow := make(chan int)
+	go func() { slow <- get("/slow") }()
+	<-started
+
+	drained := make(chan bool)
+	go func() { drained <- s.drain(time.Minute) }()
+
+	require.Eventually(t, s.draining.Load, time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusServiceUnavailable, get("/fast"))
+
+	select {
+	case <-drained:
+		t.Fatal("drained with a request in progress")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(finish)
+	require.Equal(t, http.StatusOK, <-slow)
+	require.True(t, <-drained)
+}
+
+func TestDrainTimeout(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	s := &Server{sched: InitScheduler(ctx)}
+
+	// a request holding a runner keeps the server from draining
+	runner := &runnerRef{refCount: 1}
+	s.sched.loaded["model"] = runner
+	require.Equal(t, 1, s.sched.activeRequests())
+	require.False(t, s.drain(50*time.Millisecond))
+
+	runner.refMu.Lock()
+	runner.refCount = 0
+	runner.refMu.Unlock()
+	require.True(t, s.drain(0))
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"slices"
+	"time"
+)
+
+// evictionPolicy chooses which runner is unloaded when another model needs
+// to be loaded in its place
+type evictionPolicy interface {
+	// less reports whether runner a should be unloaded before runner b
+	less(a, b runnerSnapshot) bool
+}
+
+// runnerSnapshot is the state of a runner that eviction policies compare.
+// Requests update it while the scheduler sorts runners, so it's copied with
+// the runner locked.
+type runnerSnapshot struct {
+	runner *runnerRef
+
+	name            string
+	refCount        uint
+	sessionDuration time.Duration
+	lastUsed        time.Time
+	estimatedVRAM   uint64
+	estimatedTotal  uint64
+}
+
+// snapshot copies the state of runner compared by eviction policies. The
+// refMu must already be held when calling snapshot.
+func (runner *runnerRef) snapshot() runnerSnapshot {
+	return runnerSnapshot{
+		runner:          runner,
+		name:            runner.shortName(),
+		refCount:        runner.refCount,
+		sessionDuration: runner.sessionDuration,
+		lastUsed:        runner.lastUsed,
+		estimatedVRAM:   runner.estimatedVRAM,
+		estimatedTotal:  runner.estimatedTotal,
+	}
+}
+
+// newEvictionPolicy returns the eviction policy named name. priorities are
+// the model patterns of the priority policy, from most to least important.
+func newEvictionPolicy(name string, priorities []string) evictionPolicy {
+	switch name {
+	case "lru":
+		return lruPolicy{}
+	case "smallest":
+		return sizePolicy{}
+	case "largest":
+		return sizePolicy{largest: true}
+	case "priority":
+		return priorityPolicy{models: priorities}
+	default:
+		return durationPolicy{}
+	}
+}
+
+// durationPolicy unloads the runner with the shortest keep alive first
+type durationPolicy struct{}
+
+func (durationPolicy) less(a, b runnerSnapshot) bool {
+	// uint64 to turn negative time (never unload) to largest
+	return uint64(a.sessionDuration) < uint64(b.sessionDuration)
+}
+
+// lruPolicy unloads the runner that was least recently used first
+type lruPolicy struct{}
+
+func (lruPolicy) less(a, b runnerSnapshot) bool {
+	return a.lastUsed.Before(b.lastUsed)
+}
+
+// sizePolicy unloads the runner using the least VRAM first, or the most if
+// largest is set. Runners using the same VRAM are compared by their total
+// memory, so CPU runners are ordered too.
+type sizePolicy struct {
+	largest bool
+}
+
+func (p sizePolicy) less(a, b runnerSnapshot) bool {
+	sizeA, sizeB := a.estimatedVRAM, b.estimatedVRAM
+	if sizeA == sizeB {
+		sizeA, sizeB = a.estimatedTotal, b.estimatedTotal
+	}
+
+	if p.largest {
+		return sizeA > sizeB
+	}
+
+	return sizeA < sizeB
+}
+
+// priorityPolicy unloads runners in reverse order of the first of models
+// their model matches, and runners of models that don't match any before
+// those that do. Runners of the same priority are unloaded least recently
+// used first.
+type priorityPolicy struct {
+	models []string
+}
+
+func (p priorityPolicy) rank(runner runnerSnapshot) int {
+	if i := slices.IndexFunc(p.models, func(pattern string) bool { return modelMatches(pattern, runner.name) }); i >= 0 {
+		return i
+	}
+
+	return len(p.models)
+}
+
+func (p priorityPolicy) less(a, b runnerSnapshot) bool {
+	if rankA, rankB := p.rank(a), p.rank(b); rankA != rankB {
+		return rankA > rankB
+	}
+
+	return lruPolicy{}.less(a, b)
+}
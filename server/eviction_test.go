@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer done()
+
+	now := time.Now()
+	llama := &runnerRef{
+		modelInfo:       &Model{ShortName: "llama3:latest"},
+		sessionDuration: 5 * time.Minute,
+		lastUsed:        now.Add(-3 * time.Minute),
+		estimatedVRAM:   100,
+	}
+	mistral := &runnerRef{
+		modelInfo:       &Model{ShortName: "mistral:latest"},
+		sessionDuration: time.Minute,
+		lastUsed:        now.Add(-time.Minute),
+		estimatedVRAM:   300,
+	}
+	phi := &runnerRef{
+		modelInfo:       &Model{ShortName: "phi3:mini"},
+		sessionDuration: -1,
+		lastUsed:        now.Add(-2 * time.Minute),
+		estimatedVRAM:   200,
+	}
+
+	cases := []struct {
+		name       string
+		policy     string
+		priorities []string
+		expect     *runnerRef
+	}{
+		{"duration", "duration", nil, mistral},
+		{"lru", "lru", nil, llama},
+		{"smallest", "smallest", nil, llama},
+		{"largest", "largest", nil, mistral},
+		{"unlisted priority", "priority", []string{"mistral", "llama3"}, phi},
+		{"lowest priority", "priority", []string{"phi3", "mistral", "llama3:latest"}, llama},
+		{"same priority", "priority", []string{"*"}, llama},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := InitScheduler(ctx)
+			s.eviction = newEvictionPolicy(tt.policy, tt.priorities)
+			s.loaded["llama3"] = llama
+			s.loaded["mistral"] = mistral
+			s.loaded["phi3"] = phi
+
+			assert.Same(t, tt.expect, s.findRunnerToUnload(&LlmRequest{ctx: ctx}))
+		})
+	}
+
+	t.Run("pinned", func(t *testing.T) {
+		s := InitScheduler(ctx)
+		s.eviction = newEvictionPolicy("duration", nil)
+		s.loaded["llama3"] = llama
+		s.loaded["mistral"] = &runnerRef{pinned: true, sessionDuration: time.Minute}
+		s.loaded["phi3"] = phi
+
+		assert.Same(t, llama, s.findRunnerToUnload(&LlmRequest{ctx: ctx}))
+
+		delete(s.loaded, "llama3")
+		phi.pinned = true
+		t.Cleanup(func() { phi.pinned = false })
+		assert.Nil(t, s.findRunnerToUnload(&LlmRequest{ctx: ctx}))
+	})
+
+	t.Run("runners in use", func(t *testing.T) {
+		s := InitScheduler(ctx)
+		s.eviction = newEvictionPolicy("lru", nil)
+		runners := []*runnerRef{
+			{modelInfo: &Model{ShortName: "a:latest"}},
+			{modelInfo: &Model{ShortName: "b:latest"}},
+		}
+		for _, r := range runners {
+			s.loaded[r.shortName()] = r
+		}
+
+		// requests update runners under their locks while they're compared
+		started, stop, stopped := make(chan struct{}), make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			close(started)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				r := runners[i%len(runners)]
+				r.refMu.Lock()
+				r.lastUsed = time.Now()
+				r.refMu.Unlock()
+			}
+		}()
+
+		<-started
+		for range 100 {
+			r := s.findRunnerToUnload(&LlmRequest{ctx: ctx})
+			assert.True(t, r == runners[0] || r == runners[1])
+		}
+		close(stop)
+		<-stopped
+	})
+}
+
+func TestPinnedModels(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+
+	previous := loadedMax
+	loadedMax = 1
+	t.Cleanup(func() { loadedMax = previous })
+
+	scenario1 := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario1.req.model.ShortName = "pinned:latest"
+	scenario2 := newScenario(t, ctx, "ollama-model-2", 10)
+
+	s := InitScheduler(ctx)
+	s.pinned = []string{"pinned"}
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = 24 * format.GigaByte
+		g.FreeMemory = 12 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.newServerFn = scenario1.newServer
+	s.Run(ctx)
+
+	require.NoError(t, s.pending.push(scenario1.req, 0))
+	select {
+	case resp := <-scenario1.req.successCh:
+		require.True(t, resp.pinned)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// the pinned model isn't unloaded even once it's idle
+	scenario1.ctxDone()
+	s.newServerFn = scenario2.newServer
+	require.NoError(t, s.pending.push(scenario2.req, 0))
+	select {
+	case err := <-scenario2.req.errCh:
+		require.ErrorIs(t, err, errModelsPinned)
+	case <-scenario2.req.successCh:
+		t.Fatal("pinned model was unloaded")
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	require.Len(t, s.loaded, 1)
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/convert"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/parser"
@@ -285,6 +286,24 @@ func realpath(mfDir, from string) string {
 	return abspath
 }
 
+// modelReferences returns the names of the models a Modelfile's FROM and
+// ADAPTER commands refer to, rather than files or blobs, as CreateModel
+// resolves them
+func modelReferences(commands []parser.Command, modelFileDir string) []string {
+	var names []string
+	for _, c := range commands {
+		if c.Name != "model" && c.Name != "adapter" || strings.HasPrefix(c.Args, "@") {
+			continue
+		}
+
+		if _, err := os.Stat(realpath(modelFileDir, c.Args)); err != nil {
+			names = append(names, c.Args)
+		}
+	}
+
+	return names
+}
+
 func CreateModel(ctx context.Context, name, modelFileDir, quantization string, commands []parser.Command, fn func(resp api.ProgressResponse)) error {
 	deleteMap := make(map[string]struct{})
 	if manifest, _, err := GetManifest(ParseModelPath(name)); err == nil {
@@ -624,7 +643,7 @@ func CreateModel(ctx context.Context, name, modelFileDir, quantization string, c
 		return err
 	}
 
-	if noprune := os.Getenv("OLLAMA_NOPRUNE"); noprune == "" {
+	if !envconfig.Current().NoPrune {
 		if err := deleteUnusedLayers(nil, deleteMap, false); err != nil {
 			return err
 		}
@@ -1003,12 +1022,12 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	var manifest *ManifestV2
 	var err error
-	var noprune string
+	noprune := envconfig.Current().NoPrune
 
 	// build deleteMap to prune unused layers
 	deleteMap := make(map[string]struct{})
 
-	if noprune = os.Getenv("OLLAMA_NOPRUNE"); noprune == "" {
+	if !noprune {
 		manifest, _, err = GetManifest(mp)
 		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			return err
@@ -1091,7 +1110,7 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return err
 	}
 
-	if noprune == "" {
+	if !noprune {
 		fn(api.ProgressResponse{Status: "removing any unused layers"})
 		err = deleteUnusedLayers(nil, deleteMap, false)
 		if err != nil {
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const unixScheme = "unix://"
+
+// Listen opens a listener for each of addrs, which may be a host:port, a URL
+// such as http://0.0.0.0:11434 or a Unix socket such as unix:///run/ollama.sock.
+// Unix sockets are created with mode, so access can be restricted to users
+// or groups with file permissions.
+func Listen(addrs []string, mode fs.FileMode) ([]net.Listener, error) {
+	if len(addrs) == 0 {
+		addrs = []string{""}
+	}
+
+	var lns []net.Listener
+	for _, addr := range addrs {
+		ln, err := listen(addr, mode)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+
+			return nil, err
+		}
+
+		lns = append(lns, ln)
+	}
+
+	return lns, nil
+}
+
+func listen(addr string, mode fs.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return listenUnix(path, mode)
+	}
+
+	// allow the same OLLAMA_HOST as clients, such as https://0.0.0.0:11434
+	if _, after, ok := strings.Cut(addr, "://"); ok {
+		addr = strings.TrimRight(after, "/")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "127.0.0.1", "11434"
+		if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+			host = ip.String()
+		}
+	}
+
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("unix:// address has no socket path")
+	}
+
+	// remove a socket left behind by a server that didn't shut down cleanly,
+	// but not one another server is listening on
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		conn, err := net.Dial("unix", path)
+		switch {
+		case err == nil:
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", path, syscall.EADDRINUSE)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ollama.sock")
+
+	lns, err := Listen([]string{"127.0.0.1:0", "unix://" + socket}, 0o600)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	})
+
+	require.Len(t, lns, 2)
+	assert.Equal(t, "tcp", lns[0].Addr().Network())
+	assert.Equal(t, "unix", lns[1].Addr().Network())
+
+	fi, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	t.Run("socket in use", func(t *testing.T) {
+		_, err := Listen([]string{"unix://" + socket}, 0o600)
+		require.ErrorIs(t, err, syscall.EADDRINUSE)
+	})
+
+	t.Run("missing socket path", func(t *testing.T) {
+		_, err := Listen([]string{"unix://"}, 0o600)
+		require.ErrorContains(t, err, "no socket path")
+	})
+}
+
+func TestListenStaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ollama.sock")
+
+	// a listener that doesn't remove its socket when closed, as if the
+	// server had crashed
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, ln.Close())
+
+	lns, err := Listen([]string{"unix://" + socket}, 0o660)
+	require.NoError(t, err)
+	require.NoError(t, lns[0].Close())
+}
+
+func TestUnixSocketAllowedHosts(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ollama.sock")
+	lns, err := Listen([]string{"unix://" + socket}, 0o600)
+	require.NoError(t, err)
+
+	s := &Server{}
+	srv := &http.Server{Handler: s.GenerateRoutes(), BaseContext: listenerContext}
+	go srv.Serve(lns[0]) //nolint:errcheck
+	t.Cleanup(func() { srv.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	cases := map[string]int{
+		"localhost":   http.StatusOK,
+		"example.com": http.StatusForbidden,
+	}
+
+	for host, status := range cases {
+		t.Run(host, func(t *testing.T) {
+			resp, err := client.Get("http://" + host + "/api/version")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode)
+		})
+	}
+}
+
+func TestTCPAllowedHosts(t *testing.T) {
+	cases := []struct {
+		addr  string
+		hosts map[string]int
+	}{
+		{
+			addr: "127.0.0.1:0",
+			hosts: map[string]int{
+				"localhost:11434":  http.StatusOK,
+				"127.0.0.1:11434":  http.StatusOK,
+				"ollama.localhost": http.StatusOK,
+				"example.com":      http.StatusForbidden,
+			},
+		},
+		{
+			// anyone can reach the server by its address, so the host
+			// isn't checked even for clients connecting over loopback
+			addr: "0.0.0.0:0",
+			hosts: map[string]int{
+				"localhost:11434": http.StatusOK,
+				"example.com":     http.StatusOK,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.addr, func(t *testing.T) {
+			lns, err := Listen([]string{tt.addr}, 0)
+			require.NoError(t, err)
+
+			s := &Server{}
+			srv := &http.Server{Handler: s.GenerateRoutes(), BaseContext: listenerContext}
+			go srv.Serve(lns[0]) //nolint:errcheck
+			t.Cleanup(func() { srv.Close() })
+
+			_, port, err := net.SplitHostPort(lns[0].Addr().String())
+			require.NoError(t, err)
+
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", port))
+				},
+			}}
+
+			for host, status := range tt.hosts {
+				resp, err := client.Get("http://" + host + "/api/version")
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, status, resp.StatusCode, host)
+			}
+		})
+	}
+}
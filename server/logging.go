@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/logging"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 128
+)
+
+// initLogging sets the default logger from the log settings in cfg
+func initLogging(cfg *envconfig.Config) error {
+	level := slog.LevelInfo
+	if cfg.Debug {
+		level = slog.LevelDebug
+	} else if l, err := logging.ParseLevel(cfg.LogLevel); err == nil {
+		level = l
+	}
+
+	var w io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		f, err := logging.OpenRotatingFile(cfg.LogFile, int64(cfg.LogMaxSize)<<20, cfg.LogMaxFiles)
+		if err != nil {
+			return err
+		}
+
+		// the file stays open until the process exits
+		w = f
+	}
+
+	handler, err := logging.NewHandler(w, cfg.LogFormat, level)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// requestIDMiddleware tags each request with the ID from its X-Request-ID
+// header, or a new one if it doesn't have a valid one, so log lines for the
+// request can be correlated. The ID is returned in the response's
+// X-Request-ID header.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+
+	for _, r := range id {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) || r == ' ' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	s := &Server{}
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	get := func(id string) string {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/version", nil)
+		require.NoError(t, err)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.Header.Get("X-Request-ID")
+	}
+
+	require.Equal(t, "client-id-123", get("client-id-123"))
+
+	for _, id := range []string{"", "has space", strings.Repeat("a", maxRequestIDLen+1), "naïve"} {
+		generated := get(id)
+		require.NotEqual(t, id, generated)
+		_, err := uuid.Parse(generated)
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/metrics"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	httpRequests        = registry.NewCounterVec("ollama_http_requests_total", "Number of HTTP requests handled.", "handler", "method", "code")
+	httpRequestDuration = registry.NewHistogramVec("ollama_http_request_duration_seconds", "Time taken to handle HTTP requests, including streaming the response.", metrics.DefBuckets, "handler", "method")
+
+	promptTokens       = registry.NewCounterVec("ollama_prompt_tokens_total", "Number of prompt tokens evaluated.", "model")
+	promptEvalDuration = registry.NewCounterVec("ollama_prompt_eval_duration_seconds_total", "Time spent evaluating prompt tokens.", "model")
+	evalTokens         = registry.NewCounterVec("ollama_eval_tokens_total", "Number of tokens generated.", "model")
+	evalDuration       = registry.NewCounterVec("ollama_eval_duration_seconds_total", "Time spent generating tokens.", "model")
+
+	queueDepth   = registry.NewGaugeVec("ollama_queue_depth", "Number of requests waiting to be scheduled.", "priority")
+	loadedModels = registry.NewGaugeVec("ollama_loaded_models", "Number of models loaded into memory.")
+	modelLoad    = registry.NewHistogramVec("ollama_model_load_duration_seconds", "Time taken to load a model into memory.", metrics.DefBuckets, "model")
+
+	gpuTotalMemory  = registry.NewGaugeVec("ollama_gpu_memory_total_bytes", "Total GPU memory reported by the driver.", "library", "gpu")
+	gpuFreeMemory   = registry.NewGaugeVec("ollama_gpu_memory_free_bytes", "Free GPU memory reported by the driver when it was last checked.", "library", "gpu")
+	gpuEstimatedUse = registry.NewGaugeVec("ollama_gpu_memory_estimated_used_bytes", "GPU memory the loaded models are estimated to use.", "library", "gpu")
+
+	pullBytes = registry.NewCounterVec("ollama_pull_bytes_total", "Number of bytes downloaded while pulling models.")
+	pushBytes = registry.NewCounterVec("ollama_push_bytes_total", "Number of bytes uploaded while pushing models.")
+)
+
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		handler := c.FullPath()
+		if handler == "" {
+			handler = "unmatched"
+		}
+
+		httpRequests.Inc(handler, c.Request.Method, strconv.Itoa(c.Writer.Status()))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), handler, c.Request.Method)
+	}
+}
+
+func (s *Server) MetricsHandler(c *gin.Context) {
+	if s.sched != nil {
+		depths := map[requestPriority]int{priorityInteractive: 0, priorityBatch: 0}
+		for _, req := range s.sched.queuedRequests() {
+			depths[req.priority]++
+		}
+
+		for p, depth := range depths {
+			queueDepth.Set(float64(depth), p.String())
+		}
+
+		loadedModels.Set(float64(len(s.sched.loadedRunners())))
+		recordGPUMemory(s.sched.reportedGPUs(), s.sched.estimatedGPUMemory())
+	}
+
+	registry.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+// recordTokenMetrics records the token counts and timings of a completed request
+func recordTokenMetrics(model string, m api.Metrics) {
+	promptTokens.Add(float64(m.PromptEvalCount), model)
+	promptEvalDuration.Add(m.PromptEvalDuration.Seconds(), model)
+	evalTokens.Add(float64(m.EvalCount), model)
+	evalDuration.Add(m.EvalDuration.Seconds(), model)
+}
+
+// recordGPUMemory records the memory reported for each GPU and the memory the
+// scheduler estimates the loaded models use on it
+func recordGPUMemory(gpus gpu.GpuInfoList, estimated map[gpuKey]uint64) {
+	for _, g := range gpus {
+		if g.Library == "cpu" {
+			continue
+		}
+
+		gpuTotalMemory.Set(float64(g.TotalMemory), g.Library, g.ID)
+		gpuFreeMemory.Set(float64(g.FreeMemory), g.Library, g.ID)
+		gpuEstimatedUse.Set(float64(estimated[gpuKey{g.Library, g.ID}]), g.Library, g.ID)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID returns the user ID of the process on the other end of conn
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"strings"
@@ -54,6 +55,14 @@ func formatTemplateForResponse(tmpl *template.Template, generate bool) {
 // Prompt renders a prompt from a template. If generate is set to true,
 // the response and parts of the template following it are not rendered
 func Prompt(tmpl, system, prompt, response string, generate bool) (string, error) {
+	return renderPrompt(tmpl, map[string]any{
+		"System":   system,
+		"Prompt":   prompt,
+		"Response": response,
+	}, generate)
+}
+
+func renderPrompt(tmpl string, vars map[string]any, generate bool) (string, error) {
 	parsed, err := template.New("").Option("missingkey=zero").Parse(tmpl)
 	if err != nil {
 		return "", err
@@ -61,12 +70,6 @@ func Prompt(tmpl, system, prompt, response string, generate bool) (string, error
 
 	formatTemplateForResponse(parsed, generate)
 
-	vars := map[string]any{
-		"System":   system,
-		"Prompt":   prompt,
-		"Response": response,
-	}
-
 	var sb strings.Builder
 	if err := parsed.Execute(&sb, vars); err != nil {
 		return "", err
@@ -75,8 +78,8 @@ func Prompt(tmpl, system, prompt, response string, generate bool) (string, error
 	return sb.String(), nil
 }
 
-func countTokens(tmpl string, system string, prompt string, response string, encode func(string) ([]int, error)) (int, error) {
-	rendered, err := Prompt(tmpl, system, prompt, response, false)
+func countTokens(tmpl string, vars map[string]any, encode func(string) ([]int, error)) (int, error) {
+	rendered, err := renderPrompt(tmpl, vars, false)
 	if err != nil {
 		return 0, err
 	}
@@ -91,16 +94,30 @@ func countTokens(tmpl string, system string, prompt string, response string, enc
 }
 
 // ChatPrompt builds up a prompt from a series of messages, truncating based on context window size
-func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(string) ([]int, error)) (string, error) {
+func ChatPrompt(tmpl string, messages []api.Message, tools api.Tools, window int, encode func(string) ([]int, error)) (string, error) {
 	type prompt struct {
-		System   string
-		Prompt   string
-		Response string
+		System     string
+		Prompt     string
+		Response   string
+		ToolCalls  []api.ToolCall
+		ToolResult bool
+		Tools      api.Tools
 
 		images []int
 		tokens int
 	}
 
+	vars := func(p prompt) map[string]any {
+		return map[string]any{
+			"System":     p.System,
+			"Prompt":     p.Prompt,
+			"Response":   p.Response,
+			"ToolCalls":  p.ToolCalls,
+			"ToolResult": p.ToolResult,
+			"Tools":      p.Tools,
+		}
+	}
+
 	var p prompt
 
 	// iterate through messages to build up {system,user,response} prompts
@@ -109,14 +126,14 @@ func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(str
 	for _, msg := range messages {
 		switch strings.ToLower(msg.Role) {
 		case "system":
-			if p.System != "" || p.Prompt != "" || p.Response != "" {
+			if p.System != "" || p.Prompt != "" || p.Response != "" || len(p.ToolCalls) > 0 {
 				prompts = append(prompts, p)
 				p = prompt{}
 			}
 
 			p.System = msg.Content
 		case "user":
-			if p.Prompt != "" || p.Response != "" {
+			if p.Prompt != "" || p.Response != "" || len(p.ToolCalls) > 0 {
 				prompts = append(prompts, p)
 				p = prompt{}
 			}
@@ -131,25 +148,46 @@ func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(str
 			sb.WriteString(msg.Content)
 			p.Prompt = sb.String()
 		case "assistant":
-			if p.Response != "" {
+			if p.Response != "" || len(p.ToolCalls) > 0 {
 				prompts = append(prompts, p)
 				p = prompt{}
 			}
 
 			p.Response = msg.Content
+			p.ToolCalls = msg.ToolCalls
+		case "tool":
+			// consecutive tool results are answers to the same set of tool calls
+			// so they are rendered together as a single prompt
+			if p.ToolResult && p.Response == "" && len(p.ToolCalls) == 0 {
+				p.Prompt += "\n" + msg.Content
+				continue
+			}
+
+			if p.Prompt != "" || p.Response != "" || len(p.ToolCalls) > 0 {
+				prompts = append(prompts, p)
+				p = prompt{}
+			}
+
+			p.Prompt = msg.Content
+			p.ToolResult = true
 		default:
-			return "", fmt.Errorf("invalid role: %s, role must be one of [system, user, assistant]", msg.Role)
+			return "", fmt.Errorf("invalid role: %s, role must be one of [system, user, assistant, tool]", msg.Role)
 		}
 	}
 
 	// add final prompt
-	if p.System != "" || p.Prompt != "" || p.Response != "" {
+	if p.System != "" || p.Prompt != "" || p.Response != "" || len(p.ToolCalls) > 0 {
 		prompts = append(prompts, p)
 	}
 
+	// tool definitions are only rendered once, alongside the latest prompt
+	if len(prompts) > 0 {
+		prompts[len(prompts)-1].Tools = tools
+	}
+
 	// calculate token lengths for each prompt, estimating 768 tokens per images
 	for i, p := range prompts {
-		tokens, err := countTokens(tmpl, p.System, p.Prompt, p.Response, encode)
+		tokens, err := countTokens(tmpl, vars(p), encode)
 		if err != nil {
 			return "", err
 		}
@@ -192,7 +230,7 @@ func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(str
 			if system != "" && prompts[0].System == "" {
 				prompts[0].System = system
 
-				tokens, err := countTokens(tmpl, prompts[0].System, prompts[0].Prompt, prompts[0].Response, encode)
+				tokens, err := countTokens(tmpl, vars(prompts[0]), encode)
 				if err != nil {
 					return "", err
 				}
@@ -210,7 +248,7 @@ func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(str
 	var sb strings.Builder
 	for i, p := range prompts {
 		// last prompt should leave the response unrendered (for completion)
-		rendered, err := Prompt(tmpl, p.System, p.Prompt, p.Response, i == len(prompts)-1)
+		rendered, err := renderPrompt(tmpl, vars(p), i == len(prompts)-1)
 		if err != nil {
 			return "", err
 		}
@@ -219,3 +257,128 @@ func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(str
 
 	return sb.String(), nil
 }
+
+// mayBeToolCall reports whether s could be the start of a response that
+// parseToolCalls accepts, in which case it shouldn't be streamed as content
+// until the rest of the response arrives
+func mayBeToolCall(s string) bool {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "```") {
+		s = s[3:]
+		if strings.HasPrefix("json", s) {
+			return true
+		}
+
+		s = strings.TrimSpace(strings.TrimPrefix(s, "json"))
+	}
+
+	if strings.HasPrefix(s, "<") {
+		end := strings.Index(s, ">")
+		if end < 0 {
+			return true
+		}
+
+		s = strings.TrimSpace(s[end+1:])
+	}
+
+	return s == "" || strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") || strings.HasPrefix("```", s)
+}
+
+// parseToolCalls attempts to parse a model response into a list of calls to
+// the provided tools. The response must consist solely of a JSON object or
+// array of objects, optionally wrapped in a code fence or a single markup tag,
+// and every call must name one of the tools.
+func parseToolCalls(s string, tools api.Tools) ([]api.ToolCall, bool) {
+	if len(tools) == 0 {
+		return nil, false
+	}
+
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "```") {
+		s = strings.TrimPrefix(s, "```json")
+		s = strings.TrimPrefix(s, "```")
+		s = strings.TrimSuffix(s, "```")
+		s = strings.TrimSpace(s)
+	}
+
+	// strip a wrapping tag such as <tool_call>...</tool_call>
+	if strings.HasPrefix(s, "<") {
+		if end := strings.Index(s, ">"); end > 0 {
+			tag := s[1:end]
+			s = strings.TrimSpace(s[end+1:])
+			s = strings.TrimSpace(strings.TrimSuffix(s, "</"+tag+">"))
+		}
+	}
+
+	if !strings.HasPrefix(s, "{") && !strings.HasPrefix(s, "[") {
+		return nil, false
+	}
+
+	dec := json.NewDecoder(strings.NewReader(s))
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+
+	if rest := strings.TrimSpace(s[dec.InputOffset():]); rest != "" {
+		return nil, false
+	}
+
+	var objs []any
+	switch t := v.(type) {
+	case map[string]any:
+		objs = []any{t}
+	case []any:
+		objs = t
+	}
+
+	if len(objs) == 0 {
+		return nil, false
+	}
+
+	names := make(map[string]bool, len(tools))
+	for _, tool := range tools {
+		names[tool.Function.Name] = true
+	}
+
+	var calls []api.ToolCall
+	for _, obj := range objs {
+		m, ok := obj.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		// accept both {"name": ..., "arguments": ...} and the OpenAI style
+		// {"function": {"name": ..., "arguments": ...}}
+		if fn, ok := m["function"].(map[string]any); ok {
+			m = fn
+		}
+
+		name, _ := m["name"].(string)
+		if !names[name] {
+			return nil, false
+		}
+
+		args := m["arguments"]
+		if args == nil {
+			args = m["parameters"]
+		}
+
+		var arguments map[string]any
+		switch a := args.(type) {
+		case nil:
+		case map[string]any:
+			arguments = a
+		case string:
+			if err := json.Unmarshal([]byte(a), &arguments); err != nil {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+
+		calls = append(calls, api.ToolCall{Function: api.ToolCallFunction{Name: name, Arguments: arguments}})
+	}
+
+	return calls, true
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 
@@ -78,6 +79,7 @@ func TestChatPrompt(t *testing.T) {
 		name     string
 		template string
 		messages []api.Message
+		tools    api.Tools
 		window   int
 		want     string
 	}{
@@ -183,6 +185,32 @@ func TestChatPrompt(t *testing.T) {
 			window: 1024,
 			want:   "",
 		},
+		{
+			name:     "tools",
+			template: "{{ if .Tools }}[TOOLS] {{ .Tools }} [/TOOLS] {{ end }}[INST] {{ .Prompt }} [/INST]",
+			messages: []api.Message{
+				{Role: "user", Content: "What is the weather?"},
+			},
+			tools: api.Tools{
+				{Type: "function", Function: api.ToolFunction{Name: "get_weather"}},
+			},
+			window: 1024,
+			want:   `[TOOLS] [{"type":"function","function":{"name":"get_weather"}}] [/TOOLS] [INST] What is the weather? [/INST]`,
+		},
+		{
+			name:     "tool calls and results",
+			template: "{{ if .ToolResult }}[RESULT] {{ .Prompt }} [/RESULT]{{ else if .Prompt }}[INST] {{ .Prompt }} [/INST]{{ end }}{{ range .ToolCalls }}[CALL] {{ . }} [/CALL]{{ end }}{{ .Response }}",
+			messages: []api.Message{
+				{Role: "user", Content: "What is the weather?"},
+				{Role: "assistant", ToolCalls: []api.ToolCall{
+					{Function: api.ToolCallFunction{Name: "get_weather", Arguments: map[string]any{"city": "Paris"}}},
+				}},
+				{Role: "tool", Content: "sunny"},
+				{Role: "tool", Content: "warm"},
+			},
+			window: 1024,
+			want:   `[INST] What is the weather? [/INST][CALL] {"function":{"name":"get_weather","arguments":{"city":"Paris"}}} [/CALL][RESULT] sunny` + "\n" + `warm [/RESULT]`,
+		},
 	}
 
 	encode := func(s string) ([]int, error) {
@@ -192,7 +220,7 @@ func TestChatPrompt(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got, err := ChatPrompt(tc.template, tc.messages, tc.window, encode)
+			got, err := ChatPrompt(tc.template, tc.messages, tc.tools, tc.window, encode)
 			if err != nil {
 				t.Errorf("error = %v", err)
 			}
@@ -203,3 +231,94 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestParseToolCalls(t *testing.T) {
+	tools := api.Tools{
+		{Type: "function", Function: api.ToolFunction{Name: "get_weather"}},
+		{Type: "function", Function: api.ToolFunction{Name: "get_time"}},
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    []api.ToolCall
+		ok      bool
+	}{
+		{
+			name:    "object",
+			content: `{"name": "get_weather", "arguments": {"city": "Paris"}}`,
+			want:    []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: map[string]any{"city": "Paris"}}}},
+			ok:      true,
+		},
+		{
+			name:    "array",
+			content: `[{"name": "get_weather", "parameters": {"city": "Paris"}}, {"name": "get_time"}]`,
+			want: []api.ToolCall{
+				{Function: api.ToolCallFunction{Name: "get_weather", Arguments: map[string]any{"city": "Paris"}}},
+				{Function: api.ToolCallFunction{Name: "get_time"}},
+			},
+			ok: true,
+		},
+		{
+			name:    "tagged",
+			content: "<tool_call>\n{\"function\": {\"name\": \"get_time\", \"arguments\": \"{\\\"tz\\\": \\\"UTC\\\"}\"}}\n</tool_call>",
+			want:    []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_time", Arguments: map[string]any{"tz": "UTC"}}}},
+			ok:      true,
+		},
+		{
+			name:    "code fence",
+			content: "```json\n{\"name\": \"get_time\", \"arguments\": {}}\n```",
+			want:    []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_time", Arguments: map[string]any{}}}},
+			ok:      true,
+		},
+		{
+			name:    "unknown tool",
+			content: `{"name": "get_stock_price", "arguments": {}}`,
+		},
+		{
+			name:    "plain text",
+			content: "The weather in Paris is sunny.",
+		},
+		{
+			name:    "trailing text",
+			content: `{"name": "get_time", "arguments": {}} and then some`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseToolCalls(tc.content, tools)
+			if ok != tc.ok {
+				t.Fatalf("ok = %v, want %v", ok, tc.ok)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMayBeToolCall(t *testing.T) {
+	tests := map[string]bool{
+		"":                            true,
+		"  ":                          true,
+		`{"name": "get_time"`:         true,
+		"[":                           true,
+		"`":                           true,
+		"```js":                       true,
+		"```json\n{":                  true,
+		"<tool_c":                     true,
+		"<tool_call>\n{":              true,
+		"The weather":                 false,
+		"```python\nprint()":          false,
+		"<p>The weather":              false,
+		"I'll call a tool: {\"name\"": false,
+	}
+
+	for s, want := range tests {
+		if got := mayBeToolCall(s); got != want {
+			t.Errorf("mayBeToolCall(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	errMaxQueue     = errors.New("server busy, please try again.  maximum pending requests exceeded")
+	errQueueTimeout = errors.New("server busy, please try again.  timed out waiting in queue")
+)
+
+// requestPriority determines the order pending requests are scheduled in
+type requestPriority int
+
+const (
+	priorityBatch requestPriority = iota
+	priorityInteractive
+)
+
+func parsePriority(s string) (requestPriority, error) {
+	switch s {
+	case "", "interactive":
+		return priorityInteractive, nil
+	case "batch":
+		return priorityBatch, nil
+	default:
+		return priorityInteractive, fmt.Errorf("invalid priority %q, must be \"interactive\" or \"batch\"", s)
+	}
+}
+
+func (p requestPriority) String() string {
+	if p == priorityBatch {
+		return "batch"
+	}
+
+	return "interactive"
+}
+
+// requestQueue holds requests waiting to be scheduled. Higher priority
+// requests are always taken first, and requests of the same priority are
+// taken in the order they arrived.
+type requestQueue struct {
+	mu   sync.Mutex
+	reqs []*LlmRequest
+	max  int
+
+	// readyCh is signaled when the queue is not empty
+	readyCh chan struct{}
+}
+
+func newRequestQueue(max int) *requestQueue {
+	return &requestQueue{
+		max:     max,
+		readyCh: make(chan struct{}, 1),
+	}
+}
+
+// push adds a request to the queue. If the queue is full, the newest of the
+// lowest priority requests is rejected with errMaxQueue to make room, unless
+// req doesn't outrank it, in which case req itself is rejected. A request
+// still queued once timeout elapses, or once its context is done, is failed
+// and removed. A timeout <= 0 lets requests wait indefinitely.
+func (q *requestQueue) push(req *LlmRequest, timeout time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.max > 0 && len(q.reqs) >= q.max {
+		last := q.reqs[len(q.reqs)-1]
+		if req.priority <= last.priority {
+			return errMaxQueue
+		}
+
+		q.reqs = q.reqs[:len(q.reqs)-1]
+		last.dequeued(errMaxQueue)
+	}
+
+	i := len(q.reqs)
+	for i > 0 && q.reqs[i-1].priority < req.priority {
+		i--
+	}
+
+	q.reqs = append(q.reqs, nil)
+	copy(q.reqs[i+1:], q.reqs[i:])
+	q.reqs[i] = req
+
+	stopCtx := context.AfterFunc(req.ctx, func() {
+		q.remove(req, req.ctx.Err())
+	})
+
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			q.remove(req, errQueueTimeout)
+		})
+	}
+
+	req.stopWaiting = func() {
+		stopCtx()
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	q.signal()
+	return nil
+}
+
+// pop takes the next request off the queue, or returns nil if it's empty
+func (q *requestQueue) pop() *LlmRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.reqs) == 0 {
+		return nil
+	}
+
+	req := q.reqs[0]
+	q.reqs = q.reqs[1:]
+	req.dequeued(nil)
+
+	if len(q.reqs) > 0 {
+		q.signal()
+	}
+
+	return req
+}
+
+// remove takes req off the queue if it's still waiting, failing it with err
+func (q *requestQueue) remove(req *LlmRequest, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.reqs {
+		if q.reqs[i] == req {
+			q.reqs = append(q.reqs[:i], q.reqs[i+1:]...)
+			req.dequeued(err)
+			return
+		}
+	}
+}
+
+// position returns the number of requests ahead of req, or -1 if req isn't queued
+func (q *requestQueue) position(req *LlmRequest) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.reqs {
+		if q.reqs[i] == req {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// snapshot returns the queued requests in the order they will be scheduled
+func (q *requestQueue) snapshot() []*LlmRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reqs := make([]*LlmRequest, len(q.reqs))
+	copy(reqs, q.reqs)
+	return reqs
+}
+
+func (q *requestQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.reqs)
+}
+
+func (q *requestQueue) signal() {
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+	}
+}
+
+// dequeued stops watching a request that left the queue, failing it with err
+// if it wasn't taken to be scheduled. Must be called with the queue locked.
+func (req *LlmRequest) dequeued(err error) {
+	if req.stopWaiting != nil {
+		req.stopWaiting()
+	}
+
+	if err != nil {
+		req.errCh <- err
+	}
+}
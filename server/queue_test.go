@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newQueuedRequest(ctx context.Context, name string, p requestPriority) *LlmRequest {
+	return &LlmRequest{
+		ctx:      ctx,
+		model:    &Model{ShortName: name},
+		priority: p,
+		errCh:    make(chan error, 1),
+	}
+}
+
+func TestRequestQueueOrder(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	q := newRequestQueue(10)
+	batch1 := newQueuedRequest(ctx, "batch1", priorityBatch)
+	interactive1 := newQueuedRequest(ctx, "interactive1", priorityInteractive)
+	batch2 := newQueuedRequest(ctx, "batch2", priorityBatch)
+	interactive2 := newQueuedRequest(ctx, "interactive2", priorityInteractive)
+	for _, req := range []*LlmRequest{batch1, interactive1, batch2, interactive2} {
+		require.NoError(t, q.push(req, 0))
+	}
+
+	require.Equal(t, 0, q.position(interactive1))
+	require.Equal(t, 3, q.position(batch2))
+
+	for _, expect := range []*LlmRequest{interactive1, interactive2, batch1, batch2} {
+		select {
+		case <-q.readyCh:
+		default:
+			t.Fatal("expected queue to be ready")
+		}
+		require.Equal(t, expect, q.pop())
+	}
+
+	require.Nil(t, q.pop())
+	require.Equal(t, -1, q.position(batch1))
+}
+
+func TestRequestQueueFull(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	q := newRequestQueue(2)
+	batch1 := newQueuedRequest(ctx, "batch1", priorityBatch)
+	batch2 := newQueuedRequest(ctx, "batch2", priorityBatch)
+	require.NoError(t, q.push(batch1, 0))
+	require.NoError(t, q.push(batch2, 0))
+
+	// a request that doesn't outrank anything queued is rejected
+	require.ErrorIs(t, q.push(newQueuedRequest(ctx, "batch3", priorityBatch), 0), errMaxQueue)
+
+	// an interactive request takes the place of the newest batch request
+	interactive := newQueuedRequest(ctx, "interactive", priorityInteractive)
+	require.NoError(t, q.push(interactive, 0))
+	require.Equal(t, 2, q.len())
+	require.ErrorIs(t, <-batch2.errCh, errMaxQueue)
+	require.Equal(t, interactive, q.pop())
+	require.Equal(t, batch1, q.pop())
+	require.Empty(t, batch1.errCh)
+}
+
+func TestRequestQueueTimeout(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	q := newRequestQueue(10)
+	timeout := newQueuedRequest(ctx, "timeout", priorityInteractive)
+	require.NoError(t, q.push(timeout, 5*time.Millisecond))
+
+	select {
+	case err := <-timeout.errCh:
+		require.ErrorIs(t, err, errQueueTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for queue timeout")
+	}
+	require.Equal(t, 0, q.len())
+
+	// requests taken off the queue in time aren't failed
+	scheduled := newQueuedRequest(ctx, "scheduled", priorityInteractive)
+	require.NoError(t, q.push(scheduled, 5*time.Millisecond))
+	require.Equal(t, scheduled, q.pop())
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, scheduled.errCh)
+}
+
+func TestRequestQueueCanceled(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	q := newRequestQueue(10)
+	canceled := newQueuedRequest(ctx, "canceled", priorityInteractive)
+	require.NoError(t, q.push(canceled, 0))
+
+	done()
+	select {
+	case err := <-canceled.errCh:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for canceled request")
+	}
+	require.Equal(t, 0, q.len())
+	require.Nil(t, q.pop())
+}
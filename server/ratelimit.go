@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+const rateLimitClientContextKey = "rateLimitClient"
+
+const (
+	requestWindow = time.Minute
+	tokenWindow   = 24 * time.Hour
+)
+
+// rateLimits are the limits applied to each client's inference requests.
+// Zero means unlimited.
+type rateLimits struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	ConcurrentStreams int `json:"concurrent_streams,omitempty"`
+	TokensPerDay      int `json:"tokens_per_day,omitempty"`
+}
+
+func (l rateLimits) unlimited() bool {
+	return l.RequestsPerMinute == 0 && l.ConcurrentStreams == 0 && l.TokensPerDay == 0
+}
+
+// rateLimitsFromConfig returns the default limits set by cfg
+func rateLimitsFromConfig(cfg *envconfig.Config) rateLimits {
+	return rateLimits{
+		RequestsPerMinute: cfg.MaxRequestsPerMinute,
+		ConcurrentStreams: cfg.MaxConcurrentStreams,
+		TokensPerDay:      cfg.MaxTokensPerDay,
+	}
+}
+
+// clientUsage tracks a client's requests in the current minute, its
+// requests in progress and the tokens it has generated in the current day
+type clientUsage struct {
+	requests      int
+	requestsReset time.Time
+
+	active int
+
+	tokens      int
+	tokensReset time.Time
+}
+
+func (u *clientUsage) idle(now time.Time) bool {
+	return u.active == 0 && now.After(u.requestsReset) && now.After(u.tokensReset)
+}
+
+// rateLimiter enforces rateLimits for each client, identified by its API key,
+// IP address or, on Unix sockets, user ID
+type rateLimiter struct {
+	defaults rateLimits
+
+	mu        sync.Mutex
+	clients   map[string]*clientUsage
+	lastSweep time.Time
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+func newRateLimiter(defaults rateLimits) *rateLimiter {
+	return &rateLimiter{
+		defaults: defaults,
+		clients:  make(map[string]*clientUsage),
+		now:      time.Now,
+	}
+}
+
+// acquire starts a request for client, returning a function to call once it
+// completes. If the request would exceed limits, it returns an error and how
+// long the client should wait before trying again.
+func (l *rateLimiter) acquire(client string, limits rateLimits) (func(), time.Duration, error) {
+	if limits.unlimited() {
+		return func() {}, 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	u, ok := l.clients[client]
+	if !ok {
+		u = &clientUsage{}
+		l.clients[client] = u
+	}
+
+	if now.After(u.requestsReset) {
+		u.requests = 0
+		u.requestsReset = now.Add(requestWindow)
+	}
+
+	if now.After(u.tokensReset) {
+		u.tokens = 0
+		u.tokensReset = now.Add(tokenWindow)
+	}
+
+	switch {
+	case limits.TokensPerDay > 0 && u.tokens >= limits.TokensPerDay:
+		return nil, u.tokensReset.Sub(now), fmt.Errorf("rate limit exceeded: %d tokens per day", limits.TokensPerDay)
+	case limits.RequestsPerMinute > 0 && u.requests >= limits.RequestsPerMinute:
+		return nil, u.requestsReset.Sub(now), fmt.Errorf("rate limit exceeded: %d requests per minute", limits.RequestsPerMinute)
+	case limits.ConcurrentStreams > 0 && u.active >= limits.ConcurrentStreams:
+		// there's no telling when a request in progress will finish
+		return nil, time.Second, fmt.Errorf("rate limit exceeded: %d concurrent requests", limits.ConcurrentStreams)
+	}
+
+	u.requests++
+	u.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			u.active--
+		})
+	}, 0, nil
+}
+
+// addTokens counts tokens generated for client against its daily quota. A
+// request in progress is allowed to finish even if it exceeds the quota.
+func (l *rateLimiter) addTokens(client string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if u, ok := l.clients[client]; ok {
+		u.tokens += n
+	}
+}
+
+// sweep forgets clients that have no requests in progress and whose limits
+// have reset. Must be called with the limiter locked.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < requestWindow {
+		return
+	}
+
+	l.lastSweep = now
+	for client, u := range l.clients {
+		if u.idle(now) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// socketClientContextKey is the context key of the client of a connection
+// accepted on a Unix socket
+type socketClientContextKey struct{}
+
+// connContext identifies clients of Unix sockets, which have no IP address,
+// by their user ID so each user's clients are limited together. Clients
+// share a single limit on platforms without peer credentials.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	client := "socket"
+	if uid, err := peerUID(unixConn); err == nil {
+		client = "uid:" + strconv.FormatUint(uint64(uid), 10)
+	} else {
+		slog.Debug("failed to get socket peer credentials", "error", err)
+	}
+
+	return context.WithValue(ctx, socketClientContextKey{}, client)
+}
+
+// rateLimit rejects requests that exceed the limits of the client's API key,
+// or the server's default limits, with 429 Too Many Requests
+func (s *Server) rateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.limiter == nil {
+			c.Next()
+			return
+		}
+
+		client, limits := "ip:"+c.RemoteIP(), s.limiter.defaults
+		if socketClient, ok := c.Request.Context().Value(socketClientContextKey{}).(string); ok {
+			client = socketClient
+		}
+		if key := requestAPIKey(c); key != nil {
+			client = "key:" + key.Key
+			if key.Limits != nil {
+				limits = *key.Limits
+			}
+		}
+
+		release, retryAfter, err := s.limiter.acquire(client, limits)
+		if err != nil {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		defer release()
+
+		c.Set(rateLimitClientContextKey, client)
+		c.Next()
+	}
+}
+
+// recordTokenUsage counts the tokens generated by a request against its
+// client's quota
+func (s *Server) recordTokenUsage(client string, evalCount int) {
+	if s.limiter != nil && client != "" {
+		s.limiter.addTokens(client, evalCount)
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/parser"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(rateLimits{})
+	l.now = func() time.Time { return now }
+
+	t.Run("unlimited", func(t *testing.T) {
+		for range 10 {
+			release, _, err := l.acquire("unlimited", rateLimits{})
+			require.NoError(t, err)
+			release()
+		}
+		require.NotContains(t, l.clients, "unlimited")
+	})
+
+	t.Run("requests per minute", func(t *testing.T) {
+		limits := rateLimits{RequestsPerMinute: 2}
+		for range 2 {
+			release, _, err := l.acquire("rpm", limits)
+			require.NoError(t, err)
+			release()
+		}
+
+		_, retryAfter, err := l.acquire("rpm", limits)
+		require.ErrorContains(t, err, "2 requests per minute")
+		require.Equal(t, time.Minute, retryAfter)
+
+		// other clients have their own limits
+		release, _, err := l.acquire("other", limits)
+		require.NoError(t, err)
+		release()
+
+		now = now.Add(time.Minute + time.Second)
+		release, _, err = l.acquire("rpm", limits)
+		require.NoError(t, err)
+		release()
+	})
+
+	t.Run("concurrent streams", func(t *testing.T) {
+		limits := rateLimits{ConcurrentStreams: 1}
+		release, _, err := l.acquire("streams", limits)
+		require.NoError(t, err)
+
+		_, _, err = l.acquire("streams", limits)
+		require.ErrorContains(t, err, "1 concurrent requests")
+
+		// releasing more than once has no effect
+		release()
+		release()
+
+		release, _, err = l.acquire("streams", limits)
+		require.NoError(t, err)
+		release()
+		require.Equal(t, 0, l.clients["streams"].active)
+	})
+
+	t.Run("tokens per day", func(t *testing.T) {
+		limits := rateLimits{TokensPerDay: 100}
+		release, _, err := l.acquire("tokens", limits)
+		require.NoError(t, err)
+		l.addTokens("tokens", 150)
+		release()
+
+		now = now.Add(time.Hour)
+		_, retryAfter, err := l.acquire("tokens", limits)
+		require.ErrorContains(t, err, "100 tokens per day")
+		require.Equal(t, 23*time.Hour, retryAfter)
+
+		now = now.Add(23*time.Hour + time.Second)
+		release, _, err = l.acquire("tokens", limits)
+		require.NoError(t, err)
+		release()
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		// clients are forgotten once idle and their limits have reset
+		now = now.Add(48 * time.Hour)
+		_, _, err := l.acquire("sweep", rateLimits{RequestsPerMinute: 1})
+		require.NoError(t, err)
+		require.Len(t, l.clients, 1)
+	})
+}
+
+func TestRateLimitRoutes(t *testing.T) {
+	setenv(t, "OLLAMA_MODELS", t.TempDir())
+
+	s := &Server{
+		apiKeys: &apiKeys{Keys: []apiKey{
+			{Key: "limited", Models: []string{"*"}, Operations: []operation{"*"}, Limits: &rateLimits{RequestsPerMinute: 1}},
+			{Key: "default", Models: []string{"*"}, Operations: []operation{"*"}},
+		}},
+		limiter: newRateLimiter(rateLimits{RequestsPerMinute: 2}),
+	}
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	post := func(t *testing.T, path, key, body string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+key)
+
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("key limits", func(t *testing.T) {
+		resp := post(t, "/api/generate", "limited", `{}`)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = post(t, "/api/generate", "limited", `{}`)
+		require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		require.Equal(t, "60", resp.Header.Get("Retry-After"))
+
+		var body struct {
+			Error string `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.Equal(t, "rate limit exceeded: 1 requests per minute", body.Error)
+	})
+
+	t.Run("openai error", func(t *testing.T) {
+		chat := `{"model": "missing", "messages": [{"role": "user", "content": "hi"}]}`
+		for range 2 {
+			resp := post(t, "/v1/chat/completions", "default", chat)
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		}
+
+		resp := post(t, "/v1/chat/completions", "default", chat)
+		require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		require.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+		var body struct {
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.Equal(t, "rate_limit_error", body.Error.Type)
+		require.Equal(t, "rate limit exceeded: 2 requests per minute", body.Error.Message)
+	})
+
+	t.Run("other routes", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/tags", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer limited")
+
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+func TestTokenUsage(t *testing.T) {
+	setenv(t, "OLLAMA_MODELS", t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	scenario := newScenario(t, ctx, "ollama-model", 0)
+
+	commands, err := parser.Parse(strings.NewReader("FROM " + scenario.req.model.ModelPath))
+	require.NoError(t, err)
+	require.NoError(t, CreateModel(ctx, "test", "", "", commands, func(api.ProgressResponse) {}))
+
+	system := gpu.GpuInfo{}
+	system.TotalMemory = 16 * format.GibiByte
+	system.FreeMemory = system.TotalMemory
+
+	s := &Server{
+		sched:   InitScheduler(ctx),
+		limiter: newRateLimiter(rateLimits{TokensPerDay: 1000}),
+	}
+	s.sched.simulate(gpu.NewSimulated(nil, system))
+	s.sched.Run(ctx)
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	tokens := func() int {
+		s.limiter.mu.Lock()
+		defer s.limiter.mu.Unlock()
+
+		var n int
+		for _, u := range s.limiter.clients {
+			n += u.tokens
+		}
+
+		return n
+	}
+
+	t.Run("client disconnects", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/generate", strings.NewReader(`{"model": "test", "prompt": "hi", "raw": true}`))
+		require.NoError(t, err)
+
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// read a couple of tokens and hang up
+		scanner := bufio.NewScanner(resp.Body)
+		for range 2 {
+			require.True(t, scanner.Scan())
+		}
+		cancel()
+
+		require.Eventually(t, func() bool { return tokens() >= 2 }, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestRateLimitSocket(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("peer credentials are only supported on linux and darwin")
+	}
+
+	// socket paths are limited to about 100 bytes, which t.TempDir can exceed
+	dir, err := os.MkdirTemp("", "ollama")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "ollama.sock"))
+	require.NoError(t, err)
+
+	s := &Server{limiter: newRateLimiter(rateLimits{RequestsPerMinute: 1})}
+
+	r := gin.New()
+	r.GET("/", s.rateLimit(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(rateLimitClientContextKey))
+	})
+
+	srv := &http.Server{Handler: r, ConnContext: connContext}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", ln.Addr().String())
+		},
+	}}
+
+	get := func() *http.Response {
+		t.Helper()
+
+		resp, err := client.Get("http://localhost/")
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("uid:%d", os.Getuid()), string(body))
+
+	resp = get()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
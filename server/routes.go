@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,14 +18,18 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/exp/slices"
 
+	"github.com/ollama/ollama/anthropic"
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/openai"
@@ -36,8 +41,17 @@ import (
 var mode string = gin.DebugMode
 
 type Server struct {
-	addr  net.Addr
 	sched *Scheduler
+
+	// apiKeys are required to access the API if set
+	apiKeys *apiKeys
+
+	// limiter limits each client's inference requests if set
+	limiter *rateLimiter
+
+	// draining is set once the server is shutting down
+	draining atomic.Bool
+	inflight atomic.Int64
 }
 
 func init() {
@@ -52,8 +66,6 @@ func init() {
 	gin.SetMode(mode)
 }
 
-var defaultSessionDuration = 5 * time.Minute
-
 func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, error) {
 	opts := api.DefaultOptions()
 	if err := opts.FromMap(model.Options); err != nil {
@@ -93,14 +105,22 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	case req.Model == "":
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
 		return
-	case len(req.Format) > 0 && req.Format != "json":
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be json"})
-		return
 	case req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0):
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
 		return
 	}
 
+	grammar, err := llm.Grammar(req.Format)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Logprobs < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "logprobs must not be negative"})
+		return
+	}
+
 	for _, img := range req.Images {
 		if !isSupportedImageType(img) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported image format"})
@@ -108,45 +128,24 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 	}
 
-	model, err := GetModel(req.Model)
+	priority, err := parsePriority(req.Priority)
 	if err != nil {
-		var pErr *fs.PathError
-		if errors.As(err, &pErr) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found, try pulling it first", req.Model)})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if model.IsEmbedding() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "embedding models do not support generate"})
+	model, opts, ok := requestModel(c, req.Model, req.Options)
+	if !ok {
 		return
 	}
 
-	opts, err := modelOptions(model, req.Options)
-	if err != nil {
-		if errors.Is(err, api.ErrInvalidOpts) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if model.IsEmbedding() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "embedding models do not support generate"})
 		return
 	}
 
-	var sessionDuration time.Duration
-	if req.KeepAlive == nil {
-		sessionDuration = getDefaultSessionDuration()
-	} else {
-		sessionDuration = req.KeepAlive.Duration
-	}
-
-	rCh, eCh := s.sched.GetRunner(c.Request.Context(), model, opts, sessionDuration)
-	var runner *runnerRef
-	select {
-	case runner = <-rCh:
-	case err = <-eCh:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	runner, ok := s.scheduleRunner(c, model, opts, req.KeepAlive, priority)
+	if !ok {
 		return
 	}
 
@@ -177,9 +176,9 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			req.System = model.System
 		}
 
-		slog.Debug("generate handler", "prompt", req.Prompt)
-		slog.Debug("generate handler", "template", req.Template)
-		slog.Debug("generate handler", "system", req.System)
+		slog.DebugContext(c.Request.Context(), "generate handler", "prompt", req.Prompt)
+		slog.DebugContext(c.Request.Context(), "generate handler", "template", req.Template)
+		slog.DebugContext(c.Request.Context(), "generate handler", "system", req.System)
 
 		var sb strings.Builder
 		for i := range req.Images {
@@ -210,14 +209,29 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		prompt = sb.String()
 	}
 
-	slog.Debug("generate handler", "prompt", prompt)
+	slog.DebugContext(c.Request.Context(), "generate handler", "prompt", prompt)
+
+	// the goroutine may outlive the handler if the client disconnects, so it
+	// mustn't use c
+	ctx := c.Request.Context()
+	client := c.GetString(rateLimitClientContextKey)
 
 	ch := make(chan any)
 	var generated strings.Builder
 	go func() {
 		defer close(ch)
 
+		// count the tokens generated even if the request is cancelled
+		var evalCount int
+		defer func() { s.recordTokenUsage(client, evalCount) }()
+
 		fn := func(r llm.CompletionResponse) {
+			if r.Done {
+				evalCount = r.EvalCount
+			} else {
+				evalCount++
+			}
+
 			// Build up the full response
 			if _, err := generated.WriteString(r.Content); err != nil {
 				ch <- gin.H{"error": err.Error()}
@@ -229,6 +243,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				CreatedAt: time.Now().UTC(),
 				Done:      r.Done,
 				Response:  r.Content,
+				Logprobs:  r.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
@@ -240,16 +255,17 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			if r.Done {
 				resp.TotalDuration = time.Since(checkpointStart)
 				resp.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				recordTokenMetrics(model.ShortName, resp.Metrics)
 
 				if !req.Raw {
 					p, err := Prompt(req.Template, req.System, req.Prompt, generated.String(), false)
 					if err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+						ch <- gin.H{"error": err.Error()}
 						return
 					}
 
 					// TODO (jmorganca): encode() should not strip special tokens
-					tokens, err := runner.llama.Tokenize(c.Request.Context(), p)
+					tokens, err := runner.llama.Tokenize(ctx, p)
 					if err != nil {
 						ch <- gin.H{"error": err.Error()}
 						return
@@ -259,7 +275,10 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				}
 			}
 
-			ch <- resp
+			select {
+			case ch <- resp:
+			case <-ctx.Done():
+			}
 		}
 
 		var images []llm.ImageData
@@ -272,13 +291,18 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 		// Start prediction
 		req := llm.CompletionRequest{
-			Prompt:  prompt,
-			Format:  req.Format,
-			Images:  images,
-			Options: opts,
+			Prompt:   prompt,
+			Format:   req.Format,
+			Grammar:  grammar,
+			Images:   images,
+			Options:  opts,
+			Logprobs: req.Logprobs,
 		}
-		if err := runner.llama.Completion(c.Request.Context(), req, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		if err := runner.llama.Completion(ctx, req, fn); err != nil {
+			select {
+			case ch <- gin.H{"error": err.Error()}:
+			case <-ctx.Done():
+			}
 		}
 	}()
 
@@ -286,10 +310,12 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		// Accumulate responses into the final response
 		var final api.GenerateResponse
 		var sb strings.Builder
+		var logprobs []api.Logprob
 		for resp := range ch {
 			switch r := resp.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(r.Response)
+				logprobs = append(logprobs, r.Logprobs...)
 				final = r
 			case gin.H:
 				if errorMsg, ok := r["error"].(string); ok {
@@ -306,6 +332,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		final.Response = sb.String()
+		final.Logprobs = logprobs
 		c.JSON(http.StatusOK, final)
 		return
 	}
@@ -313,30 +340,17 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
-func getDefaultSessionDuration() time.Duration {
-	if t, exists := os.LookupEnv("OLLAMA_KEEP_ALIVE"); exists {
-		v, err := strconv.Atoi(t)
-		if err != nil {
-			d, err := time.ParseDuration(t)
-			if err != nil {
-				return defaultSessionDuration
-			}
-
-			if d < 0 {
-				return time.Duration(math.MaxInt64)
-			}
-
-			return d
-		}
-
-		d := time.Duration(v) * time.Second
-		if d < 0 {
-			return time.Duration(math.MaxInt64)
-		}
-		return d
+func handleScheduleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errMaxQueue), errors.Is(err, errQueueTimeout), errors.Is(err, errModelsPinned), errors.Is(err, errSystemMemory):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	}
+}
 
-	return defaultSessionDuration
+func getDefaultSessionDuration() time.Duration {
+	return envconfig.Current().KeepAlive
 }
 
 func (s *Server) EmbeddingsHandler(c *gin.Context) {
@@ -356,62 +370,126 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	model, err := GetModel(req.Model)
-	if err != nil {
-		var pErr *fs.PathError
-		if errors.As(err, &pErr) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found, try pulling it first", req.Model)})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if req.Prompt != "" && len(req.Input) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompt and input cannot both be set"})
 		return
 	}
 
-	opts, err := modelOptions(model, req.Options)
-	if err != nil {
-		if errors.Is(err, api.ErrInvalidOpts) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	for i, text := range req.Input {
+		if text == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("input %d is empty", i)})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+
+	priority, err := parsePriority(req.Priority)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var sessionDuration time.Duration
-	if req.KeepAlive == nil {
-		sessionDuration = getDefaultSessionDuration()
-	} else {
-		sessionDuration = req.KeepAlive.Duration
+	model, opts, ok := requestModel(c, req.Model, req.Options)
+	if !ok {
+		return
 	}
 
-	rCh, eCh := s.sched.GetRunner(c.Request.Context(), model, opts, sessionDuration)
-	var runner *runnerRef
-	select {
-	case runner = <-rCh:
-	case err = <-eCh:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	runner, ok := s.scheduleRunner(c, model, opts, req.KeepAlive, priority)
+	if !ok {
 		return
 	}
 
+	input := req.Input
+	if req.Prompt != "" {
+		input = []string{req.Prompt}
+	}
+
 	// an empty request loads the model
-	if req.Prompt == "" {
+	if len(input) == 0 {
 		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
 		return
 	}
 
-	embedding, err := runner.llama.Embedding(c.Request.Context(), req.Prompt)
+	truncate := true
+	if req.Truncate != nil {
+		truncate = *req.Truncate
+	}
+
+	var count int
+	for i, text := range input {
+		tokens, err := runner.llama.Tokenize(c.Request.Context(), text)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(tokens) > opts.NumCtx && !truncate {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("input %d length of %d tokens exceeds maximum context length of %d", i, len(tokens), opts.NumCtx)})
+			return
+		}
+
+		// the runner tokenizes the truncated text again, which doesn't always
+		// give the same tokens, so shorten it until it fits
+		for n := opts.NumCtx; len(tokens) > opts.NumCtx; n = max(n-(len(tokens)-opts.NumCtx), 0) {
+			input[i], err = runner.llama.Detokenize(c.Request.Context(), tokens[:n])
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			tokens, err = runner.llama.Tokenize(c.Request.Context(), input[i])
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		count += len(tokens)
+	}
+
+	embeddings, err := runner.llama.Embedding(c.Request.Context(), input)
 	if err != nil {
-		slog.Info(fmt.Sprintf("embedding generation failed: %v", err))
+		slog.InfoContext(c.Request.Context(), fmt.Sprintf("embedding generation failed: %v", err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
 		return
 	}
 
-	resp := api.EmbeddingResponse{
-		Embedding: embedding,
+	if req.Normalize {
+		for i, e := range embeddings {
+			embeddings[i] = normalize(e)
+		}
+	}
+
+	recordTokenMetrics(model.ShortName, api.Metrics{PromptEvalCount: count})
+
+	resp := api.EmbeddingResponse{PromptEvalCount: count}
+	if req.Prompt != "" {
+		resp.Embedding = embeddings[0]
+	} else {
+		resp.Embeddings = embeddings
 	}
+
 	c.JSON(http.StatusOK, resp)
 }
 
+// normalize scales an embedding to unit length
+func normalize(vec []float64) []float64 {
+	var sum float64
+	for _, v := range vec {
+		sum += v * v
+	}
+
+	norm := math.Sqrt(sum)
+	if norm == 0 {
+		return vec
+	}
+
+	for i := range vec {
+		vec[i] /= norm
+	}
+
+	return vec
+}
+
 func (s *Server) PullModelHandler(c *gin.Context) {
 	var req api.PullRequest
 	err := c.ShouldBindJSON(&req)
@@ -560,6 +638,16 @@ func (s *Server) CreateModelHandler(c *gin.Context) {
 		return
 	}
 
+	// keys may only create models from the models they're allowed to use
+	if key := requestAPIKey(c); key != nil {
+		for _, name := range modelReferences(commands, filepath.Dir(req.Path)) {
+			if !key.allowsModel(name) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key is not allowed to use model '%s'", name)})
+				return
+			}
+		}
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
@@ -698,6 +786,15 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		Messages: msgs,
 	}
 
+	manifestPath, err := ParseModelPath(req.Model).GetManifestPath()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi, err := os.Stat(manifestPath); err == nil {
+		resp.ModifiedAt = fi.ModTime()
+	}
+
 	var params []string
 	cs := 30
 	for k, v := range model.Options {
@@ -773,6 +870,10 @@ func (s *Server) ListModelsHandler(c *gin.Context) {
 				return nil
 			}
 
+			if key := requestAPIKey(c); key != nil && !key.allowsModel(resp.Name) {
+				return nil
+			}
+
 			resp.ModifiedAt = info.ModTime()
 			models = append(models, resp)
 		}
@@ -788,6 +889,300 @@ func (s *Server) ListModelsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.ListResponse{Models: models})
 }
 
+// ConfigHandler returns the server's effective settings and where each was set
+func (s *Server) ConfigHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"settings": envconfig.Current().Settings()})
+}
+
+func (s *Server) ProcessHandler(c *gin.Context) {
+	models := []api.ProcessModelResponse{}
+
+	key := requestAPIKey(c)
+
+	// runner locks must not be taken while holding the scheduler's loaded lock
+	for _, runner := range s.sched.loadedRunners() {
+		runner.refMu.Lock()
+		if runner.modelInfo != nil && (key == nil || key.allowsModel(runner.modelInfo.ShortName)) {
+			models = append(models, processModelResponse(runner))
+		}
+		runner.refMu.Unlock()
+	}
+
+	// most recently used models first
+	slices.SortStableFunc(models, func(i, j api.ProcessModelResponse) int {
+		return j.ExpiresAt.Compare(i.ExpiresAt)
+	})
+
+	var queue []api.QueuedRequest
+	for i, req := range s.sched.queuedRequests() {
+		if key != nil && !key.allowsModel(req.model.ShortName) {
+			continue
+		}
+
+		queue = append(queue, api.QueuedRequest{
+			Model:    req.model.ShortName,
+			Priority: req.priority.String(),
+			Position: i,
+			QueuedAt: req.queuedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, api.ProcessResponse{Models: models, Queue: queue})
+}
+
+// processModelResponse describes a loaded runner. The runner's refMu must be held.
+func processModelResponse(runner *runnerRef) api.ProcessModelResponse {
+	m := runner.modelInfo
+	resp := api.ProcessModelResponse{
+		Model:  m.ShortName,
+		Name:   m.ShortName,
+		Size:   int64(runner.estimatedTotal),
+		Digest: m.Digest,
+		Details: api.ModelDetails{
+			ParentModel:       m.ParentModel,
+			Format:            m.Config.ModelFormat,
+			Family:            m.Config.ModelFamily,
+			Families:          m.Config.ModelFamilies,
+			ParameterSize:     m.Config.ModelType,
+			QuantizationLevel: m.Config.FileType,
+		},
+		ExpiresAt:      runner.expiresAt,
+		SizeVRAM:       int64(runner.estimatedVRAM),
+		ActiveRequests: int(runner.refCount),
+		Pinned:         runner.pinned,
+	}
+
+	for _, g := range runner.gpus {
+		if g.Library != "cpu" {
+			resp.GPUs = append(resp.GPUs, g.ID)
+		}
+	}
+
+	return resp
+}
+
+func (s *Server) LoadHandler(c *gin.Context) {
+	var req api.LoadRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	model, opts, ok := requestModel(c, req.Model, req.Options)
+	if !ok {
+		return
+	}
+
+	// the runner is released when this request completes, starting its keep alive timer
+	runner, ok := s.scheduleRunner(c, model, opts, req.KeepAlive, priorityInteractive)
+	if !ok {
+		return
+	}
+
+	runner.refMu.Lock()
+	resp := processModelResponse(runner)
+	runner.refMu.Unlock()
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// requestModel gets a model and the options a request runs it with. If the
+// model can't be found or the options are invalid, an error response is
+// written and ok is false.
+func requestModel(c *gin.Context, name string, requestOpts map[string]interface{}) (model *Model, opts api.Options, ok bool) {
+	model, err := GetModel(name)
+	if err != nil {
+		var pErr *fs.PathError
+		if errors.As(err, &pErr) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found, try pulling it first", name)})
+			return nil, opts, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, opts, false
+	}
+
+	opts, err = modelOptions(model, requestOpts)
+	if err != nil {
+		if errors.Is(err, api.ErrInvalidOpts) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, opts, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, opts, false
+	}
+
+	return model, opts, true
+}
+
+// scheduleRunner gets a runner for a model from the scheduler, loading it if
+// needed, and sets the X-Queue-Position header to the position the request
+// was queued at. The runner is released when the request context is done.
+// If the runner can't be scheduled an error response is written and ok is
+// false.
+func (s *Server) scheduleRunner(c *gin.Context, model *Model, opts api.Options, keepAlive *api.Duration, priority requestPriority) (runner *runnerRef, ok bool) {
+	sessionDuration := getDefaultSessionDuration()
+	if keepAlive != nil {
+		sessionDuration = keepAlive.Duration
+	}
+
+	rCh, eCh, position := s.sched.GetRunner(c.Request.Context(), model, opts, sessionDuration, priority)
+	c.Header("X-Queue-Position", strconv.Itoa(position))
+	select {
+	case runner = <-rCh:
+		return runner, true
+	case err := <-eCh:
+		handleScheduleError(c, err)
+		return nil, false
+	}
+}
+
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch {
+	case req.Model == "":
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	case req.Prompt != "" && len(req.Messages) > 0:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompt and messages cannot both be set"})
+		return
+	}
+
+	model, opts, ok := requestModel(c, req.Model, req.Options)
+	if !ok {
+		return
+	}
+
+	runner, ok := s.scheduleRunner(c, model, opts, req.KeepAlive, priorityInteractive)
+	if !ok {
+		return
+	}
+
+	prompt := req.Prompt
+	if len(req.Messages) > 0 {
+		// render the prompt the same way the chat handler does
+		messages := req.Messages
+		if messages[0].Role != "system" {
+			messages = append([]api.Message{{Role: "system", Content: model.System}}, messages...)
+		}
+
+		prompt, err = chatPrompt(c.Request.Context(), runner, model.Template, messages, req.Tools, runner.Options.NumCtx)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	tokens := []int{}
+	if prompt != "" {
+		tokens, err = runner.llama.Tokenize(c.Request.Context(), prompt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Tokens: tokens})
+}
+
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	model, opts, ok := requestModel(c, req.Model, req.Options)
+	if !ok {
+		return
+	}
+
+	runner, ok := s.scheduleRunner(c, model, opts, req.KeepAlive, priorityInteractive)
+	if !ok {
+		return
+	}
+
+	var content string
+	if len(req.Tokens) > 0 {
+		content, err = runner.llama.Detokenize(c.Request.Context(), req.Tokens)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Content: content})
+}
+
+func (s *Server) UnloadHandler(c *gin.Context) {
+	var req api.UnloadRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	model, err := GetModel(req.Model)
+	if err != nil {
+		var pErr *fs.PathError
+		if errors.As(err, &pErr) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.sched.Unload(c.Request.Context(), model); err != nil {
+		if errors.Is(err, errModelNotLoaded) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' is not loaded", req.Model)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
 func (s *Server) CopyModelHandler(c *gin.Context) {
 	var r api.CopyRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
@@ -925,8 +1320,24 @@ func allowedHost(host string) bool {
 	return false
 }
 
-func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
+// listenerAddrContextKey is the context key of the address of the listener
+// that accepted a request's connection
+type listenerAddrContextKey struct{}
+
+// listenerContext is the base context of connections accepted by ln, so
+// requests can tell which listener they came from
+func listenerContext(ln net.Listener) context.Context {
+	return context.WithValue(context.Background(), listenerAddrContextKey{}, ln.Addr())
+}
+
+// allowedHostsMiddleware rejects requests to listeners on loopback addresses
+// and Unix sockets with Host headers that aren't local, preventing DNS
+// rebinding. Listeners on other addresses are already reachable by anyone.
+func allowedHostsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// the connection's local address is loopback for local clients
+		// even on listeners bound to all addresses, so use the listener's
+		addr, _ := c.Request.Context().Value(listenerAddrContextKey{}).(net.Addr)
 		if addr == nil {
 			c.Next()
 			return
@@ -959,16 +1370,16 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 }
 
 func (s *Server) GenerateRoutes() http.Handler {
-	config := cors.DefaultConfig()
-	config.AllowWildcard = true
-	config.AllowBrowserExtensions = true
+	cfg := envconfig.Current()
 
-	if allowedOrigins := strings.Trim(os.Getenv("OLLAMA_ORIGINS"), "\"'"); allowedOrigins != "" {
-		config.AllowOrigins = strings.Split(allowedOrigins, ",")
-	}
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowWildcard = true
+	corsConfig.AllowBrowserExtensions = true
+
+	corsConfig.AllowOrigins = slices.Clone(cfg.Origins)
 
 	for _, allowOrigin := range defaultAllowOrigins {
-		config.AllowOrigins = append(config.AllowOrigins,
+		corsConfig.AllowOrigins = append(corsConfig.AllowOrigins,
 			fmt.Sprintf("http://%s", allowOrigin),
 			fmt.Sprintf("https://%s", allowOrigin),
 			fmt.Sprintf("http://%s:*", allowOrigin),
@@ -978,24 +1389,39 @@ func (s *Server) GenerateRoutes() http.Handler {
 
 	r := gin.Default()
 	r.Use(
-		cors.New(config),
-		allowedHostsMiddleware(s.addr),
+		requestIDMiddleware(),
+		cors.New(corsConfig),
+		allowedHostsMiddleware(),
+		metricsMiddleware(),
+		s.drainMiddleware(),
+		s.authMiddleware(),
 	)
 
-	r.POST("/api/pull", s.PullModelHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embeddings", s.EmbeddingsHandler)
-	r.POST("/api/create", s.CreateModelHandler)
-	r.POST("/api/push", s.PushModelHandler)
-	r.POST("/api/copy", s.CopyModelHandler)
-	r.DELETE("/api/delete", s.DeleteModelHandler)
-	r.POST("/api/show", s.ShowModelHandler)
-	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
-	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
+	r.POST("/api/pull", authorize(opPull), s.PullModelHandler)
+	r.POST("/api/generate", authorize(opInference), s.rateLimit(), s.GenerateHandler)
+	r.POST("/api/chat", authorize(opInference), s.rateLimit(), s.ChatHandler)
+	r.GET("/api/chat/ws", authorize(opInference), s.chatSocketHandler(r))
+	r.POST("/api/embeddings", authorize(opInference), s.rateLimit(), s.EmbeddingsHandler)
+	r.POST("/api/create", authorize(opCreate), s.CreateModelHandler)
+	r.POST("/api/push", authorize(opPush), s.PushModelHandler)
+	r.POST("/api/copy", authorize(opCreate), s.CopyModelHandler)
+	r.DELETE("/api/delete", authorize(opDelete), s.DeleteModelHandler)
+	r.POST("/api/show", authorize(opRead), s.ShowModelHandler)
+	r.POST("/api/load", authorize(opInference), s.rateLimit(), s.LoadHandler)
+	r.POST("/api/unload", authorize(opInference), s.rateLimit(), s.UnloadHandler)
+	r.POST("/api/tokenize", authorize(opInference), s.rateLimit(), s.TokenizeHandler)
+	r.POST("/api/detokenize", authorize(opInference), s.rateLimit(), s.DetokenizeHandler)
+	r.POST("/api/blobs/:digest", authorize(opCreate), s.CreateBlobHandler)
+	r.HEAD("/api/blobs/:digest", authorize(opCreate), s.HeadBlobHandler)
+	r.GET("/api/config", authorize(opAdmin), s.ConfigHandler)
 
 	// Compatibility endpoints
-	r.POST("/v1/chat/completions", openai.Middleware(), s.ChatHandler)
+	r.POST("/v1/chat/completions", authorize(opInference), openai.ChatMiddleware(), s.rateLimit(), s.ChatHandler)
+	r.POST("/v1/completions", authorize(opInference), openai.CompletionsMiddleware(), s.rateLimit(), s.GenerateHandler)
+	r.POST("/v1/embeddings", authorize(opInference), openai.EmbeddingsMiddleware(), s.rateLimit(), s.EmbeddingsHandler)
+	r.GET("/v1/models", openai.ListMiddleware(), s.ListModelsHandler)
+	r.GET("/v1/models/*model", authorize(opRead), openai.RetrieveMiddleware(), s.ShowModelHandler)
+	r.POST("/v1/messages", authorize(opInference), anthropic.MessagesMiddleware(), s.rateLimit(), s.ChatHandler)
 
 	for _, method := range []string{http.MethodGet, http.MethodHead} {
 		r.Handle(method, "/", func(c *gin.Context) {
@@ -1003,6 +1429,8 @@ func (s *Server) GenerateRoutes() http.Handler {
 		})
 
 		r.Handle(method, "/api/tags", s.ListModelsHandler)
+		r.Handle(method, "/api/ps", s.ProcessHandler)
+		r.Handle(method, "/metrics", authorize(opAdmin), s.MetricsHandler)
 		r.Handle(method, "/api/version", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"version": version.Version})
 		})
@@ -1011,27 +1439,13 @@ func (s *Server) GenerateRoutes() http.Handler {
 	return r
 }
 
-func Serve(ln net.Listener) error {
-	level := slog.LevelInfo
-	if debug := os.Getenv("OLLAMA_DEBUG"); debug != "" {
-		level = slog.LevelDebug
+// Serve serves the API on each of lns until the server is shut down
+func Serve(lns []net.Listener) error {
+	cfg := envconfig.Current()
+	if err := initLogging(cfg); err != nil {
+		return err
 	}
 
-	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level:     level,
-		AddSource: true,
-		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
-			if attr.Key == slog.SourceKey {
-				source := attr.Value.Any().(*slog.Source)
-				source.File = filepath.Base(source.File)
-			}
-
-			return attr
-		},
-	})
-
-	slog.SetDefault(slog.New(handler))
-
 	blobsDir, err := GetBlobsPath("")
 	if err != nil {
 		return err
@@ -1040,7 +1454,7 @@ func Serve(ln net.Listener) error {
 		return err
 	}
 
-	if noprune := os.Getenv("OLLAMA_NOPRUNE"); noprune == "" {
+	if !cfg.NoPrune {
 		// clean up unused layers and manifests
 		if err := PruneLayers(); err != nil {
 			return err
@@ -1056,38 +1470,137 @@ func Serve(ln net.Listener) error {
 		}
 	}
 
+	var keys *apiKeys
+	if cfg.APIKeysFile != "" {
+		keys, err = loadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return fmt.Errorf("failed to load API keys: %w", err)
+		}
+
+		slog.Info("API key authentication enabled", "keys", len(keys.Keys))
+	}
+
+	certs, err := tlsFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	if certs != nil {
+		// Unix sockets are protected by their file permissions instead
+		for i, ln := range lns {
+			if ln.Addr().Network() == "tcp" {
+				lns[i] = tls.NewListener(ln, certs.config())
+			}
+		}
+
+		slog.Info("TLS enabled", "cert", certs.certFile, "client_auth", certs.clientCAFile != "")
+	}
+
 	ctx, done := context.WithCancel(context.Background())
 	sched := InitScheduler(ctx)
-	s := &Server{addr: ln.Addr(), sched: sched}
+
+	var sim *gpu.Simulated
+	if cfg.SimulatedGPUs != "" {
+		sim, err = gpu.LoadSimulated(cfg.SimulatedGPUs)
+		if err != nil {
+			done()
+			return fmt.Errorf("failed to load simulated GPUs: %w", err)
+		}
+
+		sched.simulate(sim)
+		slog.Warn("using simulated GPUs, models are loaded on a stub runner and won't generate real responses", "file", cfg.SimulatedGPUs)
+	}
+	s := &Server{sched: sched, apiKeys: keys, limiter: newRateLimiter(rateLimitsFromConfig(cfg))}
 	r := s.GenerateRoutes()
 
-	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
+	for _, ln := range lns {
+		slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
+	}
 	srvr := &http.Server{
-		Handler: r,
+		Handler:     r,
+		BaseContext: listenerContext,
+		ConnContext: connContext,
 	}
 
-	// listen for a ctrl+c and stop any loaded llm
+	// listen for a ctrl+c, let requests in progress finish, then stop any loaded llm
+	shutdownTimeout := cfg.ShutdownTimeout
+	shutdown := make(chan struct{})
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-signals
+		slog.Info("shutting down, waiting for requests in progress to finish", "timeout", shutdownTimeout)
+
+		go func() {
+			// a second signal stops the server immediately
+			<-signals
+			slog.Warn("shutting down immediately")
+			sched.unloadAllRunners()
+			gpu.Cleanup()
+			os.Exit(1)
+		}()
+
+		s.drain(shutdownTimeout)
 		done()
 		sched.unloadAllRunners()
+
+		// requests still in progress fail once their runners are closed
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srvr.Shutdown(shutdownCtx); err != nil {
+			srvr.Close() //nolint:errcheck
+		}
+
 		gpu.Cleanup()
-		os.Exit(0)
+		close(shutdown)
 	}()
 
-	if err := llm.Init(); err != nil {
-		return fmt.Errorf("unable to initialize llm library %w", err)
+	if certs != nil {
+		// reload certificates on SIGHUP without interrupting loaded models
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go func() {
+			for range hangups {
+				if err := certs.reload(); err != nil {
+					slog.Error("failed to reload TLS certificates, continuing with previous certificates", "error", err)
+					continue
+				}
+
+				slog.Info("reloaded TLS certificates", "cert", certs.certFile)
+			}
+		}()
+	}
+
+	if sim == nil {
+		if err := llm.Init(); err != nil {
+			return fmt.Errorf("unable to initialize llm library %w", err)
+		}
 	}
 
 	s.sched.Run(ctx)
 
-	// At startup we retrieve GPU information so we can get log messages before loading a model
-	// This will log warnings to the log in case we have problems with detected GPUs
-	_ = gpu.GetGPUInfo()
+	if sim == nil {
+		// At startup we retrieve GPU information so we can get log messages before loading a model
+		// This will log warnings to the log in case we have problems with detected GPUs
+		_ = gpu.GetGPUInfo()
+	}
+
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() {
+			errs <- srvr.Serve(ln)
+		}()
+	}
 
-	return srvr.Serve(ln)
+	for range lns {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			srvr.Close() //nolint:errcheck
+			return err
+		}
+	}
+
+	<-shutdown
+	return nil
 }
 
 func waitForStream(c *gin.Context, ch chan interface{}) {
@@ -1115,7 +1628,14 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response"})
 }
 
+// streamResponse writes each value sent on ch as newline delimited JSON, or
+// as Server-Sent Events if the client accepts text/event-stream
 func streamResponse(c *gin.Context, ch chan any) {
+	if acceptsEventStream(c) {
+		streamEvents(c, ch)
+		return
+	}
+
 	c.Header("Content-Type", "application/x-ndjson")
 	c.Stream(func(w io.Writer) bool {
 		val, ok := <-ch
@@ -1125,14 +1645,14 @@ func streamResponse(c *gin.Context, ch chan any) {
 
 		bts, err := json.Marshal(val)
 		if err != nil {
-			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
+			slog.InfoContext(c.Request.Context(), fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
 			return false
 		}
 
 		// Delineate chunks with new-line delimiter
 		bts = append(bts, '\n')
 		if _, err := w.Write(bts); err != nil {
-			slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
+			slog.InfoContext(c.Request.Context(), fmt.Sprintf("streamResponse: w.Write failed with %s", err))
 			return false
 		}
 
@@ -1140,13 +1660,70 @@ func streamResponse(c *gin.Context, ch chan any) {
 	})
 }
 
+func acceptsEventStream(c *gin.Context) bool {
+	for _, accept := range c.Request.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.TrimSpace(mediaType) == sse.ContentType {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// streamEvents writes each value sent on ch as a Server-Sent Event with an
+// increasing ID. The final response, which includes the metrics or the
+// success status, is a "done" event, and errors are "error" events.
+func streamEvents(c *gin.Context, ch chan any) {
+	c.Header("Cache-Control", "no-cache")
+	// stop proxies such as nginx from buffering events
+	c.Header("X-Accel-Buffering", "no")
+
+	var id int
+	c.Stream(func(w io.Writer) bool {
+		val, ok := <-ch
+		if !ok {
+			return false
+		}
+
+		id++
+		c.Render(-1, sse.Event{Id: strconv.Itoa(id), Event: eventName(val), Data: val})
+		return true
+	})
+}
+
+func eventName(val any) string {
+	switch r := val.(type) {
+	case api.GenerateResponse:
+		if r.Done {
+			return "done"
+		}
+	case api.ChatResponse:
+		if r.Done {
+			return "done"
+		}
+	case api.ProgressResponse:
+		if r.Status == "success" {
+			return "done"
+		}
+	case gin.H:
+		if _, ok := r["error"]; ok {
+			return "error"
+		}
+	}
+
+	return ""
+}
+
 // ChatPrompt builds up a prompt from a series of messages for the currently `loaded` model
-func chatPrompt(ctx context.Context, runner *runnerRef, template string, messages []api.Message, numCtx int) (string, error) {
+func chatPrompt(ctx context.Context, runner *runnerRef, template string, messages []api.Message, tools api.Tools, numCtx int) (string, error) {
 	encode := func(s string) ([]int, error) {
 		return runner.llama.Tokenize(ctx, s)
 	}
 
-	prompt, err := ChatPrompt(template, messages, numCtx, encode)
+	prompt, err := ChatPrompt(template, messages, tools, numCtx, encode)
 	if err != nil {
 		return "", err
 	}
@@ -1173,50 +1750,37 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	case req.Model == "":
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
 		return
-	case len(req.Format) > 0 && req.Format != "json":
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be json"})
-		return
 	}
 
-	model, err := GetModel(req.Model)
+	grammar, err := llm.Grammar(req.Format)
 	if err != nil {
-		var pErr *fs.PathError
-		if errors.As(err, &pErr) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found, try pulling it first", req.Model)})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if model.IsEmbedding() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "embedding models do not support chat"})
+	if req.Logprobs < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "logprobs must not be negative"})
 		return
 	}
 
-	opts, err := modelOptions(model, req.Options)
+	priority, err := parsePriority(req.Priority)
 	if err != nil {
-		if errors.Is(err, api.ErrInvalidOpts) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var sessionDuration time.Duration
-	if req.KeepAlive == nil {
-		sessionDuration = getDefaultSessionDuration()
-	} else {
-		sessionDuration = req.KeepAlive.Duration
+	model, opts, ok := requestModel(c, req.Model, req.Options)
+	if !ok {
+		return
 	}
 
-	rCh, eCh := s.sched.GetRunner(c.Request.Context(), model, opts, sessionDuration)
-	var runner *runnerRef
-	select {
-	case runner = <-rCh:
-	case err = <-eCh:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if model.IsEmbedding() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "embedding models do not support chat"})
+		return
+	}
+
+	runner, ok := s.scheduleRunner(c, model, opts, req.KeepAlive, priority)
+	if !ok {
 		return
 	}
 
@@ -1232,7 +1796,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		}, req.Messages...)
 	}
 
-	prompt, err := chatPrompt(c.Request.Context(), runner, model.Template, req.Messages, opts.NumCtx)
+	prompt, err := chatPrompt(c.Request.Context(), runner, model.Template, req.Messages, req.Tools, opts.NumCtx)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -1267,19 +1831,54 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		}
 	}
 
-	slog.Debug("chat handler", "prompt", prompt, "images", len(images))
+	slog.DebugContext(c.Request.Context(), "chat handler", "prompt", prompt, "images", len(images))
 
-	ch := make(chan any)
+	// the goroutine may outlive the handler if the client disconnects, so it
+	// mustn't use c
+	ctx := c.Request.Context()
+	client := c.GetString(rateLimitClientContextKey)
 
+	ch := make(chan any)
+	var generated strings.Builder
 	go func() {
 		defer close(ch)
 
+		// count the tokens generated even if the request is cancelled
+		var evalCount int
+		defer func() { s.recordTokenUsage(client, evalCount) }()
+
+		// content that may be the start of a tool call is held back until
+		// it's clear whether it is one, so calls aren't streamed as content
+		var held strings.Builder
+		var heldLogprobs []api.Logprob
+
 		fn := func(r llm.CompletionResponse) {
+			if r.Done {
+				evalCount = r.EvalCount
+			} else {
+				evalCount++
+			}
+
+			// Build up the full response so tool calls can be parsed from it
+			generated.WriteString(r.Content)
+
+			if len(req.Tools) > 0 {
+				held.WriteString(r.Content)
+				heldLogprobs = append(heldLogprobs, r.Logprobs...)
+				if !r.Done && mayBeToolCall(generated.String()) {
+					return
+				}
+
+				r.Content, r.Logprobs = held.String(), heldLogprobs
+				held.Reset()
+				heldLogprobs = nil
+			}
 
 			resp := api.ChatResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
 				Message:   api.Message{Role: "assistant", Content: r.Content},
+				Logprobs:  r.Logprobs,
 				Done:      r.Done,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
@@ -1292,18 +1891,32 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			if r.Done {
 				resp.TotalDuration = time.Since(checkpointStart)
 				resp.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				recordTokenMetrics(model.ShortName, resp.Metrics)
+
+				if toolCalls, ok := parseToolCalls(generated.String(), req.Tools); ok {
+					resp.Message.Content = ""
+					resp.Message.ToolCalls = toolCalls
+				}
 			}
 
-			ch <- resp
+			select {
+			case ch <- resp:
+			case <-ctx.Done():
+			}
 		}
 
-		if err := runner.llama.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Format:  req.Format,
-			Images:  images,
-			Options: opts,
+		if err := runner.llama.Completion(ctx, llm.CompletionRequest{
+			Prompt:   prompt,
+			Format:   req.Format,
+			Grammar:  grammar,
+			Images:   images,
+			Options:  opts,
+			Logprobs: req.Logprobs,
 		}, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			select {
+			case ch <- gin.H{"error": err.Error()}:
+			case <-ctx.Done():
+			}
 		}
 	}()
 
@@ -1311,10 +1924,12 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		// Accumulate responses into the final response
 		var final api.ChatResponse
 		var sb strings.Builder
+		var logprobs []api.Logprob
 		for resp := range ch {
 			switch r := resp.(type) {
 			case api.ChatResponse:
 				sb.WriteString(r.Message.Content)
+				logprobs = append(logprobs, r.Logprobs...)
 				final = r
 			case gin.H:
 				if errorMsg, ok := r["error"].(string); ok {
@@ -1330,7 +1945,12 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			}
 		}
 
-		final.Message = api.Message{Role: "assistant", Content: sb.String()}
+		final.Message.Content = sb.String()
+		final.Logprobs = logprobs
+		if len(final.Message.ToolCalls) > 0 {
+			final.Message.Content = ""
+		}
+
 		c.JSON(http.StatusOK, final)
 		return
 	}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
@@ -11,16 +12,33 @@ import (
 	"net/http/httptest"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/version"
 )
 
+// setenv sets an environment variable for the rest of the test, and has
+// envconfig read the environment again
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	t.Setenv(key, value)
+	envconfig.Reset()
+	t.Cleanup(envconfig.Reset)
+}
+
 func Test_Routes(t *testing.T) {
 	type testCase struct {
 		Name     string
@@ -208,6 +226,237 @@ func Test_Routes(t *testing.T) {
 				assert.Equal(t, expectedParams, params)
 			},
 		},
+		{
+			Name:   "OpenAI List Models Handler",
+			Method: http.MethodGet,
+			Path:   "/v1/models",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "list-model")
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+
+				var list openai.ListCompletion
+				err = json.Unmarshal(body, &list)
+				assert.Nil(t, err)
+
+				assert.Equal(t, "list", list.Object)
+				assert.NotEmpty(t, list.Data)
+				for _, m := range list.Data {
+					assert.Equal(t, "model", m.Object)
+					assert.Equal(t, "library", m.OwnedBy)
+				}
+			},
+		},
+		{
+			Name:   "OpenAI Retrieve Model Handler",
+			Method: http.MethodGet,
+			Path:   "/v1/models/retrieve-model",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "retrieve-model")
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+
+				var m openai.Model
+				err = json.Unmarshal(body, &m)
+				assert.Nil(t, err)
+
+				assert.Equal(t, "retrieve-model", m.Id)
+				assert.Equal(t, "model", m.Object)
+				assert.NotZero(t, m.Created)
+			},
+		},
+		{
+			Name:   "OpenAI Retrieve Missing Model Handler",
+			Method: http.MethodGet,
+			Path:   "/v1/models/missing-model",
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+
+				var errResp openai.ErrorResponse
+				err = json.Unmarshal(body, &errResp)
+				assert.Nil(t, err)
+
+				assert.Equal(t, "not_found_error", errResp.Error.Type)
+			},
+		},
+		{
+			Name:   "Embeddings Handler Prompt And Input",
+			Method: http.MethodPost,
+			Path:   "/api/embeddings",
+			Setup: func(t *testing.T, req *http.Request) {
+				embedReq := api.EmbeddingRequest{
+					Model:  "embed-model",
+					Prompt: "hello",
+					Input:  []string{"hello", "world"},
+				}
+				jsonData, err := json.Marshal(embedReq)
+				assert.Nil(t, err)
+
+				req.Body = io.NopCloser(bytes.NewReader(jsonData))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			},
+		},
+		{
+			Name:   "Embeddings Handler Empty Input",
+			Method: http.MethodPost,
+			Path:   "/api/embeddings",
+			Setup: func(t *testing.T, req *http.Request) {
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "embed-model", "input": ["hello", ""]}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+				assert.Contains(t, string(body), "input 1 is empty")
+			},
+		},
+		{
+			Name:   "Generate Handler Invalid Format",
+			Method: http.MethodPost,
+			Path:   "/api/generate",
+			Setup: func(t *testing.T, req *http.Request) {
+				generateReq := api.GenerateRequest{
+					Model:  "format-model",
+					Prompt: "hello",
+					Format: `{"type": "object", "properties": {"name": {"type": "string", "pattern": "^[a-z]+$"}}}`,
+				}
+				jsonData, err := json.Marshal(generateReq)
+				assert.Nil(t, err)
+
+				req.Body = io.NopCloser(bytes.NewReader(jsonData))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+				assert.Contains(t, string(body), "invalid format")
+			},
+		},
+		{
+			Name:   "Chat Handler Negative Logprobs",
+			Method: http.MethodPost,
+			Path:   "/api/chat",
+			Setup: func(t *testing.T, req *http.Request) {
+				chatReq := api.ChatRequest{
+					Model:    "logprobs-model",
+					Messages: []api.Message{{Role: "user", Content: "hello"}},
+					Logprobs: -1,
+				}
+				jsonData, err := json.Marshal(chatReq)
+				assert.Nil(t, err)
+
+				req.Body = io.NopCloser(bytes.NewReader(jsonData))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+				assert.Contains(t, string(body), "logprobs must not be negative")
+			},
+		},
+		{
+			Name:   "Generate Handler Invalid Priority",
+			Method: http.MethodPost,
+			Path:   "/api/generate",
+			Setup: func(t *testing.T, req *http.Request) {
+				generateReq := api.GenerateRequest{
+					Model:    "priority-model",
+					Prompt:   "hello",
+					Priority: "urgent",
+				}
+				jsonData, err := json.Marshal(generateReq)
+				assert.Nil(t, err)
+
+				req.Body = io.NopCloser(bytes.NewReader(jsonData))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+				assert.Contains(t, string(body), "invalid priority")
+			},
+		},
+		{
+			Name:   "Metrics Handler",
+			Method: http.MethodGet,
+			Path:   "/metrics",
+			Setup: func(t *testing.T, req *http.Request) {
+				recordTokenMetrics("metrics-model:latest", api.Metrics{PromptEvalCount: 10, EvalCount: 20})
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+				assert.Contains(t, string(body), `ollama_prompt_tokens_total{model="metrics-model:latest"} 10`)
+				assert.Contains(t, string(body), `ollama_eval_tokens_total{model="metrics-model:latest"} 20`)
+				assert.Contains(t, string(body), "# TYPE ollama_http_requests_total counter")
+			},
+		},
+		{
+			Name:   "Config Handler",
+			Method: http.MethodGet,
+			Path:   "/api/config",
+			Setup: func(t *testing.T, req *http.Request) {
+				setenv(t, "OLLAMA_NUM_PARALLEL", "3")
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				var body struct {
+					Settings []envconfig.Setting `json:"settings"`
+				}
+				err := json.NewDecoder(resp.Body).Decode(&body)
+				assert.Nil(t, err)
+				assert.Contains(t, body.Settings, envconfig.Setting{Name: "num_parallel", Env: "OLLAMA_NUM_PARALLEL", Value: float64(3), Source: envconfig.SourceEnv})
+			},
+		},
+		{
+			Name:   "Tokenize Handler Prompt And Messages",
+			Method: http.MethodPost,
+			Path:   "/api/tokenize",
+			Setup: func(t *testing.T, req *http.Request) {
+				tokenizeReq := api.TokenizeRequest{
+					Model:    "tokenize-model",
+					Prompt:   "hello",
+					Messages: []api.Message{{Role: "user", Content: "hello"}},
+				}
+				jsonData, err := json.Marshal(tokenizeReq)
+				assert.Nil(t, err)
+
+				req.Body = io.NopCloser(bytes.NewReader(jsonData))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			},
+		},
+		{
+			Name:   "Detokenize Handler Missing Model",
+			Method: http.MethodPost,
+			Path:   "/api/detokenize",
+			Setup: func(t *testing.T, req *http.Request) {
+				jsonData, err := json.Marshal(api.DetokenizeRequest{Tokens: []int{1, 2, 3}})
+				assert.Nil(t, err)
+
+				req.Body = io.NopCloser(bytes.NewReader(jsonData))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+				assert.Contains(t, string(body), "model is required")
+			},
+		},
 	}
 
 	s := &Server{}
@@ -219,7 +468,7 @@ func Test_Routes(t *testing.T) {
 	workDir, err := os.MkdirTemp("", "ollama-test")
 	assert.Nil(t, err)
 	defer os.RemoveAll(workDir)
-	os.Setenv("OLLAMA_MODELS", workDir)
+	setenv(t, "OLLAMA_MODELS", workDir)
 
 	for _, tc := range testCases {
 		t.Logf("Running Test: [%s]", tc.Name)
@@ -241,3 +490,307 @@ func Test_Routes(t *testing.T) {
 
 	}
 }
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		input    []float64
+		expected []float64
+	}{
+		{input: []float64{3, 4}, expected: []float64{0.6, 0.8}},
+		{input: []float64{0, 0, 2}, expected: []float64{0, 0, 1}},
+		{input: []float64{0, 0}, expected: []float64{0, 0}},
+		{input: []float64{}, expected: []float64{}},
+	}
+
+	for _, tc := range cases {
+		assert.InDeltaSlice(t, tc.expected, normalize(tc.input), 1e-9)
+	}
+}
+
+func TestStreamResponse(t *testing.T) {
+	send := func() chan any {
+		ch := make(chan any, 3)
+		ch <- api.GenerateResponse{Response: "Hello"}
+		ch <- api.GenerateResponse{Done: true, Metrics: api.Metrics{EvalCount: 1}}
+		ch <- gin.H{"error": "something went wrong"}
+		close(ch)
+		return ch
+	}
+
+	cases := []struct {
+		accept      string
+		contentType string
+		expect      string
+	}{
+		{
+			accept:      "application/x-ndjson",
+			contentType: "application/x-ndjson",
+			expect: `{"model":"","created_at":"0001-01-01T00:00:00Z","response":"Hello","done":false}
+{"model":"","created_at":"0001-01-01T00:00:00Z","response":"","done":true,"eval_count":1}
+{"error":"something went wrong"}
+`,
+		},
+		{
+			accept:      "application/json, text/event-stream;q=0.9",
+			contentType: "text/event-stream",
+			expect: `id:1
+data:{"model":"","created_at":"0001-01-01T00:00:00Z","response":"Hello","done":false}
+
+id:2
+event:done
+data:{"model":"","created_at":"0001-01-01T00:00:00Z","response":"","done":true,"eval_count":1}
+
+id:3
+event:error
+data:{"error":"something went wrong"}
+
+`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := gin.New()
+			r.POST("/", func(c *gin.Context) { streamResponse(c, send()) })
+			srv := httptest.NewServer(r)
+			t.Cleanup(srv.Close)
+
+			req, err := http.NewRequest(http.MethodPost, srv.URL, nil)
+			assert.Nil(t, err)
+			req.Header.Set("Accept", tt.accept)
+
+			resp, err := srv.Client().Do(req)
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, tt.expect, string(body))
+		})
+	}
+}
+
+func TestProcessHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &Server{
+		sched: &Scheduler{
+			pending: newRequestQueue(10),
+			loaded: map[string]*runnerRef{
+				"/blobs/sha256-abc": {
+					modelInfo: &Model{
+						ShortName: "test-model:latest",
+						Digest:    "0123456789abcdef",
+						Config:    ConfigV2{ModelFamily: "llama"},
+					},
+					model:          "/blobs/sha256-abc",
+					refCount:       2,
+					estimatedTotal: 2000,
+					estimatedVRAM:  1000,
+					expiresAt:      time.Now().Add(5 * time.Minute),
+					gpus: gpu.GpuInfoList{
+						{Library: "cuda", ID: "0"},
+						{Library: "cuda", ID: "1"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, p := range []requestPriority{priorityBatch, priorityInteractive} {
+		err := s.sched.pending.push(&LlmRequest{
+			ctx:      ctx,
+			model:    &Model{ShortName: "queued-model:latest"},
+			priority: p,
+			errCh:    make(chan error, 1),
+		}, 0)
+		assert.Nil(t, err)
+	}
+
+	httpSrv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(httpSrv.Close)
+
+	resp, err := httpSrv.Client().Get(httpSrv.URL + "/api/ps")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var ps api.ProcessResponse
+	err = json.NewDecoder(resp.Body).Decode(&ps)
+	assert.Nil(t, err)
+
+	assert.Len(t, ps.Models, 1)
+	m := ps.Models[0]
+	assert.Equal(t, "test-model:latest", m.Name)
+	assert.Equal(t, "0123456789abcdef", m.Digest)
+	assert.Equal(t, "llama", m.Details.Family)
+	assert.Equal(t, int64(2000), m.Size)
+	assert.Equal(t, int64(1000), m.SizeVRAM)
+	assert.Equal(t, []string{"0", "1"}, m.GPUs)
+	assert.Equal(t, 2, m.ActiveRequests)
+	assert.False(t, m.ExpiresAt.IsZero())
+
+	assert.Len(t, ps.Queue, 2)
+	for i, q := range ps.Queue {
+		assert.Equal(t, "queued-model:latest", q.Model)
+		assert.Equal(t, i, q.Position)
+	}
+	assert.Equal(t, "interactive", ps.Queue[0].Priority)
+	assert.Equal(t, "batch", ps.Queue[1].Priority)
+}
+
+func TestQueuePosition(t *testing.T) {
+	setenv(t, "OLLAMA_MODELS", t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	scenario := newScenario(t, ctx, "ollama-model", 0)
+	commands, err := parser.Parse(strings.NewReader("FROM " + scenario.req.model.ModelPath))
+	require.NoError(t, err)
+	require.NoError(t, CreateModel(ctx, "test", "", "", commands, func(api.ProgressResponse) {}))
+
+	system := gpu.GpuInfo{}
+	system.TotalMemory = 16 * format.GibiByte
+	system.FreeMemory = system.TotalMemory
+
+	previous := maxQueuedRequests
+	maxQueuedRequests = 10
+	t.Cleanup(func() { maxQueuedRequests = previous })
+
+	s := &Server{sched: InitScheduler(ctx)}
+	s.sched.simulate(gpu.NewSimulated(nil, system))
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	// queue requests to load the model before the scheduler starts
+	var responses []chan *http.Response
+	for i := range 3 {
+		ch := make(chan *http.Response, 1)
+		go func() {
+			resp, err := srv.Client().Post(srv.URL+"/api/generate", "application/json", strings.NewReader(`{"model": "test"}`))
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- resp
+		}()
+
+		require.Eventually(t, func() bool { return s.sched.pending.len() == i+1 }, time.Second, time.Millisecond)
+		responses = append(responses, ch)
+	}
+
+	s.sched.Run(ctx)
+
+	for i, ch := range responses {
+		resp := <-ch
+		require.NotNil(t, resp)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, strconv.Itoa(i), resp.Header.Get("X-Queue-Position"))
+	}
+}
+
+func TestEmbeddingsTruncate(t *testing.T) {
+	setenv(t, "OLLAMA_MODELS", t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	scenario := newScenario(t, ctx, "ollama-model", 0)
+	commands, err := parser.Parse(strings.NewReader("FROM " + scenario.req.model.ModelPath))
+	require.NoError(t, err)
+	require.NoError(t, CreateModel(ctx, "test", "", "", commands, func(api.ProgressResponse) {}))
+
+	system := gpu.GpuInfo{}
+	system.TotalMemory = 16 * format.GibiByte
+	system.FreeMemory = system.TotalMemory
+
+	s := &Server{sched: InitScheduler(ctx)}
+	s.sched.simulate(gpu.NewSimulated(nil, system))
+	s.sched.Run(ctx)
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	embed := func(body string) (int, api.EmbeddingResponse) {
+		t.Helper()
+		resp, err := srv.Client().Post(srv.URL+"/api/embeddings", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var embedding api.EmbeddingResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&embedding))
+		return resp.StatusCode, embedding
+	}
+
+	// the stub runner has a token for each word
+	input := strings.Repeat("word ", 10)
+
+	status, resp := embed(`{"model": "test", "input": ["` + input + `", "short"], "options": {"num_ctx": 4}}`)
+	require.Equal(t, http.StatusOK, status)
+	assert.Len(t, resp.Embeddings, 2)
+	assert.Equal(t, 5, resp.PromptEvalCount)
+
+	status, _ = embed(`{"model": "test", "input": ["` + input + `"], "truncate": false, "options": {"num_ctx": 4}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestGPUMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	g := gpu.GpuInfo{Library: "cuda", ID: "GPU-metrics"}
+	g.TotalMemory = 4 * format.GibiByte
+	g.FreeMemory = g.TotalMemory
+	system := gpu.GpuInfo{}
+	system.TotalMemory = 16 * format.GibiByte
+	system.FreeMemory = system.TotalMemory
+
+	s := &Server{sched: InitScheduler(ctx)}
+	s.sched.simulate(gpu.NewSimulated(gpu.GpuInfoList{g}, system))
+	s.sched.Run(ctx)
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	gauge := func(name string) float64 {
+		t.Helper()
+		resp, err := srv.Client().Get(srv.URL + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), name+`{library="cuda",gpu="GPU-metrics"} `); ok {
+				f, err := strconv.ParseFloat(value, 64)
+				require.NoError(t, err)
+				return f
+			}
+		}
+
+		return -1
+	}
+
+	// the first model loaded is reported without waiting for another
+	scenario := newScenario(t, ctx, "ollama-model", 0)
+	require.NoError(t, s.sched.pending.push(scenario.req, 0))
+	var runner *runnerRef
+	select {
+	case runner = <-scenario.req.successCh:
+	case err := <-scenario.req.errCh:
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, float64(g.TotalMemory), gauge("ollama_gpu_memory_total_bytes"))
+	assert.Equal(t, float64(g.FreeMemory), gauge("ollama_gpu_memory_free_bytes"))
+	assert.Equal(t, float64(runner.estimatedVRAM), gauge("ollama_gpu_memory_estimated_used_bytes"))
+	assert.Positive(t, runner.estimatedVRAM)
+
+	// and unloading it is reported at the next scrape
+	scenario.ctxDone()
+	require.Eventually(t, func() bool { return gauge("ollama_gpu_memory_estimated_used_bytes") == 0 }, time.Second, 10*time.Millisecond)
+}
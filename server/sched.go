@@ -5,19 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"os"
 	"reflect"
+	"slices"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/llm"
-	"golang.org/x/exp/slices"
 )
 
 type LlmRequest struct {
@@ -25,12 +24,17 @@ type LlmRequest struct {
 	model           *Model
 	opts            api.Options
 	sessionDuration time.Duration
+	priority        requestPriority
+	queuedAt        time.Time
 	successCh       chan *runnerRef
 	errCh           chan error
+
+	// stopWaiting is set while the request is queued
+	stopWaiting func()
 }
 
 type Scheduler struct {
-	pendingReqCh  chan *LlmRequest
+	pending       *requestQueue
 	finishedReqCh chan *LlmRequest
 	expiredCh     chan *runnerRef
 	unloadedCh    chan interface{}
@@ -38,66 +42,127 @@ type Scheduler struct {
 	loaded   map[string]*runnerRef
 	loadedMu sync.Mutex
 
+	// gpus are the GPUs as last reported before loading a model, for metrics
+	gpus   gpu.GpuInfoList
+	gpusMu sync.Mutex
+
+	// eviction chooses which runner to unload to make room for another,
+	// except for runners of pinned models
+	eviction evictionPolicy
+	pinned   []string
+
+	// reservedMemory is the system memory left free when loading models on the CPU
+	reservedMemory uint64
+
 	loadFn      func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList)
 	newServerFn func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options) (llm.LlamaServer, error)
 	getGpuFn    func() gpu.GpuInfoList
+	getCpuFn    func() gpu.GpuInfo
 }
 
+var (
+	errModelNotLoaded = errors.New("model is not loaded")
+	errModelsPinned   = errors.New("unable to load model: the maximum number of models are loaded and all of them are pinned")
+	errSystemMemory   = errors.New("unable to load model: not enough system memory")
+)
+
 // TODO set this to zero after a release or two, to enable multiple models by default
-var loadedMax = 1          // Maximum runners; < 1 maps to as many as will fit in VRAM (unlimited for CPU runners)
-var maxQueuedRequests = 10 // TODO configurable
-var numParallel = 1
+var loadedMax = 1 // Maximum runners; < 1 maps to as many as will fit in VRAM (or system memory for CPU runners)
+var maxQueuedRequests = 512
+var queueTimeout = 5 * time.Minute // <= 0 lets requests wait in the queue until they are canceled
+var numParallel = 1                // Default requests each model serves at once
 
 func InitScheduler(ctx context.Context) *Scheduler {
-	maxRunners := os.Getenv("OLLAMA_MAX_LOADED_MODELS")
-	if maxRunners != "" {
-		m, err := strconv.Atoi(maxRunners)
-		if err != nil {
-			slog.Error("invalid setting", "OLLAMA_MAX_LOADED_MODELS", maxRunners, "error", err)
-		} else {
-			loadedMax = m
-		}
+	cfg := envconfig.Current()
+	if cfg.IsSet("max_loaded_models") {
+		loadedMax = cfg.MaxLoadedModels
 	}
-	if onp := os.Getenv("OLLAMA_NUM_PARALLEL"); onp != "" {
-		p, err := strconv.Atoi(onp)
-		if err != nil || p <= 0 {
-			slog.Error("invalid parallel setting, must be greater than zero", "OLLAMA_NUM_PARALLEL", onp, "error", err)
-		} else {
-			numParallel = p
-		}
+	if cfg.IsSet("num_parallel") {
+		numParallel = cfg.NumParallel
+	}
+	if cfg.IsSet("max_queue") {
+		maxQueuedRequests = cfg.MaxQueue
+	}
+	if cfg.IsSet("queue_timeout") {
+		queueTimeout = cfg.QueueTimeout
 	}
 
 	sched := &Scheduler{
-		pendingReqCh:  make(chan *LlmRequest, maxQueuedRequests),
-		finishedReqCh: make(chan *LlmRequest, maxQueuedRequests),
-		expiredCh:     make(chan *runnerRef, maxQueuedRequests),
-		unloadedCh:    make(chan interface{}, maxQueuedRequests),
-		loaded:        make(map[string]*runnerRef),
-		newServerFn:   llm.NewLlamaServer,
-		getGpuFn:      gpu.GetGPUInfo,
+		pending:        newRequestQueue(maxQueuedRequests),
+		finishedReqCh:  make(chan *LlmRequest, maxQueuedRequests),
+		expiredCh:      make(chan *runnerRef, maxQueuedRequests),
+		unloadedCh:     make(chan interface{}, maxQueuedRequests),
+		loaded:         make(map[string]*runnerRef),
+		eviction:       newEvictionPolicy(cfg.EvictionPolicy, cfg.ModelPriorities),
+		pinned:         cfg.PinnedModels,
+		reservedMemory: cfg.ReservedMemory,
+		newServerFn:    llm.NewLlamaServer,
+		getGpuFn:       gpu.GetGPUInfo,
+		getCpuFn:       gpu.GetCPUInfo,
 	}
 	sched.loadFn = sched.load
 	return sched
 }
 
-// context must be canceled to decrement ref count and release the runner
-func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration time.Duration) (chan *runnerRef, chan error) {
+// simulate schedules models on the simulated GPUs of sim, loading them on
+// stub runners
+func (s *Scheduler) simulate(sim *gpu.Simulated) {
+	s.getGpuFn = sim.GetGPUInfo
+	s.getCpuFn = sim.GetCPUInfo
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options) (llm.LlamaServer, error) {
+		return llm.NewStubServer(sim, gpus, model, ggml, adapters, projectors, opts)
+	}
+}
+
+// context must be canceled to decrement ref count and release the runner.
+// The returned position is the number of requests queued ahead of this one.
+func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration time.Duration, priority requestPriority) (chan *runnerRef, chan error, int) {
+	// models without num_parallel in their options serve the default number
+	// of requests at once, so loaded runners match requests with either
+	if opts.NumParallel <= 0 {
+		opts.NumParallel = numParallel
+	}
+
 	req := &LlmRequest{
 		ctx:             c,
 		model:           model,
 		opts:            opts,
 		sessionDuration: sessionDuration,
+		priority:        priority,
+		queuedAt:        time.Now(),
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
 	}
-	// context split across parallel threads
-	opts.NumCtx = opts.NumCtx * numParallel
-	select {
-	case s.pendingReqCh <- req:
-	default:
-		req.errCh <- fmt.Errorf("server busy, please try again.  maximum pending requests exceeded")
+	var position int
+	if err := s.pending.push(req, queueTimeout); err != nil {
+		req.errCh <- err
+	} else {
+		// the request may have been scheduled already
+		position = max(s.pending.position(req), 0)
+		slog.DebugContext(req.ctx, "request queued", "model", model.ModelPath, "priority", priority, "position", position)
+	}
+	return req.successCh, req.errCh, position
+}
+
+// queuedRequests returns the requests waiting to be scheduled, in the order
+// they will be scheduled
+func (s *Scheduler) queuedRequests() []*LlmRequest {
+	return s.pending.snapshot()
+}
+
+// activeRequests returns the number of requests waiting to be scheduled or
+// holding a reference to a runner
+func (s *Scheduler) activeRequests() int {
+	active := s.pending.len()
+
+	// runner locks must not be taken while holding the scheduler's loaded lock
+	for _, runner := range s.loadedRunners() {
+		runner.refMu.Lock()
+		active += int(runner.refCount)
+		runner.refMu.Unlock()
 	}
-	return req.successCh, req.errCh
+
+	return active
 }
 
 // Returns immediately, spawns go routines for the scheduler which will shutdown when ctx is done
@@ -118,7 +183,13 @@ func (s *Scheduler) processPending(ctx context.Context) {
 		case <-ctx.Done():
 			slog.Debug("shutting down scheduler pending loop")
 			return
-		case pending := <-s.pendingReqCh:
+		case <-s.pending.readyCh:
+			pending := s.pending.pop()
+			if pending == nil {
+				// the request was canceled or timed out while queued
+				continue
+			}
+
 			// Block other requests until we get this pending request running
 			for {
 				var runnerToExpire *runnerRef
@@ -127,6 +198,21 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				loadedCount := len(s.loaded)
 				s.loadedMu.Unlock()
 				if runner != nil {
+					runner.refMu.Lock()
+					unloading := runner.unloading
+					runner.refMu.Unlock()
+					if unloading {
+						// An explicit unload is draining this runner, wait for it to finish before reloading
+						slog.DebugContext(pending.ctx, "waiting for unload to complete", "model", runner.model)
+						select {
+						case <-ctx.Done():
+							slog.DebugContext(pending.ctx, "shutting down scheduler pending loop")
+							return
+						case <-s.unloadedCh:
+							continue
+						}
+					}
+
 					if runner.needsReload(ctx, pending) {
 						runnerToExpire = runner
 					} else {
@@ -135,12 +221,17 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						break
 					}
 				} else if loadedMax > 0 && loadedCount >= loadedMax {
-					slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
+					slog.DebugContext(pending.ctx, "max runners achieved, unloading one to make room", "runner_count", loadedCount)
 					runnerToExpire = s.findRunnerToUnload(pending)
+					if runnerToExpire == nil {
+						pending.errCh <- errModelsPinned
+						break
+					}
 				} else {
 					// Either no models are loaded or below loadedMax
 					// Get a refreshed GPU list
 					gpus := s.getGpuFn()
+					s.recordGPUs(gpus)
 
 					// Load model for fitting
 					ggml, err := llm.LoadModel(pending.model.ModelPath)
@@ -149,37 +240,58 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						break
 					}
 
-					// No models loaded. Load the model but prefer the best fit.
-					if loadedCount == 0 {
-						slog.Debug("loading first model", "model", pending.model.ModelPath)
-						g := pickBestFitGPUs(pending, ggml, gpus)
-						if g != nil {
-							gpus = g
+					// Pick the GPUs to load on, unless the model runs on the CPU
+					if !loadsOnCPU(gpus, pending.opts) {
+						if loadedCount == 0 {
+							// No models loaded. Load the model but prefer the best fit.
+							slog.DebugContext(pending.ctx, "loading first model", "model", pending.model.ModelPath)
+							if g := pickBestFitGPUs(pending, ggml, gpus); g != nil {
+								gpus = g
+							}
+						} else {
+							// More than one loaded model, so we have to see if the new one fits
+							// Update free memory from currently loaded models
+							s.updateFreeSpace(gpus)
+							if fit := pickBestFitGPUs(pending, ggml, gpus); fit != nil {
+								slog.DebugContext(pending.ctx, "new model fits with existing models")
+								gpus = fit
+							} else if runnerToExpire = s.findRunnerToUnload(pending); runnerToExpire == nil {
+								// pinned models stay loaded, so load as much of the new model as fits alongside them
+								slog.DebugContext(pending.ctx, "loaded models are pinned, loading new model into the remaining memory")
+							}
 						}
-						s.loadFn(pending, ggml, gpus)
-						break
 					}
 
-					// More than one loaded model, so we have to see if the new one fits
-					// Update free memory from currently loaded models
-					s.updateFreeSpace(gpus)
-					gpus = pickBestFitGPUs(pending, ggml, gpus)
-					if gpus != nil {
-						slog.Debug("new model fits with existing models, loading")
-						s.loadFn(pending, ggml, gpus)
-						break
+					if runnerToExpire == nil {
+						// layers and cache that aren't offloaded to GPUs are kept in system memory
+						required := systemMemoryRequired(pending, ggml, gpus)
+						available, limit := s.systemMemory()
+						if required <= available {
+							slog.DebugContext(pending.ctx, "new model fits in system memory, loading", "model", pending.model.ModelPath, "required", format.HumanBytes2(required), "available", format.HumanBytes2(available))
+							s.loadFn(pending, ggml, gpus)
+							break
+						}
+
+						// unload other models if that would make room, otherwise the load would overcommit memory
+						if required <= limit {
+							runnerToExpire = s.findRunnerToUnload(pending)
+						}
+
+						if runnerToExpire == nil || loadedCount == 0 {
+							pending.errCh <- fmt.Errorf("%w: model requires %s but %s is available", errSystemMemory, format.HumanBytes2(required), format.HumanBytes2(available))
+							break
+						}
 					}
-					runnerToExpire = s.findRunnerToUnload(pending)
 				}
 
 				if runnerToExpire == nil {
 					// Shouildn't happen
-					slog.Error("runner to expire was nil!")
+					slog.ErrorContext(pending.ctx, "runner to expire was nil!")
 					continue
 				}
 				// Trigger an expiration to unload once it's done
 				runnerToExpire.refMu.Lock()
-				slog.Debug("resetting model to expire immediately to make room", "model", runnerToExpire.model, "refCount", runnerToExpire.refCount)
+				slog.DebugContext(pending.ctx, "resetting model to expire immediately to make room", "model", runnerToExpire.model, "refCount", runnerToExpire.refCount)
 				if runnerToExpire.expireTimer != nil {
 					runnerToExpire.expireTimer.Stop()
 					runnerToExpire.expireTimer = nil
@@ -192,13 +304,13 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				// Wait for the unload to happen
 				// Note: at this point we're queueing up all incoming requests, even if they were for
 				// a different model that's loaded and not scheduled to be removed.
-				slog.Debug("waiting for pending requests to complete and unload to occur", "model", runnerToExpire.model)
+				slog.DebugContext(pending.ctx, "waiting for pending requests to complete and unload to occur", "model", runnerToExpire.model)
 				select {
 				case <-ctx.Done():
-					slog.Debug("shutting down scheduler pending loop")
+					slog.DebugContext(pending.ctx, "shutting down scheduler pending loop")
 					return
 				case <-s.unloadedCh:
-					slog.Debug("unload completed", "model", runnerToExpire.model)
+					slog.DebugContext(pending.ctx, "unload completed", "model", runnerToExpire.model)
 					continue
 				}
 			}
@@ -221,23 +333,25 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			runner := s.loaded[finished.model.ModelPath]
 			s.loadedMu.Unlock()
 			if runner == nil {
-				slog.Error("finished requeset signal received after model unloaded", "model", finished.model.ModelPath)
+				slog.ErrorContext(finished.ctx, "finished requeset signal received after model unloaded", "model", finished.model.ModelPath)
 				continue
 			}
 			runner.refMu.Lock()
 			runner.refCount--
+			runner.lastUsed = time.Now()
 			if runner.refCount <= 0 {
 				if runner.sessionDuration <= 0 {
-					slog.Debug("runner with zero duration has gone idle, expiring to unload", "model", runner.model)
+					slog.DebugContext(finished.ctx, "runner with zero duration has gone idle, expiring to unload", "model", runner.model)
 					if runner.expireTimer != nil {
 						runner.expireTimer.Stop()
 						runner.expireTimer = nil
 					}
 					s.expiredCh <- runner
 				} else if runner.expireTimer == nil {
-					slog.Debug("runner with non-zero duration has gone idle, adding timer", "model", runner.model, "duration", runner.sessionDuration)
+					slog.DebugContext(finished.ctx, "runner with non-zero duration has gone idle, adding timer", "model", runner.model, "duration", runner.sessionDuration)
+					runner.expiresAt = time.Now().Add(runner.sessionDuration)
 					runner.expireTimer = time.AfterFunc(runner.sessionDuration, func() {
-						slog.Debug("timer expired, expiring to unload", "model", runner.model)
+						slog.DebugContext(finished.ctx, "timer expired, expiring to unload", "model", runner.model)
 						runner.refMu.Lock()
 						defer runner.refMu.Unlock()
 						if runner.expireTimer != nil {
@@ -246,11 +360,12 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 						s.expiredCh <- runner
 					})
 				} else {
-					slog.Debug("runner with non-zero duration has gone idle, resetting timer", "model", runner.model, "duration", runner.sessionDuration)
+					slog.DebugContext(finished.ctx, "runner with non-zero duration has gone idle, resetting timer", "model", runner.model, "duration", runner.sessionDuration)
 					runner.expireTimer.Reset(runner.sessionDuration)
+					runner.expiresAt = time.Now().Add(runner.sessionDuration)
 				}
 			}
-			slog.Debug("after processing request finished event", "model", runner.model, "refCount", runner.refCount)
+			slog.DebugContext(finished.ctx, "after processing request finished event", "model", runner.model, "refCount", runner.refCount)
 			runner.refMu.Unlock()
 		case runner := <-s.expiredCh:
 			slog.Debug("runner expired event received", "model", runner.model)
@@ -271,9 +386,16 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			slog.Debug("got lock to unload", "model", runner.model)
 			runner.unload()
 			s.loadedMu.Lock()
-			delete(s.loaded, runner.model)
+			// the runner may have already been replaced if it was expired more than once
+			if s.loaded[runner.model] == runner {
+				delete(s.loaded, runner.model)
+			}
 			s.loadedMu.Unlock()
 			slog.Debug("runner released", "model", runner.model)
+			if runner.unloadedCh != nil {
+				close(runner.unloadedCh)
+				runner.unloadedCh = nil
+			}
 			runner.refMu.Unlock()
 			slog.Debug("sending an unloaded event", "model", runner.model)
 			s.unloadedCh <- struct{}{}
@@ -288,16 +410,19 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 	runner.refMu.Lock()
 	defer runner.refMu.Unlock()
 	runner.refCount++
+	runner.lastUsed = time.Now()
 	runner.sessionDuration = pending.sessionDuration
+	runner.expiresAt = time.Now().Add(pending.sessionDuration)
 	pending.successCh <- runner
 	go func() {
 		<-pending.ctx.Done()
-		slog.Debug("context for request finished")
+		slog.DebugContext(pending.ctx, "context for request finished")
 		finished <- pending
 	}()
 }
 
 func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) {
+	start := time.Now()
 	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
@@ -306,80 +431,99 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList)
 		if errors.Is(llm.ErrUnsupportedFormat, err) || strings.Contains(err.Error(), "failed to load model") {
 			err = fmt.Errorf("%v: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, req.model.ShortName)
 		}
-		slog.Info("NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
+		slog.InfoContext(req.ctx, "NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
 		req.errCh <- err
 		return
 	}
 	runner := &runnerRef{}
+	runner.modelInfo = req.model
 	runner.model = req.model.ModelPath
 	runner.adapters = req.model.AdapterPaths
 	runner.projectors = req.model.ProjectorPaths
 	runner.llama = llama
 	runner.Options = &req.opts
 	runner.sessionDuration = req.sessionDuration
-	runner.gpus = gpus
+	runner.expiresAt = time.Now().Add(req.sessionDuration)
+	runner.gpus = usedGPUs(llama, gpus)
 	runner.estimatedVRAM = llama.EstimatedVRAM()
+	runner.estimatedTotal = llama.EstimatedTotal()
+	runner.pinned = slices.ContainsFunc(s.pinned, func(pattern string) bool { return modelMatches(pattern, req.model.ShortName) })
+	runner.lastUsed = time.Now()
 	runner.loading = true
 	runner.refCount = 1
 	runner.refMu.Lock()
 	s.loadedMu.Lock()
 	s.loaded[req.model.ModelPath] = runner
-	slog.Info("loaded runners", "count", len(s.loaded))
+	slog.InfoContext(req.ctx, "loaded runners", "count", len(s.loaded))
 	s.loadedMu.Unlock()
 
 	go func() {
 		defer runner.refMu.Unlock()
 		if err = llama.WaitUntilRunning(req.ctx); err != nil {
-			slog.Error("error loading llama server", "error", err)
+			slog.ErrorContext(req.ctx, "error loading llama server", "error", err)
 			runner.refCount--
 			req.errCh <- err
-			slog.Debug("triggering expiration for failed load", "model", runner.model)
+			slog.DebugContext(req.ctx, "triggering expiration for failed load", "model", runner.model)
 			s.expiredCh <- runner
 			return
 		}
-		slog.Debug("finished setting up runner", "model", req.model.ModelPath)
+		slog.DebugContext(req.ctx, "finished setting up runner", "model", req.model.ModelPath)
+		modelLoad.Observe(time.Since(start).Seconds(), req.model.ShortName)
 		runner.loading = false
 		go func() {
 			<-req.ctx.Done()
-			slog.Debug("context for request finished")
+			slog.DebugContext(req.ctx, "context for request finished")
 			s.finishedReqCh <- req
 		}()
 		req.successCh <- runner
 	}()
 }
 
-func (s *Scheduler) updateFreeSpace(allGpus gpu.GpuInfoList) {
-	type predKey struct {
-		Library string
-		ID      string
-	}
-	predMap := map[predKey]uint64{} // Sum up the total predicted usage per GPU for all runners
-	s.loadedMu.Lock()
-	for _, r := range s.loaded {
+// gpuKey identifies a GPU, whose IDs are only unique within a library
+type gpuKey struct {
+	Library string
+	ID      string
+}
+
+// estimatedGPUMemory sums the VRAM the loaded runners are estimated to use on
+// each GPU
+func (s *Scheduler) estimatedGPUMemory() map[gpuKey]uint64 {
+	predMap := map[gpuKey]uint64{}
+	// runner locks must not be taken while holding the scheduler's loaded lock
+	for _, r := range s.loadedRunners() {
 		r.refMu.Lock()
-		gpuIDs := make([]string, 0, len(r.gpus))
 		if r.llama != nil {
-
-			// TODO this should be broken down by GPU instead of assuming uniform spread
-			estimatedVRAMPerGPU := r.llama.EstimatedVRAM() / uint64(len(r.gpus))
 			for _, gpu := range r.gpus {
-				gpuIDs = append(gpuIDs, gpu.ID)
-			}
-			for _, gpu := range allGpus {
-				if slices.Contains(gpuIDs, gpu.ID) {
-					predMap[predKey{gpu.Library, gpu.ID}] += estimatedVRAMPerGPU
-				}
+				predMap[gpuKey{gpu.Library, gpu.ID}] += r.llama.EstimatedVRAMByGPU(gpu.ID)
 			}
 		} else {
 			slog.Warn("unexpected nil runner reference, memory prediction may be incorrect")
 		}
 		r.refMu.Unlock()
 	}
-	s.loadedMu.Unlock()
+	return predMap
+}
+
+// recordGPUs keeps the GPUs reported before loading a model for metrics
+func (s *Scheduler) recordGPUs(gpus gpu.GpuInfoList) {
+	s.gpusMu.Lock()
+	defer s.gpusMu.Unlock()
+	s.gpus = slices.Clone(gpus)
+}
+
+// reportedGPUs returns the GPUs as last reported before loading a model
+func (s *Scheduler) reportedGPUs() gpu.GpuInfoList {
+	s.gpusMu.Lock()
+	defer s.gpusMu.Unlock()
+	return slices.Clone(s.gpus)
+}
+
+func (s *Scheduler) updateFreeSpace(allGpus gpu.GpuInfoList) {
+	predMap := s.estimatedGPUMemory() // Sum up the total predicted usage per GPU for all runners
 
 	// Now that we've summed up all the GPU usage predictions across all the loaded runners, update the gpu list
 	for i := range allGpus {
-		if p, ok := predMap[predKey{allGpus[i].Library, allGpus[i].ID}]; ok {
+		if p, ok := predMap[gpuKey{allGpus[i].Library, allGpus[i].ID}]; ok {
 			slog.Debug("gpu reported", "gpu", allGpus[i].ID, "library", allGpus[i].Library, "available", format.HumanBytes2(allGpus[i].FreeMemory))
 			if p > allGpus[i].TotalMemory {
 				// Shouldn't happen
@@ -396,20 +540,96 @@ func (s *Scheduler) updateFreeSpace(allGpus gpu.GpuInfoList) {
 	}
 }
 
+// loadsOnCPU reports whether a model loaded with opts on gpus runs on the
+// CPU, as NewLlamaServer decides
+func loadsOnCPU(gpus gpu.GpuInfoList, opts api.Options) bool {
+	return (len(gpus) == 1 && gpus[0].Library == "cpu") || opts.NumGPU == 0
+}
+
+// usedGPUs returns the GPUs llama is estimated to use VRAM on, or all of
+// gpus if it isn't estimated to use any, like NewLlamaServer does when it
+// leaves GPUs without layers out of the runner's visible devices
+func usedGPUs(llama llm.LlamaServer, gpus gpu.GpuInfoList) gpu.GpuInfoList {
+	var used gpu.GpuInfoList
+	for _, g := range gpus {
+		if llama.EstimatedVRAMByGPU(g.ID) > 0 {
+			used = append(used, g)
+		}
+	}
+
+	if len(used) == 0 {
+		return gpus
+	}
+
+	return used
+}
+
+// systemMemoryRequired estimates the system memory a model needs when it's
+// loaded on gpus, which is everything that isn't offloaded to them
+func systemMemoryRequired(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) uint64 {
+	total := llm.EstimateTotalMemory(ggml, req.model.ProjectorPaths, req.opts)
+	if loadsOnCPU(gpus, req.opts) {
+		return total
+	}
+
+	estimate := llm.EstimateGPULayers(gpus, ggml, req.model.ProjectorPaths, req.opts)
+	return total - min(estimate.VRAMSize, total)
+}
+
+// systemMemory returns the system memory available to load a model on the
+// CPU, and the most that could be made available by unloading every model
+// that isn't pinned. Both leave the reserved memory free.
+func (s *Scheduler) systemMemory() (available, limit uint64) {
+	info := s.getCpuFn()
+
+	// Runners keep their weights and context in system memory, except for
+	// what is offloaded to GPUs
+	var predicted, pinned uint64
+	for _, r := range s.loadedRunners() {
+		size := r.estimatedTotal - min(r.estimatedVRAM, r.estimatedTotal)
+		predicted += size
+		if r.pinned {
+			pinned += size
+		}
+	}
+
+	// As with VRAM, trust whichever of the reported free memory and our
+	// prediction is smaller, since runners may not have allocated all of
+	// their memory yet. On Linux free memory includes reclaimable page
+	// cache, and macOS doesn't report it.
+	available = info.TotalMemory - min(predicted, info.TotalMemory)
+	if info.FreeMemory > 0 {
+		available = min(available, info.FreeMemory)
+	}
+	limit = info.TotalMemory - min(pinned, info.TotalMemory)
+
+	slog.Debug("system memory", "total", format.HumanBytes2(info.TotalMemory), "free", format.HumanBytes2(info.FreeMemory), "predicted", format.HumanBytes2(predicted), "reserved", format.HumanBytes2(s.reservedMemory))
+	return available - min(s.reservedMemory, available), limit - min(s.reservedMemory, limit)
+}
+
 type runnerRef struct {
 	refMu sync.Mutex
 	// refCond   sync.Cond // Signaled on transition from 1 -> 0 refCount
 	refCount uint // prevent unloading if > 0
 	// unloading bool      // set to true when we are trying to unload the runner
 
-	llama         llm.LlamaServer
-	loading       bool            // True only during initial load, then false forever
-	gpus          gpu.GpuInfoList // Recorded at time of provisioning
-	estimatedVRAM uint64
+	llama          llm.LlamaServer
+	loading        bool            // True only during initial load, then false forever
+	gpus           gpu.GpuInfoList // Recorded at time of provisioning
+	estimatedVRAM  uint64
+	estimatedTotal uint64
 
 	sessionDuration time.Duration
 	expireTimer     *time.Timer
+	expiresAt       time.Time
+	lastUsed        time.Time // when a request last started or finished using the runner
 
+	pinned bool // pinned runners are never unloaded to make room for another model
+
+	unloading  bool          // set by an explicit unload so new requests wait rather than reuse the runner
+	unloadedCh chan struct{} // closed once the runner has been unloaded, if an explicit unload is waiting
+
+	modelInfo  *Model
 	model      string
 	adapters   []string
 	projectors []string
@@ -429,7 +649,7 @@ func (runner *runnerRef) unload() {
 }
 
 func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool {
-	slog.Debug("evaluating already loaded", "model", req.model.ModelPath)
+	slog.DebugContext(req.ctx, "evaluating already loaded", "model", req.model.ModelPath)
 	runner.refMu.Lock()
 	defer runner.refMu.Unlock()
 
@@ -458,21 +678,15 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	return false
 }
 
-type ByDuration []*runnerRef
+// shortName returns the name of the runner's model, such as llama3:latest
+func (runner *runnerRef) shortName() string {
+	if runner.modelInfo == nil {
+		return ""
+	}
 
-func (a ByDuration) Len() int      { return len(a) }
-func (a ByDuration) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByDuration) Less(i, j int) bool {
-	// uint64 to turn negative time (never unload) to largest
-	return uint64(a[i].sessionDuration) < uint64(a[j].sessionDuration)
+	return runner.modelInfo.ShortName
 }
 
-// TODO - future consideration to pick runners based on size
-// type BySize []*runnerRef
-// func (a BySize) Len() int           { return len(a) }
-// func (a BySize) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-// func (a BySize) Less(i, j int) bool { return a[i].estimatedVRAM < a[j].estimatedVRAM }
-
 // pickBestFitGPUs will try to find the optimal placement of the model in the available GPUs where the model fully fits
 // If the model can not be fit fully within the available GPU(s) nil is returned
 func pickBestFitGPUs(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) gpu.GpuInfoList {
@@ -488,7 +702,7 @@ func pickBestFitGPUs(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) gpu.
 		// First attempt to fit the model into a single GPU
 		for _, g := range sgl {
 			if ok, estimatedVRAM = llm.PredictServerFit([]gpu.GpuInfo{g}, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
-				slog.Debug("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
+				slog.DebugContext(req.ctx, "new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
 				return []gpu.GpuInfo{g}
 			}
 		}
@@ -499,39 +713,93 @@ func pickBestFitGPUs(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) gpu.
 
 		// Now try all the GPUs
 		if ok, estimatedVRAM = llm.PredictServerFit(gl, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
-			slog.Debug("new model will fit in available VRAM, loading", "model", req.model.ModelPath, "library", gl[0].Library, "required", format.HumanBytes2(estimatedVRAM))
+			slog.DebugContext(req.ctx, "new model will fit in available VRAM, loading", "model", req.model.ModelPath, "library", gl[0].Library, "required", format.HumanBytes2(estimatedVRAM))
 			return gl
 		}
 	}
 	return nil
 }
 
-// findRunnerToUnload finds a runner to unload to make room for a new model
+// findRunnerToUnload finds a runner to unload to make room for a new model,
+// or nil if every loaded runner is pinned
 func (s *Scheduler) findRunnerToUnload(req *LlmRequest) *runnerRef {
-	s.loadedMu.Lock()
-	runnerList := make([]*runnerRef, 0, len(s.loaded))
-	for _, r := range s.loaded {
-		runnerList = append(runnerList, r)
+	// runner locks must not be taken while holding the scheduler's loaded lock
+	var runnerList []runnerSnapshot
+	for _, r := range s.loadedRunners() {
+		r.refMu.Lock()
+		if !r.pinned {
+			runnerList = append(runnerList, r.snapshot())
+		}
+		r.refMu.Unlock()
+	}
+
+	if len(runnerList) == 0 {
+		slog.DebugContext(req.ctx, "no runners to unload, all loaded models are pinned")
+		return nil
 	}
-	s.loadedMu.Unlock()
 
 	// In the future we can enhance the algorithm to be smarter about picking the optimal runner to unload
 	// e.g., if we have multiple options, will one make room for the request?
-	sort.Sort(ByDuration(runnerList))
+	sort.SliceStable(runnerList, func(i, j int) bool {
+		return s.eviction.less(runnerList[i], runnerList[j])
+	})
 
 	// First try to find a runner that's already idle
 	for _, runner := range runnerList {
-		runner.refMu.Lock()
-		rc := runner.refCount
-		runner.refMu.Unlock()
-		if rc == 0 {
-			slog.Debug("found an idle runner to unload")
-			return runner
+		if runner.refCount == 0 {
+			slog.DebugContext(req.ctx, "found an idle runner to unload")
+			return runner.runner
 		}
 	}
-	// None appear idle, just wait for the one with the shortest duration
-	slog.Debug("no idle runners, picking the shortest duration", "count", len(runnerList))
-	return runnerList[0]
+	// None appear idle, just wait for the first one to unload
+	slog.DebugContext(req.ctx, "no idle runners, picking the first to unload", "count", len(runnerList))
+	return runnerList[0].runner
+}
+
+// Unload unloads the runner for a model once its in-flight requests have
+// completed. It blocks until the runner has been unloaded or ctx is done.
+func (s *Scheduler) Unload(ctx context.Context, model *Model) error {
+	s.loadedMu.Lock()
+	runner := s.loaded[model.ModelPath]
+	s.loadedMu.Unlock()
+	if runner == nil {
+		return errModelNotLoaded
+	}
+
+	runner.refMu.Lock()
+	if runner.expireTimer != nil {
+		runner.expireTimer.Stop()
+		runner.expireTimer = nil
+	}
+	runner.sessionDuration = 0
+	runner.unloading = true
+	if runner.unloadedCh == nil {
+		runner.unloadedCh = make(chan struct{})
+	}
+	unloaded := runner.unloadedCh
+	slog.DebugContext(ctx, "unloading model", "model", runner.model, "refCount", runner.refCount)
+	if runner.refCount <= 0 {
+		s.expiredCh <- runner
+	}
+	runner.refMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-unloaded:
+		return nil
+	}
+}
+
+// loadedRunners returns a snapshot of the runners currently loaded
+func (s *Scheduler) loadedRunners() []*runnerRef {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	runners := make([]*runnerRef, 0, len(s.loaded))
+	for _, runner := range s.loaded {
+		runners = append(runners, runner)
+	}
+	return runners
 }
 
 func (s *Scheduler) unloadAllRunners() {
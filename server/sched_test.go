@@ -32,12 +32,12 @@ func TestInitScheduler(t *testing.T) {
 	require.Equal(t, initialMax, loadedMax)
 	require.NotNil(t, s.loaded)
 
-	os.Setenv("OLLAMA_MAX_LOADED_MODELS", "blue")
+	setenv(t, "OLLAMA_MAX_LOADED_MODELS", "blue")
 	s = InitScheduler(ctx)
 	require.Equal(t, initialMax, loadedMax)
 	require.NotNil(t, s.loaded)
 
-	os.Setenv("OLLAMA_MAX_LOADED_MODELS", "0")
+	setenv(t, "OLLAMA_MAX_LOADED_MODELS", "0")
 	s = InitScheduler(ctx)
 	require.Equal(t, 0, loadedMax)
 	require.NotNil(t, s.loaded)
@@ -143,6 +143,7 @@ func newScenario(t *testing.T, ctx context.Context, modelName string, estimatedV
 	scenario.req = &LlmRequest{
 		ctx:             scenario.ctx,
 		model:           model,
+		opts:            api.DefaultOptions(),
 		sessionDuration: 5 * time.Millisecond,
 		successCh:       make(chan *runnerRef, 1),
 		errCh:           make(chan error, 1),
@@ -182,13 +183,13 @@ func TestRequests(t *testing.T) {
 	}
 	s.newServerFn = scenario1a.newServer
 	slog.Info("scenario1a")
-	s.pendingReqCh <- scenario1a.req
-	require.Len(t, s.pendingReqCh, 1)
+	require.NoError(t, s.pending.push(scenario1a.req, 0))
+	require.Equal(t, 1, s.pending.len())
 	s.Run(ctx)
 	select {
 	case resp := <-scenario1a.req.successCh:
 		require.Equal(t, resp.llama, scenario1a.srv)
-		require.Len(t, s.pendingReqCh, 0)
+		require.Equal(t, 0, s.pending.len())
 		require.Len(t, scenario1a.req.errCh, 0)
 	case <-ctx.Done():
 		t.Errorf("timeout")
@@ -197,11 +198,11 @@ func TestRequests(t *testing.T) {
 	// Same runner as first request due to not needing a reload
 	s.newServerFn = scenario1b.newServer
 	slog.Info("scenario1b")
-	s.pendingReqCh <- scenario1b.req
+	require.NoError(t, s.pending.push(scenario1b.req, 0))
 	select {
 	case resp := <-scenario1b.req.successCh:
 		require.Equal(t, resp.llama, scenario1a.srv)
-		require.Len(t, s.pendingReqCh, 0)
+		require.Equal(t, 0, s.pending.len())
 		require.Len(t, scenario1b.req.errCh, 0)
 	case <-ctx.Done():
 		t.Errorf("timeout")
@@ -211,7 +212,7 @@ func TestRequests(t *testing.T) {
 	s.newServerFn = scenario2a.newServer
 	scenario2a.req.model.AdapterPaths = []string{"new"}
 	slog.Info("scenario2a")
-	s.pendingReqCh <- scenario2a.req
+	require.NoError(t, s.pending.push(scenario2a.req, 0))
 	// finish first two requests, so model can reload
 	time.Sleep(1 * time.Millisecond)
 	scenario1a.ctxDone()
@@ -219,7 +220,7 @@ func TestRequests(t *testing.T) {
 	select {
 	case resp := <-scenario2a.req.successCh:
 		require.Equal(t, resp.llama, scenario2a.srv)
-		require.Len(t, s.pendingReqCh, 0)
+		require.Equal(t, 0, s.pending.len())
 		require.Len(t, scenario2a.req.errCh, 0)
 	case <-ctx.Done():
 		t.Errorf("timeout")
@@ -228,14 +229,14 @@ func TestRequests(t *testing.T) {
 	loadedMax = 1
 	s.newServerFn = scenario3a.newServer
 	slog.Info("scenario3a")
-	s.pendingReqCh <- scenario3a.req
+	require.NoError(t, s.pending.push(scenario3a.req, 0))
 	// finish prior request, so new model can load
 	time.Sleep(1 * time.Millisecond)
 	scenario2a.ctxDone()
 	select {
 	case resp := <-scenario3a.req.successCh:
 		require.Equal(t, resp.llama, scenario3a.srv)
-		require.Len(t, s.pendingReqCh, 0)
+		require.Equal(t, 0, s.pending.len())
 		require.Len(t, scenario3a.req.errCh, 0)
 	case <-ctx.Done():
 		t.Errorf("timeout")
@@ -245,11 +246,11 @@ func TestRequests(t *testing.T) {
 	loadedMax = 0
 	s.newServerFn = scenario3b.newServer
 	slog.Info("scenario3b")
-	s.pendingReqCh <- scenario3b.req
+	require.NoError(t, s.pending.push(scenario3b.req, 0))
 	select {
 	case resp := <-scenario3b.req.successCh:
 		require.Equal(t, resp.llama, scenario3b.srv)
-		require.Len(t, s.pendingReqCh, 0)
+		require.Equal(t, 0, s.pending.len())
 		require.Len(t, scenario3b.req.errCh, 0)
 	case <-ctx.Done():
 		t.Errorf("timeout")
@@ -262,7 +263,7 @@ func TestRequests(t *testing.T) {
 	require.Len(t, s.loaded, 2)
 	scenario3a.ctxDone() // Won't help since this one isn't big enough to make room
 	time.Sleep(2 * time.Millisecond)
-	s.pendingReqCh <- scenario3c.req
+	require.NoError(t, s.pending.push(scenario3c.req, 0))
 	// finish prior request, so new model can load
 	time.Sleep(6 * time.Millisecond)
 	require.Len(t, s.loaded, 1)
@@ -270,7 +271,7 @@ func TestRequests(t *testing.T) {
 	select {
 	case resp := <-scenario3c.req.successCh:
 		require.Equal(t, resp.llama, scenario3c.srv)
-		require.Len(t, s.pendingReqCh, 0)
+		require.Equal(t, 0, s.pending.len())
 		require.Len(t, scenario3c.req.errCh, 0)
 	case <-ctx.Done():
 		t.Errorf("timeout")
@@ -299,11 +300,11 @@ func TestGetRunner(t *testing.T) {
 	}
 	s.newServerFn = scenario1a.newServer
 	slog.Info("scenario1a")
-	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration)
-	require.Len(t, s.pendingReqCh, 1)
+	successCh1a, errCh1a, _ := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration, priorityInteractive)
+	require.Equal(t, 1, s.pending.len())
 	slog.Info("scenario1b")
-	successCh1b, errCh1b := s.GetRunner(scenario1b.ctx, scenario1b.req.model, scenario1b.req.opts, scenario1b.req.sessionDuration)
-	require.Len(t, s.pendingReqCh, 1)
+	successCh1b, errCh1b, _ := s.GetRunner(scenario1b.ctx, scenario1b.req.model, scenario1b.req.opts, scenario1b.req.sessionDuration, priorityInteractive)
+	require.Equal(t, 1, s.pending.len())
 	require.Len(t, successCh1b, 0)
 	require.Len(t, errCh1b, 1)
 	err := <-errCh1b
@@ -312,7 +313,7 @@ func TestGetRunner(t *testing.T) {
 	select {
 	case resp := <-successCh1a:
 		require.Equal(t, resp.llama, scenario1a.srv)
-		require.Len(t, s.pendingReqCh, 0)
+		require.Equal(t, 0, s.pending.len())
 		require.Len(t, errCh1a, 0)
 	case <-ctx.Done():
 		t.Errorf("timeout")
@@ -322,12 +323,11 @@ func TestGetRunner(t *testing.T) {
 
 	scenario1c.req.model.ModelPath = "bad path"
 	slog.Info("scenario1c")
-	successCh1c, errCh1c := s.GetRunner(scenario1c.ctx, scenario1c.req.model, scenario1c.req.opts, scenario1c.req.sessionDuration)
-	require.Len(t, s.pendingReqCh, 0)
+	successCh1c, errCh1c, _ := s.GetRunner(scenario1c.ctx, scenario1c.req.model, scenario1c.req.opts, scenario1c.req.sessionDuration, priorityInteractive)
 	require.Len(t, successCh1c, 0)
-	require.Len(t, errCh1c, 0)
 
 	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, 0, s.pending.len())
 	require.Len(t, s.loaded, 0)
 	require.Len(t, errCh1c, 1)
 	err = <-errCh1c
@@ -335,6 +335,58 @@ func TestGetRunner(t *testing.T) {
 	scenario1b.ctxDone()
 }
 
+func TestNumParallel(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+
+	previous := numParallel
+	numParallel = 4
+	t.Cleanup(func() { numParallel = previous })
+
+	scenario1 := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario2 := newScenario(t, ctx, "ollama-model-1", 10)
+	scenario2.req.model = scenario1.req.model
+	scenario2.req.opts.NumParallel = 1
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = 24 * format.GigaByte
+		g.FreeMemory = 12 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.newServerFn = scenario1.newServer
+	s.Run(ctx)
+
+	// without num_parallel, the model serves the default number of requests
+	successCh, errCh, _ := s.GetRunner(scenario1.ctx, scenario1.req.model, scenario1.req.opts, time.Minute, priorityInteractive)
+	select {
+	case resp := <-successCh:
+		require.Equal(t, scenario1.srv, resp.llama)
+		require.Equal(t, 4, resp.Options.NumParallel)
+	case err := <-errCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// the model is reloaded for a request with a different num_parallel
+	scenario1.ctxDone()
+	s.newServerFn = scenario2.newServer
+	successCh, errCh, _ = s.GetRunner(scenario2.ctx, scenario2.req.model, scenario2.req.opts, time.Minute, priorityInteractive)
+	select {
+	case resp := <-successCh:
+		require.Equal(t, scenario2.srv, resp.llama)
+		require.Equal(t, 1, resp.Options.NumParallel)
+		require.True(t, scenario1.srv.closeCalled)
+	case err := <-errCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	scenario2.ctxDone()
+}
+
 // TODO - add one scenario that triggers the bogus finished event with positive ref count
 func TestPrematureExpired(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
@@ -350,13 +402,13 @@ func TestPrematureExpired(t *testing.T) {
 		return []gpu.GpuInfo{g}
 	}
 	s.newServerFn = scenario1a.newServer
-	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration)
-	require.Len(t, s.pendingReqCh, 1)
+	successCh1a, errCh1a, _ := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration, priorityInteractive)
+	require.Equal(t, 1, s.pending.len())
 	s.Run(ctx)
 	select {
 	case resp := <-successCh1a:
 		require.Equal(t, resp.llama, scenario1a.srv)
-		require.Len(t, s.pendingReqCh, 0)
+		require.Equal(t, 0, s.pending.len())
 		require.Len(t, errCh1a, 0)
 		require.Len(t, s.loaded, 1)
 		slog.Info("sending premature expired event now")
@@ -420,18 +472,242 @@ func TestUpdateFreeSpace(t *testing.T) {
 	gpus[0].FreeMemory = 900
 	gpus[1].TotalMemory = 2000
 	gpus[1].FreeMemory = 1900
-	llm1 := &mockLlm{estimatedVRAM: 100}
-	llm2 := &mockLlm{estimatedVRAM: 200}
+	llm1 := &mockLlm{estimatedVRAMByGPU: map[string]uint64{"1": 50, "2": 50}}
+	llm2 := &mockLlm{estimatedVRAMByGPU: map[string]uint64{"1": 125, "2": 75}}
+	llm3 := &mockLlm{estimatedVRAMByGPU: map[string]uint64{"2": 300}}
 	r1 := &runnerRef{llama: llm1, gpus: gpus}
 	r2 := &runnerRef{llama: llm2, gpus: gpus}
+	r3 := &runnerRef{llama: llm3, gpus: gpus[1:]}
 
 	s := InitScheduler(ctx)
 	s.loaded["a"] = r1
 	s.loaded["b"] = r2
+	s.loaded["c"] = r3
 
 	s.updateFreeSpace(gpus)
-	require.Equal(t, uint64(850), gpus[0].FreeMemory)
-	require.Equal(t, uint64(1850), gpus[1].FreeMemory)
+	require.Equal(t, uint64(825), gpus[0].FreeMemory)
+	require.Equal(t, uint64(1575), gpus[1].FreeMemory)
+}
+
+func TestUsedGPUs(t *testing.T) {
+	gpus := gpu.GpuInfoList{{Library: "cuda", ID: "0"}, {Library: "cuda", ID: "1"}}
+
+	used := usedGPUs(&mockLlm{estimatedVRAMByGPU: map[string]uint64{"1": 100}}, gpus)
+	require.Len(t, used, 1)
+	require.Equal(t, "1", used[0].ID)
+
+	// a runner without layers on any GPU still sees all of them
+	require.Equal(t, gpus, usedGPUs(&mockLlm{}, gpus))
+}
+
+func TestSystemMemory(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+
+	previous := loadedMax
+	loadedMax = 0
+	t.Cleanup(func() { loadedMax = previous })
+
+	scenario1 := newScenario(t, ctx, "ollama-model-1", 0)
+	scenario2 := newScenario(t, ctx, "ollama-model-2", 0)
+	scenario3 := newScenario(t, ctx, "ollama-model-3", 0)
+
+	required := llm.EstimateTotalMemory(scenario1.ggml, nil, scenario1.req.opts)
+	scenario1.srv.estimatedTotal = required
+	scenario2.srv.estimatedTotal = required
+
+	// room for one model, but not two, after the reserve
+	mem := gpu.GpuInfo{Library: "cpu"}
+	mem.TotalMemory = required*3/2 + format.GigaByte
+	mem.FreeMemory = mem.TotalMemory
+
+	s := InitScheduler(ctx)
+	s.reservedMemory = format.GigaByte
+	s.getGpuFn = func() gpu.GpuInfoList { return []gpu.GpuInfo{mem} }
+	s.getCpuFn = func() gpu.GpuInfo { return mem }
+	s.newServerFn = scenario1.newServer
+	s.Run(ctx)
+
+	require.NoError(t, s.pending.push(scenario1.req, 0))
+	select {
+	case resp := <-scenario1.req.successCh:
+		require.Equal(t, scenario1.srv, resp.llama)
+	case err := <-scenario1.req.errCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// the first model is unloaded to make room for the second
+	s.newServerFn = scenario2.newServer
+	require.NoError(t, s.pending.push(scenario2.req, 0))
+	scenario1.ctxDone()
+	select {
+	case resp := <-scenario2.req.successCh:
+		require.Equal(t, scenario2.srv, resp.llama)
+		require.True(t, scenario1.srv.closeCalled)
+	case err := <-scenario2.req.errCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// a model that won't fit even once the others are unloaded is rejected
+	mem.TotalMemory = required + format.GigaByte - 1
+	s.newServerFn = scenario3.newServer
+	require.NoError(t, s.pending.push(scenario3.req, 0))
+	select {
+	case <-scenario3.req.successCh:
+		t.Fatal("model loaded without enough system memory")
+	case err := <-scenario3.req.errCh:
+		require.ErrorIs(t, err, errSystemMemory)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	require.Len(t, s.loaded, 1)
+}
+
+func TestSystemMemoryOffload(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+
+	previous := loadedMax
+	loadedMax = 0
+	t.Cleanup(func() { loadedMax = previous })
+
+	scenario1 := newScenario(t, ctx, "ollama-model-1", 0)
+	scenario2 := newScenario(t, ctx, "ollama-model-2", 0)
+
+	// too small to offload any layers
+	g := gpu.GpuInfo{Library: "cuda", ID: "GPU-0"}
+	g.TotalMemory = 600 * format.MebiByte
+	g.FreeMemory = g.TotalMemory
+	g.MinimumMemory = 457 * format.MebiByte
+
+	required := systemMemoryRequired(scenario1.req, scenario1.ggml, gpu.GpuInfoList{g})
+	require.Equal(t, llm.EstimateTotalMemory(scenario1.ggml, nil, scenario1.req.opts), required)
+
+	mem := gpu.GpuInfo{Library: "cpu"}
+	mem.TotalMemory = required + format.GigaByte - 1
+	mem.FreeMemory = mem.TotalMemory
+
+	s := InitScheduler(ctx)
+	s.reservedMemory = format.GigaByte
+	s.getGpuFn = func() gpu.GpuInfoList { return []gpu.GpuInfo{g} }
+	s.getCpuFn = func() gpu.GpuInfo { return mem }
+	s.newServerFn = scenario1.newServer
+	s.Run(ctx)
+
+	// layers left on the CPU are charged to system memory
+	require.NoError(t, s.pending.push(scenario1.req, 0))
+	select {
+	case <-scenario1.req.successCh:
+		t.Fatal("model loaded without enough system memory")
+	case err := <-scenario1.req.errCh:
+		require.ErrorIs(t, err, errSystemMemory)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// fully offloaded, the model needs no system memory
+	g.TotalMemory = 768 * format.MebiByte
+	g.FreeMemory = g.TotalMemory
+	require.Zero(t, systemMemoryRequired(scenario2.req, scenario2.ggml, gpu.GpuInfoList{g}))
+
+	s.newServerFn = scenario2.newServer
+	require.NoError(t, s.pending.push(scenario2.req, 0))
+	select {
+	case resp := <-scenario2.req.successCh:
+		require.Equal(t, scenario2.srv, resp.llama)
+	case err := <-scenario2.req.errCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestSimulatedGPUs(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	previous := loadedMax
+	loadedMax = 0
+	t.Cleanup(func() { loadedMax = previous })
+
+	scenario1 := newScenario(t, ctx, "ollama-model-1", 0)
+	scenario2 := newScenario(t, ctx, "ollama-model-2", 0)
+	scenario3 := newScenario(t, ctx, "ollama-model-3", 0)
+	for _, scenario := range []*bundle{scenario1, scenario2, scenario3} {
+		scenario.req.sessionDuration = time.Minute
+	}
+
+	// each GPU has room for one model
+	var gpus gpu.GpuInfoList
+	for _, id := range []string{"GPU-0", "GPU-1"} {
+		g := gpu.GpuInfo{Library: "cuda", ID: id}
+		g.TotalMemory = 768 * format.MebiByte
+		g.FreeMemory = g.TotalMemory
+		g.MinimumMemory = 457 * format.MebiByte
+		gpus = append(gpus, g)
+	}
+
+	system := gpu.GpuInfo{}
+	system.TotalMemory = 16 * format.GibiByte
+	system.FreeMemory = system.TotalMemory
+	sim := gpu.NewSimulated(gpus, system)
+
+	s := InitScheduler(ctx)
+	s.simulate(sim)
+	s.Run(ctx)
+
+	load := func(scenario *bundle) *runnerRef {
+		t.Helper()
+		require.NoError(t, s.pending.push(scenario.req, 0))
+		select {
+		case resp := <-scenario.req.successCh:
+			return resp
+		case err := <-scenario.req.errCh:
+			t.Fatal(err)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+
+		return nil
+	}
+
+	runner1 := load(scenario1)
+	runner2 := load(scenario2)
+	require.Len(t, runner1.gpus, 1)
+	require.Len(t, runner2.gpus, 1)
+	require.NotEqual(t, runner1.gpus[0].ID, runner2.gpus[0].ID)
+
+	for _, g := range sim.GetGPUInfo() {
+		require.Less(t, g.FreeMemory, g.TotalMemory-457*format.MebiByte, "no model loaded on %s", g.ID)
+	}
+
+	// the third model only fits once another is unloaded
+	scenario1.ctxDone()
+	scenario2.ctxDone()
+	runner3 := load(scenario3)
+	require.Len(t, runner3.gpus, 1)
+
+	// the simulated GPUs have room for the loaded models and no more
+	var used uint64
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 2)
+	for _, r := range s.loaded {
+		used += r.estimatedVRAM
+	}
+	s.loadedMu.Unlock()
+
+	var free uint64
+	for _, g := range sim.GetGPUInfo() {
+		free += g.FreeMemory
+	}
+	require.Equal(t, 2*768*format.MebiByte-used, free)
 }
 
 func TestFindRunnerToUnload(t *testing.T) {
@@ -516,6 +792,64 @@ func TestUnloadAllRunners(t *testing.T) {
 	require.True(t, llm2.closeCalled)
 }
 
+func TestSchedulerUnload(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	scenario := newScenario(t, ctx, "ollama-model-unload", 10)
+	scenario.req.sessionDuration = time.Hour
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = 24 * format.GigaByte
+		g.FreeMemory = 12 * format.GigaByte
+		return []gpu.GpuInfo{g}
+	}
+	s.newServerFn = scenario.newServer
+	s.Run(ctx)
+
+	err := s.Unload(ctx, scenario.req.model)
+	require.ErrorIs(t, err, errModelNotLoaded)
+
+	require.NoError(t, s.pending.push(scenario.req, 0))
+	select {
+	case resp := <-scenario.req.successCh:
+		require.Equal(t, resp.llama, scenario.srv)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// the unload must wait for the in-flight request to complete
+	unloaded := make(chan error, 1)
+	go func() {
+		unloaded <- s.Unload(ctx, scenario.req.model)
+	}()
+
+	select {
+	case err := <-unloaded:
+		t.Fatalf("unload completed with a request in flight: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	s.loadedMu.Unlock()
+
+	scenario.ctxDone()
+	select {
+	case err := <-unloaded:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	require.True(t, scenario.srv.closeCalled)
+	s.loadedMu.Lock()
+	require.Empty(t, s.loaded)
+	s.loadedMu.Unlock()
+}
+
 func TestUnload(t *testing.T) {
 	llm1 := &mockLlm{}
 	r1 := &runnerRef{llama: llm1}
@@ -527,18 +861,20 @@ func TestUnload(t *testing.T) {
 }
 
 type mockLlm struct {
-	pingResp          error
-	waitResp          error
-	completionResp    error
-	embeddingResp     []float64
-	embeddingRespErr  error
-	tokenizeResp      []int
-	tokenizeRespErr   error
-	detokenizeResp    string
-	detonekizeRespErr error
-	closeResp         error
-	closeCalled       bool
-	estimatedVRAM     uint64
+	pingResp           error
+	waitResp           error
+	completionResp     error
+	embeddingResp      [][]float64
+	embeddingRespErr   error
+	tokenizeResp       []int
+	tokenizeRespErr    error
+	detokenizeResp     string
+	detonekizeRespErr  error
+	closeResp          error
+	closeCalled        bool
+	estimatedVRAM      uint64
+	estimatedVRAMByGPU map[string]uint64
+	estimatedTotal     uint64
 }
 
 func (s *mockLlm) Ping(ctx context.Context) error             { return s.pingResp }
@@ -546,7 +882,7 @@ func (s *mockLlm) WaitUntilRunning(ctx context.Context) error { return s.waitRes
 func (s *mockLlm) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
 	return s.completionResp
 }
-func (s *mockLlm) Embedding(ctx context.Context, prompt string) ([]float64, error) {
+func (s *mockLlm) Embedding(ctx context.Context, input []string) ([][]float64, error) {
 	return s.embeddingResp, s.embeddingRespErr
 }
 func (s *mockLlm) Tokenize(ctx context.Context, content string) ([]int, error) {
@@ -559,4 +895,12 @@ func (s *mockLlm) Close() error {
 	s.closeCalled = true
 	return s.closeResp
 }
-func (s *mockLlm) EstimatedVRAM() uint64 { return s.estimatedVRAM }
+func (s *mockLlm) EstimatedVRAM() uint64  { return s.estimatedVRAM }
+func (s *mockLlm) EstimatedTotal() uint64 { return s.estimatedTotal }
+func (s *mockLlm) EstimatedVRAMByGPU(gpuID string) uint64 {
+	// without a breakdown by GPU the model is on a single GPU
+	if s.estimatedVRAMByGPU == nil {
+		return s.estimatedVRAM
+	}
+	return s.estimatedVRAMByGPU[gpuID]
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// tlsCertificates holds the server's certificate and the CAs trusted to sign
+// client certificates, which can be reloaded from disk while serving
+type tlsCertificates struct {
+	certFile, keyFile, clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// tlsFromConfig returns the certificates set by the tls_cert, tls_key and
+// tls_client_ca settings, or nil if TLS is not enabled
+func tlsFromConfig(cfg *envconfig.Config) (*tlsCertificates, error) {
+	certs := &tlsCertificates{
+		certFile:     cfg.TLSCert,
+		keyFile:      cfg.TLSKey,
+		clientCAFile: cfg.TLSClientCA,
+	}
+
+	switch {
+	case certs.certFile == "" && certs.keyFile == "" && certs.clientCAFile == "":
+		return nil, nil
+	case certs.certFile == "" || certs.keyFile == "":
+		return nil, errors.New("tls_cert and tls_key must both be set to enable TLS")
+	}
+
+	if err := certs.reload(); err != nil {
+		return nil, err
+	}
+
+	return certs, nil
+}
+
+// reload reads the certificates from disk again. The current certificates are
+// kept if any of them fail to load.
+func (t *tlsCertificates) reload() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if t.clientCAFile != "" {
+		pem, err := os.ReadFile(t.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client CA: %w", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("failed to load client CA: no certificates found in %s", t.clientCAFile)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cert = &cert
+	t.clientCAs = clientCAs
+	return nil
+}
+
+// config returns a TLS config that uses the latest certificates for each
+// connection, so reloading them doesn't require restarting the server
+func (t *tlsCertificates) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*t.cert},
+			}
+
+			if t.clientCAs != nil {
+				config.ClientCAs = t.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			return config, nil
+		},
+	}
+}
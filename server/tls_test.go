@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed
+// CA if parent is nil
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCertificate{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// write saves the certificate and its key to dir, returning their paths
+func (c *testCertificate) write(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, c.pem, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600))
+	return certFile, keyFile
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTLSFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	certFile, keyFile := newTestCertificate(t, "server", ca).write(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+
+	cases := []struct {
+		name          string
+		cert, key, ca string
+		enabled       bool
+		err           string
+	}{
+		{name: "disabled"},
+		{name: "cert and key", cert: certFile, key: keyFile, enabled: true},
+		{name: "client ca", cert: certFile, key: keyFile, ca: caFile, enabled: true},
+		{name: "missing key", cert: certFile, err: "must both be set"},
+		{name: "client ca only", ca: caFile, err: "must both be set"},
+		{name: "missing file", cert: filepath.Join(dir, "missing.pem"), key: keyFile, err: "failed to load TLS certificate"},
+		{name: "invalid client ca", cert: certFile, key: keyFile, ca: keyFile, err: "no certificates found"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			certs, err := tlsFromConfig(&envconfig.Config{TLSCert: tt.cert, TLSKey: tt.key, TLSClientCA: tt.ca})
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.enabled, certs != nil)
+		})
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	server := newTestCertificate(t, "server", ca)
+	client := newTestCertificate(t, "client", ca)
+
+	certFile, keyFile := server.write(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+
+	certs := &tlsCertificates{certFile: certFile, keyFile: keyFile, clientCAFile: caFile}
+	require.NoError(t, certs.reload())
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certs.config())
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(ln) //nolint:errcheck
+	t.Cleanup(func() { srv.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(cert *tls.Certificate) (*x509.Certificate, error) {
+		config := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+
+		c := http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := c.Get("https://" + ln.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		return resp.TLS.PeerCertificates[0], nil
+	}
+
+	clientCert := client.tlsCertificate()
+	peer, err := get(&clientCert)
+	require.NoError(t, err)
+	require.Equal(t, server.cert.SerialNumber, peer.SerialNumber)
+
+	_, err = get(nil)
+	require.Error(t, err, "expected client certificate to be required")
+
+	// a new certificate is served once reloaded
+	renewed := newTestCertificate(t, "server", ca)
+	renewed.write(t, dir)
+	require.NoError(t, certs.reload())
+
+	peer, err = get(&clientCert)
+	require.NoError(t, err)
+	require.Equal(t, renewed.cert.SerialNumber, peer.SerialNumber)
+
+	// a broken certificate leaves the previous one in place
+	require.NoError(t, os.WriteFile(certFile, []byte("invalid"), 0o600))
+	require.Error(t, certs.reload())
+
+	peer, err = get(&clientCert)
+	require.NoError(t, err)
+	require.Equal(t, renewed.cert.SerialNumber, peer.SerialNumber)
+}
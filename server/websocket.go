@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/logging"
+)
+
+// chatFrame is a message sent by the client of a chat socket. A "chat" frame
+// adds its messages to the conversation and generates a response, and a
+// "cancel" frame stops generating the response in progress.
+type chatFrame struct {
+	Type string `json:"type"`
+
+	// the model, options and other settings of a chat frame apply to the
+	// rest of the conversation
+	api.ChatRequest
+}
+
+// UnmarshalJSON decodes the frame's type alongside its chat request, whose
+// own UnmarshalJSON would otherwise decode the whole frame
+func (f *chatFrame) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	f.Type = v.Type
+	return json.Unmarshal(b, &f.ChatRequest)
+}
+
+// chatEvent is a message sent to the client of a chat socket. It is a
+// "response" with a chunk of the response being generated, an "error", or
+// "cancelled" once a response has stopped after a cancel frame.
+type chatEvent struct {
+	Type string `json:"type"`
+
+	*api.ChatResponse
+	Error string `json:"error,omitempty"`
+}
+
+// chatTurn is a response being generated for a chat socket
+type chatTurn struct {
+	cancel    context.CancelFunc
+	cancelled bool
+
+	// done receives the response once it has finished, or nil if it failed
+	done chan *api.Message
+}
+
+// chatSocketHandler serves a conversation over a WebSocket. Each turn of the
+// conversation is handled as a request to /api/chat by router, so it is
+// authorized and rate limited like any other.
+func (s *Server) chatSocketHandler(router http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		srv := websocket.Server{
+			// cross-origin requests have already been checked
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				serveChatSocket(ws, c.Request, router)
+			},
+		}
+
+		srv.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+func serveChatSocket(ws *websocket.Conn, r *http.Request, router http.Handler) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	send := func(e chatEvent) {
+		if err := websocket.JSON.Send(ws, e); err != nil {
+			slog.DebugContext(ctx, "failed to write to chat socket", "error", err)
+			cancel()
+		}
+	}
+
+	frames := make(chan chatFrame)
+	go func() {
+		defer close(frames)
+		for {
+			var bts []byte
+			if err := websocket.Message.Receive(ws, &bts); err != nil {
+				return
+			}
+
+			var f chatFrame
+			if err := json.Unmarshal(bts, &f); err != nil {
+				send(chatEvent{Type: "error", Error: "invalid frame: " + err.Error()})
+				continue
+			}
+
+			select {
+			case frames <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var settings api.ChatRequest
+	var history []api.Message
+	var turn *chatTurn
+
+	// finish adds the response of a turn that has ended to the conversation,
+	// or removes the messages that started it if it failed
+	finish := func(reply *api.Message, messages int) {
+		if reply == nil && !turn.cancelled {
+			history = history[:len(history)-messages]
+		} else if reply != nil && (reply.Content != "" || len(reply.ToolCalls) > 0) {
+			history = append(history, *reply)
+		}
+
+		turn = nil
+	}
+
+	var turnMessages int
+	for {
+		var done chan *api.Message
+		if turn != nil {
+			done = turn.done
+		}
+
+		select {
+		case reply := <-done:
+			finish(reply, turnMessages)
+		case <-ctx.Done():
+			return
+		case f, ok := <-frames:
+			if !ok {
+				return
+			}
+
+			switch f.Type {
+			case "cancel":
+				if turn != nil {
+					turn.cancelled = true
+					turn.cancel()
+				}
+			case "chat":
+				if turn != nil {
+					if !turn.cancelled {
+						send(chatEvent{Type: "error", Error: "a response is already in progress"})
+						continue
+					}
+
+					// a cancelled response stops right away
+					finish(<-turn.done, turnMessages)
+				}
+
+				settings = mergeChatSettings(settings, f.ChatRequest)
+				history = append(history, f.Messages...)
+				turnMessages = len(f.Messages)
+
+				req := settings
+				req.Messages = slices.Clone(history)
+
+				turnCtx, cancelTurn := context.WithCancel(ctx)
+				turn = &chatTurn{cancel: cancelTurn, done: make(chan *api.Message, 1)}
+				go func(t *chatTurn) {
+					defer cancelTurn()
+					reply := runChatTurn(turnCtx, r, router, req, func(e chatEvent) {
+						// errors from stopping the response aren't errors to the client
+						if e.Type == "error" && turnCtx.Err() != nil {
+							return
+						}
+
+						send(e)
+					})
+
+					if turnCtx.Err() != nil && ctx.Err() == nil {
+						send(chatEvent{Type: "cancelled"})
+					}
+
+					t.done <- reply
+				}(turn)
+			default:
+				send(chatEvent{Type: "error", Error: "unknown frame type " + strconv.Quote(f.Type)})
+			}
+		}
+	}
+}
+
+// mergeChatSettings returns settings updated with those set in req
+func mergeChatSettings(settings, req api.ChatRequest) api.ChatRequest {
+	if req.Model != "" {
+		settings.Model = req.Model
+	}
+
+	if req.KeepAlive != nil {
+		settings.KeepAlive = req.KeepAlive
+	}
+
+	if req.Format != "" {
+		settings.Format = req.Format
+	}
+
+	if req.Tools != nil {
+		settings.Tools = req.Tools
+	}
+
+	if req.Priority != "" {
+		settings.Priority = req.Priority
+	}
+
+	if req.Logprobs != 0 {
+		settings.Logprobs = req.Logprobs
+	}
+
+	if req.Options != nil {
+		settings.Options = req.Options
+	}
+
+	return settings
+}
+
+// runChatTurn generates a response to req by sending it to /api/chat,
+// passing each chunk of the response to send. It returns the response once
+// it is done or cancelled, or nil if it failed.
+func runChatTurn(ctx context.Context, r *http.Request, router http.Handler, req api.ChatRequest, send func(chatEvent)) *api.Message {
+	stream := true
+	req.Stream = &stream
+
+	bts, err := json.Marshal(req)
+	if err != nil {
+		send(chatEvent{Type: "error", Error: err.Error()})
+		return nil
+	}
+
+	turn, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/chat", bytes.NewReader(bts))
+	if err != nil {
+		send(chatEvent{Type: "error", Error: err.Error()})
+		return nil
+	}
+
+	// keep the credentials, origin and other headers of the socket's client,
+	// and its request ID so turns can be matched to the socket in the logs
+	for name, values := range r.Header {
+		if !isSocketHeader(name) {
+			turn.Header[name] = slices.Clone(values)
+		}
+	}
+	if id := logging.RequestID(r.Context()); id != "" {
+		turn.Header.Set(requestIDHeader, id)
+	}
+	turn.Header.Set("Content-Type", "application/json")
+	turn.Header.Set("Accept", "application/x-ndjson")
+	turn.Host = r.Host
+	turn.RemoteAddr = r.RemoteAddr
+
+	reply := api.Message{Role: "assistant"}
+	var content strings.Builder
+	var failed bool
+
+	w := &chatTurnWriter{header: make(http.Header), status: http.StatusOK}
+	w.line = func(line []byte) {
+		var resp struct {
+			api.ChatResponse
+			Error string `json:"error"`
+		}
+
+		if err := json.Unmarshal(line, &resp); err != nil {
+			failed = true
+			send(chatEvent{Type: "error", Error: strings.TrimSpace(string(line))})
+			return
+		}
+
+		if resp.Error != "" {
+			failed = true
+			send(chatEvent{Type: "error", Error: resp.Error})
+			return
+		}
+
+		content.WriteString(resp.Message.Content)
+		if resp.Done {
+			reply.ToolCalls = resp.Message.ToolCalls
+		}
+
+		send(chatEvent{Type: "response", ChatResponse: &resp.ChatResponse})
+	}
+
+	router.ServeHTTP(w, turn)
+	w.flush()
+
+	if w.status >= http.StatusBadRequest && !failed {
+		failed = true
+		send(chatEvent{Type: "error", Error: http.StatusText(w.status)})
+	}
+
+	if failed && ctx.Err() == nil {
+		return nil
+	}
+
+	reply.Content = content.String()
+	if len(reply.ToolCalls) > 0 {
+		reply.Content = ""
+	}
+
+	return &reply
+}
+
+// socketHeaders are the hop-by-hop and WebSocket handshake headers of a chat
+// socket's request, which don't apply to its turns
+var socketHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func isSocketHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return slices.Contains(socketHeaders, name) || strings.HasPrefix(name, "Sec-Websocket-")
+}
+
+// chatTurnWriter is the http.ResponseWriter of a chat socket's turn. It
+// passes each line of newline delimited JSON written to it to line.
+type chatTurnWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+	line   func([]byte)
+}
+
+func (w *chatTurnWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *chatTurnWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *chatTurnWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+
+		if line := bytes.TrimSpace(w.buf.Next(i + 1)); len(line) > 0 {
+			w.line(line)
+		}
+	}
+
+	return len(p), nil
+}
+
+// flush passes on a final response that isn't terminated by a newline, such
+// as an error
+func (w *chatTurnWriter) flush() {
+	if line := bytes.TrimSpace(w.buf.Bytes()); len(line) > 0 {
+		w.line(line)
+	}
+
+	w.buf.Reset()
+}
+
+func (w *chatTurnWriter) Flush() {}
+
+// CloseNotify is needed to stream responses. Turns end when their context is
+// cancelled instead.
+func (w *chatTurnWriter) CloseNotify() <-chan bool {
+	return nil
+}
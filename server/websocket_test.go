@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/logging"
+)
+
+func TestChatSocket(t *testing.T) {
+	var mu sync.Mutex
+	var requests []api.ChatRequest
+
+	// chat stands in for the chat handler: "fast" replies right away, "slow"
+	// replies until its request is cancelled and "missing" doesn't exist
+	chat := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.ChatRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		enc := json.NewEncoder(w)
+		switch req.Model {
+		case "fast":
+			enc.Encode(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: "Hello"}})                               //nolint:errcheck
+			enc.Encode(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: " world"}})                              //nolint:errcheck
+			enc.Encode(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant"}, Done: true, Metrics: api.Metrics{EvalCount: 2}}) //nolint:errcheck
+		case "slow":
+			enc.Encode(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: "Thinking"}}) //nolint:errcheck
+			<-r.Context().Done()
+			enc.Encode(gin.H{"error": r.Context().Err().Error()}) //nolint:errcheck
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"model 'missing' not found"}`)) //nolint:errcheck
+		}
+	})
+
+	s := &Server{}
+	r := gin.New()
+	r.GET("/api/chat/ws", s.chatSocketHandler(chat))
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/chat/ws", "", srv.URL)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.Close() })
+
+	send := func(f any) {
+		t.Helper()
+		require.NoError(t, websocket.JSON.Send(ws, f))
+	}
+
+	receive := func() chatEvent {
+		t.Helper()
+		var e chatEvent
+		require.NoError(t, websocket.JSON.Receive(ws, &e))
+		return e
+	}
+
+	// reply reads response events until the response is done
+	reply := func() string {
+		t.Helper()
+		var sb strings.Builder
+		for {
+			e := receive()
+			require.Equal(t, "response", e.Type, e.Error)
+			sb.WriteString(e.Message.Content)
+			if e.Done {
+				assert.Equal(t, 2, e.EvalCount)
+				return sb.String()
+			}
+		}
+	}
+
+	user := func(content string) []api.Message {
+		return []api.Message{{Role: "user", Content: content}}
+	}
+
+	lastRequest := func() api.ChatRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[len(requests)-1]
+	}
+
+	send(map[string]any{"type": "chat", "model": "fast", "messages": user("Hi")})
+	assert.Equal(t, "Hello world", reply())
+
+	t.Run("keeps the conversation", func(t *testing.T) {
+		send(map[string]any{"type": "chat", "messages": user("Again")})
+		assert.Equal(t, "Hello world", reply())
+
+		req := lastRequest()
+		assert.Equal(t, "fast", req.Model)
+		assert.Equal(t, []api.Message{
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", Content: "Hello world"},
+			{Role: "user", Content: "Again"},
+		}, req.Messages)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		send(map[string]any{"type": "chat", "model": "slow", "messages": user("Think")})
+		e := receive()
+		require.Equal(t, "response", e.Type)
+		assert.Equal(t, "Thinking", e.Message.Content)
+
+		send(map[string]any{"type": "chat", "messages": user("Too soon")})
+		e = receive()
+		assert.Equal(t, "error", e.Type)
+		assert.Contains(t, e.Error, "already in progress")
+
+		// the next message is accepted right after cancelling
+		send(map[string]any{"type": "cancel"})
+		send(map[string]any{"type": "chat", "model": "fast", "messages": user("Stop")})
+		assert.Equal(t, "cancelled", receive().Type)
+		assert.Equal(t, "Hello world", reply())
+
+		req := lastRequest()
+		assert.Equal(t, []api.Message{
+			{Role: "assistant", Content: "Thinking"},
+			{Role: "user", Content: "Stop"},
+		}, req.Messages[len(req.Messages)-2:])
+	})
+
+	t.Run("error", func(t *testing.T) {
+		send(map[string]any{"type": "chat", "model": "missing", "messages": user("Hello?")})
+		e := receive()
+		assert.Equal(t, "error", e.Type)
+		assert.Equal(t, "model 'missing' not found", e.Error)
+
+		// failed messages are removed from the conversation
+		send(map[string]any{"type": "chat", "model": "fast", "messages": user("Hello")})
+		assert.Equal(t, "Hello world", reply())
+
+		req := lastRequest()
+		assert.Equal(t, api.Message{Role: "user", Content: "Stop"}, req.Messages[len(req.Messages)-3])
+	})
+
+	t.Run("unknown frame", func(t *testing.T) {
+		send(map[string]any{"type": "pause"})
+		e := receive()
+		assert.Equal(t, "error", e.Type)
+		assert.Equal(t, `unknown frame type "pause"`, e.Error)
+	})
+}
+
+func TestChatSocketAPIKey(t *testing.T) {
+	s := &Server{
+		apiKeys: &apiKeys{Keys: []apiKey{
+			{Name: "reader", Key: "reader-key", Models: []string{"fast"}, Operations: []operation{opInference}},
+		}},
+		limiter: newRateLimiter(rateLimits{}),
+	}
+
+	var mu sync.Mutex
+	var clients, ids []string
+
+	r := gin.New()
+	r.Use(requestIDMiddleware(), s.authMiddleware())
+	r.POST("/api/chat", authorize(opInference), s.rateLimit(), func(c *gin.Context) {
+		mu.Lock()
+		clients = append(clients, c.GetString(rateLimitClientContextKey))
+		ids = append(ids, logging.RequestID(c.Request.Context()))
+		mu.Unlock()
+
+		c.JSON(http.StatusOK, api.ChatResponse{Model: "fast", Message: api.Message{Role: "assistant", Content: "Hello"}, Done: true})
+	})
+	r.GET("/api/chat/ws", authorize(opInference), s.chatSocketHandler(r))
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/chat/ws", srv.URL)
+	require.NoError(t, err)
+	config.Header.Set("X-Api-Key", "reader-key")
+	config.Header.Set("X-Request-ID", "socket-1")
+
+	ws, err := websocket.DialConfig(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.Close() })
+
+	require.NoError(t, websocket.JSON.Send(ws, map[string]any{"type": "chat", "model": "fast", "messages": []api.Message{{Role: "user", Content: "Hi"}}}))
+
+	var e chatEvent
+	require.NoError(t, websocket.JSON.Receive(ws, &e))
+	require.Equal(t, "response", e.Type, e.Error)
+	assert.Equal(t, "Hello", e.Message.Content)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"key:reader-key"}, clients)
+	assert.Equal(t, []string{"socket-1"}, ids)
+}